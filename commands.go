@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// commands are subcommands invoked as `grit <command> [flags]`. Anything else
+// falls through to the original flag interface (grit -run, grit -export, ...).
+var commands = map[string]func(args []string){
+	"dashboard": dashboardCommand,
+	"export":    exportCommand,
+	"graph":     graphCommand,
+	"import":    importCommand,
+	"migrate":   migrateCommand,
+	"mount":     mountCommand,
+	"runs":      runsCommand,
+	"serve":     serveCommand,
+	"stats":     statsCommand,
+	"status":    statusCommand,
+	"validate":  validateCommand,
+	"watch":     watchCommand,
+	"worker":    workerCommand,
+}
+
+// runCommand dispatches os.Args to a subcommand, returning false if there is none
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	command, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+
+	command(args[1:])
+	return true
+}
+
+// parseArgs parses fs from args, allowing flags and positional arguments to be
+// interleaved (grit mount ./mnt -db ./db). Returns the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+
+		// Parsing stopped at "--": everything after it is positional
+		consumed := len(args) - len(rest)
+		if consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...)
+		}
+
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// databaseFlags are the flags every subcommand uses to locate the database
+type databaseFlags struct {
+	path        *string
+	objectStore *string
+}
+
+func addDatabaseFlags(fs *flag.FlagSet) databaseFlags {
+	return databaseFlags{
+		path:        fs.String("db", "./db", "database path"),
+		objectStore: fs.String("object-store", "", "object store: badger, dir, dir:PATH or s3://BUCKET/PREFIX (defaults to badger)"),
+	}
+}
+
+// open opens the database, exiting with a readable error on failure
+func (f databaseFlags) open(opts DatabaseOptions) Database {
+	if opts.ObjectStore == "" {
+		opts.ObjectStore = *f.objectStore
+	}
+
+	mainLogger.Info("Initializing database", "path", *f.path)
+	database, err := NewDatabase(*f.path, opts)
+	if err != nil {
+		fatal("Failed to open database", "path", *f.path, "error", err)
+	}
+	return database
+}
+
+// fatal logs msg and its key/value fields as an error and exits
+func fatal(msg string, args ...any) {
+	mainLogger.Error(msg, args...)
+	os.Exit(1)
+}
+
+func commandUsage(fs *flag.FlagSet, usage string) {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: grit %s\n\n", usage)
+		fs.PrintDefaults()
+	}
+}
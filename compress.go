@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how an object is encoded before it reaches the object store.
+type Compression string
+
+const (
+	CompressAuto Compression = "auto" // zstd when it saves space, raw otherwise
+	CompressZstd Compression = "zstd" // always zstd
+	CompressNone Compression = "none" // always raw
+)
+
+// Codec bytes recorded in the object header
+const (
+	codecNone byte = 0
+	codecZstd byte = 1
+)
+
+// Every stored object starts with objectMagic followed by a single codec byte.
+// Objects written before compression support have no header; the database
+// records them in the raw_object table and they are returned unchanged.
+var objectMagic = []byte{0x00, 'G', 'R', 'T'}
+
+const objectHeaderSize = 5
+
+// Objects smaller than this are never worth compressing
+const minCompressSize = 256
+
+// The zstd encoder and decoder are safe for concurrent use and shared by all objects
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+)
+
+// ParseCompression validates a compression mode from the manifest; empty means auto
+func ParseCompression(s string) (Compression, error) {
+	switch Compression(s) {
+	case "", CompressAuto:
+		return CompressAuto, nil
+	case CompressZstd, CompressNone:
+		return Compression(s), nil
+	}
+	return "", fmt.Errorf("unknown compression %q (expected auto, zstd or none)", s)
+}
+
+// encodeObject prefixes data with a codec header, compressing it according to mode
+func encodeObject(data []byte, mode Compression) ([]byte, error) {
+	if mode == CompressZstd || (mode != CompressNone && len(data) >= minCompressSize) {
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		compressed := encoder.EncodeAll(data, make([]byte, objectHeaderSize, objectHeaderSize+len(data)/2))
+		copy(compressed, objectMagic)
+		compressed[len(objectMagic)] = codecZstd
+
+		// In auto mode only keep the compressed form if it saves at least 10%
+		if mode == CompressZstd || len(compressed) < len(data)*9/10 {
+			return compressed, nil
+		}
+	}
+
+	encoded := make([]byte, objectHeaderSize+len(data))
+	copy(encoded, objectMagic)
+	encoded[len(objectMagic)] = codecNone
+	copy(encoded[objectHeaderSize:], data)
+	return encoded, nil
+}
+
+// decodeObject strips the codec header and returns the original bytes. Objects
+// stored before compression support (framed false) have no header and are
+// returned unchanged.
+func decodeObject(raw []byte, framed bool) ([]byte, error) {
+	if !framed {
+		return raw, nil
+	}
+	if len(raw) < objectHeaderSize || !bytes.HasPrefix(raw, objectMagic) {
+		return nil, fmt.Errorf("object has no codec header")
+	}
+
+	switch raw[len(objectMagic)] {
+	case codecNone:
+		return raw[objectHeaderSize:], nil
+	case codecZstd:
+		decoder, err := zstdDecoder()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+		}
+		return decoder.DecodeAll(raw[objectHeaderSize:], nil)
+	default:
+		return nil, fmt.Errorf("unknown object codec %d", raw[len(objectMagic)])
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestObjectEncodingRoundTrip(t *testing.T) {
+	text := []byte(strings.Repeat("grit stores objects behind a codec header\n", 100))
+	tests := []struct {
+		name  string
+		data  []byte
+		mode  Compression
+		codec byte
+	}{
+		{"auto compresses text", text, CompressAuto, codecZstd},
+		{"auto leaves small objects", []byte("small"), CompressAuto, codecNone},
+		{"auto leaves incompressible data", incompressible(4096), CompressAuto, codecNone},
+		{"zstd compresses anything", []byte("small"), CompressZstd, codecZstd},
+		{"none never compresses", text, CompressNone, codecNone},
+		{"empty object", []byte{}, CompressAuto, codecNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := encodeObject(tt.data, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(encoded, objectMagic) || encoded[len(objectMagic)] != tt.codec {
+				t.Errorf("header %x, want codec %d", encoded[:min(len(encoded), objectHeaderSize)], tt.codec)
+			}
+			decoded, err := decodeObject(encoded, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, tt.data) {
+				t.Errorf("decoded %d bytes, want the %d encoded", len(decoded), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestDecodeObject(t *testing.T) {
+	// Objects from before compression support may look like anything, even a header
+	legacy := append(append([]byte{}, objectMagic...), 7, 'x')
+	if data, err := decodeObject(legacy, false); err != nil || !bytes.Equal(data, legacy) {
+		t.Errorf("raw object: got %q, %v, want it unchanged", data, err)
+	}
+	for name, raw := range map[string][]byte{
+		"no header":     []byte("plain text"),
+		"short":         objectMagic[:2],
+		"unknown codec": append(append([]byte{}, objectMagic...), 7, 'x'),
+	} {
+		if _, err := decodeObject(raw, true); err == nil {
+			t.Errorf("%s: decoding succeeded, want an error", name)
+		}
+	}
+}
+
+// incompressible returns n bytes that zstd cannot shrink
+func incompressible(n int) []byte {
+	data := make([]byte, n)
+	x := uint32(2463534242)
+	for i := range data {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		data[i] = byte(x)
+	}
+	return data
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var coordinatorLogger = NewLogger("COORDINATOR")
+
+// Coordinator hands tasks to remote workers (grit worker) instead of running them
+// locally. A worker leases a task, runs it and reports back with its outputs; a
+// lease that is not renewed by a heartbeat expires and the task is handed out again.
+// Leases only live in memory: if the coordinator restarts, leased tasks are still
+// unprocessed in the database and are simply leased again.
+type Coordinator struct {
+	db      *Database
+	outputs chan FileData
+	ttl     time.Duration
+
+	mu       sync.Mutex
+	steps    map[int64]Step    // steps of the current run, by id
+	order    []Step            // steps of the current run, upstream first
+	queue    []Task            // unprocessed tasks of the current run that are not leased
+	leases   map[string]*Lease // by lease id
+	byTask   map[int64]*Lease
+	executed int64
+	active   bool
+	stopping bool
+	changed  chan struct{}   // closed and replaced whenever work may have become available
+	runCtx   context.Context // carries the span of the current run
+}
+
+// Lease is a task handed to a worker
+type Lease struct {
+	ID      string
+	Task    Task
+	Step    Step
+	Input   *Resource
+	Worker  string
+	Host    string // host and pid of the worker process
+	PID     int
+	Started time.Time
+	Expires time.Time
+	Trace   map[string]string // trace context of the task's span, passed to the script
+
+	span       trace.Span
+	completing bool // outputs are being uploaded; the lease no longer expires
+}
+
+// leaseWait is how long a worker's lease request waits for work before returning empty
+const leaseWait = 20 * time.Second
+
+func NewCoordinator(db *Database, ttl time.Duration) *Coordinator {
+	return &Coordinator{
+		db:      db,
+		outputs: db.MakeResourceConsumer(),
+		ttl:     ttl,
+		leases:  make(map[string]*Lease),
+		byTask:  make(map[int64]*Lease),
+		changed: make(chan struct{}),
+	}
+}
+
+// notify wakes up Run and any worker waiting for a lease. c.mu must be held.
+func (c *Coordinator) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Run schedules the tasks of steps and waits for workers to process them, until
+// no step has work left or Shutdown is called. Returns the number of tasks completed.
+func (c *Coordinator) Run(ctx context.Context, steps []Step) (int64, error) {
+	if err := c.seed(steps); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	if c.stopping {
+		c.mu.Unlock()
+		return 0, nil
+	}
+	c.steps = make(map[int64]Step, len(steps))
+	for _, step := range steps {
+		c.steps[step.ID] = step
+	}
+	c.order = steps
+	c.queue = nil
+	c.executed = 0
+	c.active = true
+	c.runCtx = ctx
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.active = false
+		c.queue = nil
+		c.notify()
+		c.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(max(c.ttl/4, 100*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		c.mu.Lock()
+		c.expireLeases()
+		if c.stopping {
+			executed := c.executed
+			c.mu.Unlock()
+			return executed, nil
+		}
+		if len(c.queue) == 0 {
+			if err := c.refill(); err != nil {
+				executed := c.executed
+				c.mu.Unlock()
+				return executed, err
+			}
+			if len(c.queue) == 0 && len(c.leases) == 0 {
+				executed := c.executed
+				c.mu.Unlock()
+				return executed, nil
+			}
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// seed creates the start step's task when there are no resources yet, like seedPipeline
+func (c *Coordinator) seed(steps []Step) error {
+	count, err := c.db.CountResources()
+	if err != nil || count > 0 {
+		return err
+	}
+
+	startStep, err := c.db.GetStartingStep()
+	if err != nil {
+		return err
+	}
+	if startStep == nil {
+		return fmt.Errorf("no start step found in manifest")
+	}
+	if !slices.ContainsFunc(steps, func(s Step) bool { return s.ID == startStep.ID }) {
+		return nil
+	}
+
+	// A seed task from an interrupted run is still pending and will be leased again
+	pending := false
+	for range c.db.GetUnprocessedTasks(startStep.ID) {
+		pending = true
+	}
+	if pending {
+		return nil
+	}
+
+	runLogger.Info("No resources found, scheduling seed task", "step", startStep.Name)
+	_, err = c.db.CreateTask(Task{StepID: startStep.ID})
+	return err
+}
+
+// refill schedules tasks for every step and queues the unprocessed ones that
+// are not leased. c.mu must be held.
+func (c *Coordinator) refill() error {
+	for _, step := range c.order {
+		created, err := c.db.ScheduleTasksForStep(step.ID)
+		if err != nil {
+			return fmt.Errorf("scheduling tasks for step %s: %w", step.Name, err)
+		}
+		if created > 0 {
+			pipelineLogger.Info("Scheduled new tasks", "step", step.Name, "count", created)
+		}
+	}
+
+	for _, step := range c.order {
+		for task := range c.db.GetUnprocessedTasks(step.ID) {
+			if _, leased := c.byTask[task.ID]; !leased {
+				c.queue = append(c.queue, task)
+			}
+		}
+	}
+	if len(c.queue) > 0 {
+		c.notify()
+	}
+	return nil
+}
+
+// expireLeases requeues the tasks of workers that stopped sending heartbeats. c.mu must be held.
+func (c *Coordinator) expireLeases() {
+	now := time.Now()
+	for id, lease := range c.leases {
+		if lease.completing || now.Before(lease.Expires) {
+			continue
+		}
+		coordinatorLogger.Warn("Lease expired, requeueing task", "task_id", lease.Task.ID, "step", lease.Step.Name, "worker", lease.Worker)
+		delete(c.leases, id)
+		delete(c.byTask, lease.Task.ID)
+		c.requeue(lease, errors.New("lease expired"))
+	}
+}
+
+// requeue makes the task of a lost lease pending again, discarding any outputs
+// already recorded, and puts it at the front of the queue. c.mu must be held.
+func (c *Coordinator) requeue(lease *Lease, reason error) {
+	task := lease.Task
+	endSpan(lease.span, reason)
+	if _, err := c.db.ResetTask(task.ID); err != nil {
+		coordinatorLogger.Error("Failed to reset task", "task_id", task.ID, "error", err)
+	}
+	if c.active {
+		c.queue = append([]Task{task}, c.queue...)
+	}
+	c.notify()
+}
+
+// Lease hands the next available task to worker, waiting up to leaseWait for one.
+// Returns nil if there is no work, done is closed first or the coordinator is shutting down.
+func (c *Coordinator) Lease(worker string, host string, pid int, done <-chan struct{}) (*Lease, error) {
+	timeout := time.NewTimer(leaseWait)
+	defer timeout.Stop()
+
+	for {
+		c.mu.Lock()
+		lease, err := c.next(worker, host, pid)
+		changed, stopping := c.changed, c.stopping
+		c.mu.Unlock()
+		if lease != nil || err != nil || stopping {
+			return lease, err
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return nil, nil
+		case <-done:
+			return nil, nil
+		}
+	}
+}
+
+// next leases the first queued task whose step is below its parallel limit. c.mu must be held.
+func (c *Coordinator) next(worker string, host string, pid int) (*Lease, error) {
+	if !c.active || c.stopping {
+		return nil, nil
+	}
+
+	leasedPerStep := make(map[int64]int)
+	for _, lease := range c.leases {
+		leasedPerStep[lease.Task.StepID]++
+	}
+
+	for i := 0; i < len(c.queue); i++ {
+		task := c.queue[i]
+		step := c.steps[task.StepID]
+		if step.Parallel != nil && *step.Parallel > 0 && leasedPerStep[step.ID] >= *step.Parallel {
+			continue
+		}
+		c.queue = slices.Delete(c.queue, i, i+1)
+		i--
+
+		// The task may have been cancelled since it was queued
+		current, err := c.db.GetTask(task.ID)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil || current.Processed {
+			continue
+		}
+
+		var input *Resource
+		if task.InputResourceID != nil {
+			input, err = c.db.GetResource(*task.InputResourceID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		version, err := c.db.GetStep(step.ID)
+		if err != nil {
+			return nil, err
+		}
+		step.Version = version.Version
+
+		id, err := newLeaseID()
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		if err := c.db.StartTask(task.ID, runIDFromContext(c.runCtx), host, pid); err != nil {
+			return nil, err
+		}
+		ctx, span := tracer.Start(c.runCtx, "task "+step.Name, taskSpanAttributes(task.ID, step),
+			trace.WithAttributes(attribute.String("grit.worker", worker)))
+		lease := &Lease{ID: id, Task: task, Step: step, Input: input, Worker: worker, Host: host, PID: pid, Started: now, Expires: now.Add(c.ttl), Trace: traceHeaders(ctx), span: span}
+		c.leases[id] = lease
+		c.byTask[task.ID] = lease
+
+		metrics.TaskStarted(step.Name)
+		coordinatorLogger.Debug("Leased task", "task_id", task.ID, "step", step.Name, "worker", worker)
+		return lease, nil
+	}
+	return nil, nil
+}
+
+func newLeaseID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Heartbeat extends a lease, returning false if it has expired or been cancelled
+// and the worker should stop the task
+func (c *Coordinator) Heartbeat(leaseID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lease, ok := c.leases[leaseID]
+	if !ok {
+		return false
+	}
+	lease.Expires = time.Now().Add(c.ttl)
+	return true
+}
+
+// Release gives up a lease without a result, putting the task back in the queue
+func (c *Coordinator) Release(leaseID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lease, ok := c.leases[leaseID]
+	if !ok || lease.completing {
+		return false
+	}
+	coordinatorLogger.Info("Task released, requeueing", "task_id", lease.Task.ID, "step", lease.Step.Name, "worker", lease.Worker)
+	delete(c.leases, leaseID)
+	delete(c.byTask, lease.Task.ID)
+	c.requeue(lease, errors.New("lease released"))
+	return true
+}
+
+// LeaseOutput is a file a worker's task wrote to its output directory
+type LeaseOutput struct {
+	Name   string
+	Reader io.Reader
+}
+
+// ErrLeaseNotFound is returned for leases that expired, were released or whose task was cancelled
+var ErrLeaseNotFound = fmt.Errorf("lease not found (it expired or the task was cancelled)")
+
+// Complete records the result of a leased task and, if the script ran, its usage.
+// next is called for each output until it returns io.EOF; outputs are stored like
+// those of local tasks. If reading the outputs fails the task is requeued.
+func (c *Coordinator) Complete(leaseID string, taskErr *string, log string, usage *TaskUsage, next func() (*LeaseOutput, error)) error {
+	c.mu.Lock()
+	lease, ok := c.leases[leaseID]
+	if !ok || lease.completing {
+		c.mu.Unlock()
+		return ErrLeaseNotFound
+	}
+	lease.completing = true
+	c.mu.Unlock()
+
+	var committed sync.WaitGroup
+	var commitMu sync.Mutex
+	var commitErr error // first output that failed to be stored or recorded
+	var readErr error
+	var written, refused []string
+	for {
+		output, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil && !lease.Step.Outputs.allows(output.Name) {
+			// Workers write to a plain directory, so undeclared outputs are refused here
+			if lease.Step.Outputs.WarnUndeclared {
+				coordinatorLogger.Warn("Undeclared output", "task_id", lease.Task.ID, "file", output.Name)
+			} else {
+				coordinatorLogger.Warn("Undeclared output refused", "task_id", lease.Task.ID, "file", output.Name)
+				refused = append(refused, output.Name)
+				_, err = io.Copy(io.Discard, output.Reader)
+				if err == nil {
+					continue
+				}
+			}
+		}
+		if err == nil {
+			var data []byte
+			data, err = io.ReadAll(output.Reader)
+			if err == nil && len(data) > 0 {
+				written = append(written, output.Name)
+			}
+			if err == nil {
+				committed.Add(1)
+				c.outputs <- FileData{
+					Name:     lease.Step.Outputs.storedName(output.Name),
+					Reader:   bytes.NewReader(data),
+					TaskID:   lease.Task.ID,
+					Compress: lease.Step.Compress,
+					Committed: func(err error) {
+						if err != nil {
+							commitMu.Lock()
+							if commitErr == nil {
+								commitErr = err
+							}
+							commitMu.Unlock()
+						}
+						committed.Done()
+					},
+				}
+			}
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	committed.Wait()
+
+	if readErr == nil && taskErr == nil && commitErr != nil {
+		msg := commitErr.Error()
+		taskErr = &msg
+	}
+	if readErr == nil && taskErr == nil {
+		if err := lease.Step.Outputs.check(written, refused); err != nil {
+			msg := err.Error()
+			taskErr = &msg
+		}
+	}
+	if readErr == nil {
+		if err := c.db.SaveTaskLog(lease.Task.ID, log); err != nil {
+			coordinatorLogger.Warn("Failed to save task log", "task_id", lease.Task.ID, "error", err)
+		}
+		if usage != nil {
+			if err := c.db.SaveTaskUsage(lease.Task.ID, *usage); err != nil {
+				coordinatorLogger.Warn("Failed to save task usage", "task_id", lease.Task.ID, "error", err)
+			}
+		}
+		readErr = c.db.UpdateTaskStatus(lease.Task.ID, true, taskErr)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.leases, leaseID)
+	delete(c.byTask, lease.Task.ID)
+	if readErr != nil {
+		coordinatorLogger.Error("Failed to record task result, requeueing", "task_id", lease.Task.ID, "step", lease.Step.Name, "worker", lease.Worker, "error", readErr)
+		c.requeue(lease, readErr)
+		return readErr
+	}
+
+	wall := time.Since(lease.Started)
+	if usage != nil {
+		wall = usage.Wall()
+	}
+	metrics.TaskFinished(lease.Step.Name, wall, taskErr != nil)
+	if usage != nil {
+		lease.span.SetAttributes(usage.spanAttributes()...)
+	}
+	if taskErr != nil {
+		endSpan(lease.span, errors.New(*taskErr))
+	} else {
+		lease.span.End()
+	}
+	if taskErr != nil {
+		pipelineLogger.Error("Task failed", "task_id", lease.Task.ID, "step", lease.Step.Name, "worker", lease.Worker, "error", *taskErr)
+		taskFailed(c.runCtx, *c.db, lease.Task.ID, lease.Step, *taskErr)
+	} else {
+		executeLogger.Info("Executed task", "task_id", lease.Task.ID, "step", lease.Step.Name, "worker", lease.Worker, "duration", time.Since(lease.Started).Round(time.Millisecond))
+	}
+	c.executed++
+	c.notify()
+	return nil
+}
+
+// CancelTask records a pending or leased task as failed with ErrTaskCancelled.
+// A worker running it finds out at its next heartbeat and kills the script.
+// Returns false if the task has already finished.
+func (c *Coordinator) CancelTask(taskID int64) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lease, leased := c.byTask[taskID]
+	if leased && lease.completing {
+		return false, nil
+	}
+
+	task, err := c.db.GetTask(taskID)
+	if err != nil || task == nil || task.Processed {
+		return false, err
+	}
+	msg := ErrTaskCancelled
+	if err := c.db.UpdateTaskStatus(taskID, true, &msg); err != nil {
+		return false, err
+	}
+
+	if leased {
+		metrics.TaskFinished(lease.Step.Name, time.Since(lease.Started), true)
+		endSpan(lease.span, errors.New(ErrTaskCancelled))
+		delete(c.leases, lease.ID)
+		delete(c.byTask, taskID)
+		c.notify()
+	}
+	return true, nil
+}
+
+// LeaseOf returns the lease of a task, or nil if no worker is running it
+func (c *Coordinator) LeaseOf(taskID int64) *Lease {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if lease, ok := c.byTask[taskID]; ok {
+		snapshot := *lease
+		return &snapshot
+	}
+	return nil
+}
+
+// Leases returns the current leases, oldest first
+func (c *Coordinator) Leases() []Lease {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	leases := make([]Lease, 0, len(c.leases))
+	for _, lease := range c.leases {
+		leases = append(leases, *lease)
+	}
+	slices.SortFunc(leases, func(a, b Lease) int { return a.Started.Compare(b.Started) })
+	return leases
+}
+
+// Shutdown ends the current run and drops every lease, so workers stop their
+// tasks at their next heartbeat. Leased tasks are pending again for the next run.
+func (c *Coordinator) Shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopping = true
+	c.active = false
+	for id, lease := range c.leases {
+		if !lease.completing {
+			delete(c.leases, id)
+			delete(c.byTask, lease.Task.ID)
+			c.requeue(lease, errors.New("coordinator shutting down"))
+		}
+	}
+	c.notify()
+}
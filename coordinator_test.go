@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCoordinator opens a database in a temporary directory with a manifest
+// of one start step and runs a coordinator for it until the test ends
+func newTestCoordinator(t *testing.T, ttl time.Duration) (*Coordinator, *Database) {
+	dir := t.TempDir()
+	manifestPath := filepath.Join(dir, "workflow.toml")
+	err := os.WriteFile(manifestPath, []byte("[[step]]\nname = \"seed\"\nstart = true\nscript = \"echo hi > $OUTPUT_DIR/greeting\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := LoadManifest(manifestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database, err := NewDatabase(filepath.Join(dir, "db"), DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps, _, err := registerSteps(manifest, database, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coordinator := NewCoordinator(&database, ttl)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := coordinator.Run(context.Background(), steps); err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		coordinator.Shutdown()
+		<-done
+		database.Close()
+	})
+	return coordinator, &database
+}
+
+func TestLeaseExpiresAndTaskIsRequeued(t *testing.T) {
+	coordinator, database := newTestCoordinator(t, 100*time.Millisecond)
+
+	first, err := coordinator.Lease("w1", "host1", 1, nil)
+	if err != nil || first == nil {
+		t.Fatalf("first lease: %v, %v", first, err)
+	}
+
+	// Without heartbeats the lease expires and the task is handed to the next worker
+	deadline := time.Now().Add(5 * time.Second)
+	for coordinator.LeaseOf(first.Task.ID) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("lease did not expire")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if coordinator.Heartbeat(first.ID) {
+		t.Error("heartbeat of an expired lease succeeded")
+	}
+	task, err := database.GetTask(first.Task.ID)
+	if err != nil || task.State != TaskPending {
+		t.Fatalf("task after expiry: %+v, %v", task, err)
+	}
+
+	second, err := coordinator.Lease("w2", "host2", 2, nil)
+	if err != nil || second == nil {
+		t.Fatalf("second lease: %v, %v", second, err)
+	}
+	if second.Task.ID != first.Task.ID || second.ID == first.ID || second.Worker != "w2" {
+		t.Fatalf("second lease is %+v, want task %d leased again to w2", second, first.Task.ID)
+	}
+
+	// The result of the expired lease is refused, the new one's is recorded
+	noOutputs := func() (*LeaseOutput, error) { return nil, io.EOF }
+	if err := coordinator.Complete(first.ID, nil, "", nil, noOutputs); err != ErrLeaseNotFound {
+		t.Errorf("completing the expired lease: got %v, want ErrLeaseNotFound", err)
+	}
+	sent := false
+	outputs := func() (*LeaseOutput, error) {
+		if sent {
+			return nil, io.EOF
+		}
+		sent = true
+		return &LeaseOutput{Name: "greeting", Reader: strings.NewReader("hi\n")}, nil
+	}
+	if err := coordinator.Complete(second.ID, nil, "hi\n", nil, outputs); err != nil {
+		t.Fatalf("completing the new lease: %v", err)
+	}
+	task, err = database.GetTask(first.Task.ID)
+	if err != nil || task.State != TaskSucceeded || task.Host != "host2" {
+		t.Fatalf("task after completion: %+v, %v", task, err)
+	}
+}
+
+func TestRoutesRequireToken(t *testing.T) {
+	coordinator, database := newTestCoordinator(t, time.Minute)
+	api := &apiServer{database: *database, coordinator: coordinator, token: "secret"}
+	server := httptest.NewServer(api.routes())
+	defer server.Close()
+
+	tests := []struct {
+		path     string
+		token    string
+		password string // sent with basic authentication, as a browser does
+		want     int
+	}{
+		{"/api/leases", "", "", http.StatusUnauthorized},
+		{"/api/leases", "wrong", "", http.StatusUnauthorized},
+		{"/api/leases", "secret", "", http.StatusOK},
+		{"/api/status", "", "", http.StatusUnauthorized},
+		{"/api/status", "secret", "", http.StatusOK},
+		{"/", "", "", http.StatusUnauthorized},
+		{"/", "", "wrong", http.StatusUnauthorized},
+		{"/", "", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.password != "" {
+			req.SetBasicAuth("anyone", tt.password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET %s with token %q, password %q: got status %d, want %d", tt.path, tt.token, tt.password, resp.StatusCode, tt.want)
+		}
+	}
+
+	// Workers send the token with every request: the unknown lease is gone
+	// rather than the request being refused
+	client := newCoordinatorClient(server.URL)
+	if err := client.release("unknown"); err == nil || !strings.Contains(err.Error(), "token") {
+		t.Errorf("release without the token: got %v, want it refused", err)
+	}
+	client.token = "secret"
+	if err := client.release("unknown"); err != errLeaseLost {
+		t.Errorf("release with the token: got %v, want errLeaseLost", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"flag"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The dashboard is a single page with no external assets, so it works offline
+//
+//go:embed web
+var webFiles embed.FS
+
+var dashboardLogger = NewLogger("DASHBOARD")
+
+func dashboardHandler() http.Handler {
+	root, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServerFS(root)
+}
+
+// dashboardCommand serves the dashboard and the read-only part of the API for a
+// database, without running anything. It can be used alongside a running pipeline;
+// grit serve includes the same dashboard with run controls.
+func dashboardCommand(args []string) {
+	flags := flag.NewFlagSet("dashboard", flag.ExitOnError)
+	addLogFlags(flags)
+	dbFlags := addDatabaseFlags(flags)
+	listen := flags.String("listen", "127.0.0.1:8420", "address to listen on: HOST:PORT or unix:PATH")
+	token := addTokenFlag(flags)
+	commandUsage(flags, "dashboard [-db PATH] [--listen 127.0.0.1:8420|unix:PATH] [--token TOKEN]")
+	if len(parseArgs(flags, args)) != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	*token = apiToken(*token, *listen)
+
+	database := dbFlags.open(DatabaseOptions{ReadOnly: true})
+	defer database.Close()
+
+	listener, err := listenAPI(*listen)
+	if err != nil {
+		fatal("Failed to listen", "address", *listen, "error", err)
+	}
+	api := &apiServer{database: database, token: *token, listen: *listen}
+	server := &http.Server{Handler: api.routes()}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	dashboardLogger.Info("Dashboard listening (read-only)", "url", dashboardURL(*listen))
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("Server error", "error", err)
+	}
+}
+
+func dashboardURL(address string) string {
+	if strings.HasPrefix(address, "unix:") {
+		return address
+	}
+	return "http://" + address + "/"
+}
@@ -12,7 +12,6 @@ import (
 	"strings"
 
 	"github.com/danhab99/idk/workers"
-	badger "github.com/dgraph-io/badger/v4"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -61,17 +60,44 @@ CREATE INDEX IF NOT EXISTS idx_task_input_resource ON task(input_resource_id);
 type Database struct {
 	db        *sql.DB
 	repo_path string
-	badgerDB  *badger.DB
+	objects   ObjectStore
+	lock      *RunLock // nil when opened read-only
+	readOnly  bool
+
+	// rawObjects are the objects stored before they had a codec header, see decodeObject
+	rawObjects map[string]bool
+}
+
+// DatabaseOptions controls how NewDatabase opens a repository
+type DatabaseOptions struct {
+	ObjectStore    string // object store spec, see OpenObjectStore
+	SkipMigrations bool   // open without upgrading the schema (used by grit migrate)
+	ReadOnly       bool   // open without the run lock; writes will fail
 }
 
 type Step struct {
 	ID       int64
 	Name     string
-	Script   string
+	Script   string // as run; the database holds the template, see storedScript
 	IsStart  bool
 	Parallel *int
 	Inputs   []string
 	Version  int
+	Compress Compression
+	Outputs  OutputRules   // from the manifest, like Compress
+	Params   []MatrixParam // from the manifest, for steps expanded from a matrix
+	Runner   ScriptRunner  // part of the version; only read from the manifest
+
+	scriptTemplate string // Script with {{env.NAME}} left as written, from the manifest
+}
+
+// storedScript is the script the step is versioned and stored with, so values
+// from the environment never reach the database
+func (s Step) storedScript() string {
+	if s.scriptTemplate != "" {
+		return s.scriptTemplate
+	}
+	return s.Script
 }
 
 type Task struct {
@@ -80,13 +106,119 @@ type Task struct {
 	InputResourceID *int64
 	Processed       bool
 	Error           *string
+	State           string  // one of the Task* states below
+	StartedAt       *string // when the task last started running
+	FinishedAt      *string
+	Host            string // host and pid of the process that last ran the task
+	PID             int
+	Usage           *TaskUsage // what the last run of the script used, if it ran
+	RunID           *int64     // the run that last started the task
+}
+
+// Task states. Processed is true for the last three.
+const (
+	TaskPending   = "pending"
+	TaskRunning   = "running"
+	TaskSucceeded = "succeeded"
+	TaskFailed    = "failed"
+	TaskCancelled = "cancelled"
+)
+
+// taskColumns are the task columns scanned by scanTask, prefixed with a table alias
+func taskColumns(alias string) string {
+	columns := []string{"id", "step_id", "input_resource_id", "processed", "error", "state", "started_at", "finished_at", "host", "pid",
+		"wall_ms", "exit_code", "user_cpu_ms", "sys_cpu_ms", "max_rss_kb", "bytes_in", "bytes_out", "run_id"}
+	for i, c := range columns {
+		columns[i] = alias + c
+	}
+	return strings.Join(columns, ", ")
 }
 
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTask(row rowScanner) (Task, error) {
+	var t Task
+	var host sql.NullString
+	var pid, wall sql.NullInt64
+	var u TaskUsage
+	var userCPU, sysCPU, maxRSS, bytesIn, bytesOut sql.NullInt64
+	err := row.Scan(&t.ID, &t.StepID, &t.InputResourceID, &t.Processed, &t.Error, &t.State, &t.StartedAt, &t.FinishedAt, &host, &pid,
+		&wall, &u.ExitCode, &userCPU, &sysCPU, &maxRSS, &bytesIn, &bytesOut, &t.RunID)
+	t.Host, t.PID = host.String, int(pid.Int64)
+	if wall.Valid {
+		u.WallMS, u.UserCPUMS, u.SysCPUMS = wall.Int64, userCPU.Int64, sysCPU.Int64
+		u.MaxRSSKB, u.BytesIn, u.BytesOut = maxRSS.Int64, bytesIn.Int64, bytesOut.Int64
+		t.Usage = &u
+	}
+	return t, err
+}
+
+// taskUsageReset clears the usage columns when a task is run again
+const taskUsageReset = "wall_ms = NULL, exit_code = NULL, user_cpu_ms = NULL, sys_cpu_ms = NULL, max_rss_kb = NULL, bytes_in = NULL, bytes_out = NULL"
+
+// taskState is the state a task ends up in when it is marked processed (or not)
+func taskState(processed bool, errorMsg *string) string {
+	switch {
+	case !processed:
+		return TaskPending
+	case errorMsg == nil:
+		return TaskSucceeded
+	case *errorMsg == ErrTaskCancelled:
+		return TaskCancelled
+	default:
+		return TaskFailed
+	}
+}
+
+// sqlNow is a timestamp with millisecond precision, in the format of CURRENT_TIMESTAMP
+const sqlNow = "strftime('%Y-%m-%d %H:%M:%f', 'now')"
+
 type Resource struct {
 	ID         int64
 	Name       string
 	ObjectHash string
 	CreatedAt  string
+	Source     string // where an imported resource came from, if recorded
+}
+
+// TaskOutput is a resource produced by a task, under the filename the script wrote
+type TaskOutput struct {
+	TaskID   int64
+	Filename string
+	Resource Resource
+}
+
+// ResourceOrigin is the task that wrote a resource, as recorded in task_output
+type ResourceOrigin struct {
+	TaskID      int64
+	Filename    string
+	StepName    string
+	StepVersion int
+	Input       *Resource // nil for seed tasks
+}
+
+// ResourceLineage is a resource with one of the tasks that produced it. Origin is
+// nil when no producing task was recorded (resources created before lineage tracking).
+type ResourceLineage struct {
+	Resource Resource
+	Origin   *ResourceOrigin
+}
+
+// ResourceFilter selects resources for FindResources; zero fields match everything
+type ResourceFilter struct {
+	Names         []string
+	Step          string
+	LatestVersion bool // only resources produced by the newest version of their step
+}
+
+// TaskFilter selects tasks for FindTasks; zero fields match everything
+type TaskFilter struct {
+	Step  string // step name, any version
+	State string // one of the Task* states
+	Run   int64  // tasks executed by this run, with State matching what the run left them in
+	Limit int
 }
 
 func (t Task) String() string {
@@ -97,23 +229,35 @@ func (t Task) String() string {
 		e = *t.Error
 	}
 
-	return fmt.Sprintf("Task(id=%d step_id=%d processed=%v error=%s)", t.ID, t.StepID, t.Processed, e)
+	return fmt.Sprintf("Task(id=%d step_id=%d state=%s error=%s)", t.ID, t.StepID, t.State, e)
 }
 
-func NewDatabase(repo_path string) (Database, error) {
+func NewDatabase(repo_path string, opts DatabaseOptions) (Database, error) {
+	if opts.ReadOnly {
+		return openReadOnlyDatabase(repo_path, opts)
+	}
+
 	err := os.MkdirAll(repo_path, 0755)
 	if err != nil {
 		return Database{}, err
 	}
 
+	// Only one writing process per repository; status and export open read-only instead
+	lock, err := AcquireRunLock(repo_path)
+	if err != nil {
+		return Database{}, err
+	}
+
 	err = os.MkdirAll(repo_path+"/sqlite", 0755)
 	if err != nil {
+		lock.Release()
 		return Database{}, err
 	}
 
-	dbLogger.Verbosef("Opening database at %s/db\n", repo_path)
+	dbLogger.Debug("Opening database", "path", repo_path)
 	db, err := sql.Open("sqlite3", fmt.Sprintf("%s/sqlite/db?timeout=600000", repo_path))
 	if err != nil {
+		lock.Release()
 		return Database{}, err
 	}
 
@@ -123,61 +267,268 @@ func NewDatabase(repo_path string) (Database, error) {
 	db.SetMaxOpenConns(numConns)
 	db.SetMaxIdleConns(numConns)
 
-	// Force WAL checkpoint to clear the 173GB log before proceeding
-	dbLogger.Println("Checkpointing WAL file (this may take a moment)...")
-	// _, err = db.Exec("PRAGMA busy_timeout = 600000;")
-	_, err = db.Exec("PRAGMA busy_timeout = 6;")
-	if err != nil {
+	database := Database{db: db, repo_path: repo_path, lock: lock}
+	if err := database.init(opts); err != nil {
+		db.Close()
+		lock.Release()
 		return Database{}, err
 	}
 
-	// Checkpoint: restart to clear the wal file
-	_, err = db.Exec("PRAGMA wal_autocheckpoint = 0;")
+	return database, nil
+}
+
+// openReadOnlyDatabase opens a repository without taking the run lock, so
+// status and export commands work while a pipeline is executing
+func openReadOnlyDatabase(repo_path string, opts DatabaseOptions) (Database, error) {
+	sqlitePath := repo_path + "/sqlite/db"
+	if _, err := os.Stat(sqlitePath); err != nil {
+		return Database{}, fmt.Errorf("no database at %s: %w", repo_path, err)
+	}
+
+	dbLogger.Debug("Opening database read-only", "path", sqlitePath)
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&timeout=600000", sqlitePath))
 	if err != nil {
 		return Database{}, err
 	}
 
-	db.Exec("PRAGMA journal_mode=WAL;")
-	db.Exec("PRAGMA synchronous=NORMAL;")
-	db.Exec("PRAGMA foreign_keys=ON;")
+	database := Database{db: db, repo_path: repo_path, readOnly: true}
+	if err := database.init(opts); err != nil {
+		db.Close()
+		return Database{}, err
+	}
+
+	return database, nil
+}
+
+// init configures the SQLite connection, checks the schema and opens the object store
+func (d *Database) init(opts DatabaseOptions) error {
+	db := d.db
+
+	if !d.readOnly {
+		// Force WAL checkpoint to clear the 173GB log before proceeding
+		dbLogger.Info("Checkpointing WAL file (this may take a moment)")
+		// _, err = db.Exec("PRAGMA busy_timeout = 600000;")
+		_, err := db.Exec("PRAGMA busy_timeout = 6;")
+		if err != nil {
+			return err
+		}
+
+		// Checkpoint: restart to clear the wal file
+		_, err = db.Exec("PRAGMA wal_autocheckpoint = 0;")
+		if err != nil {
+			return err
+		}
+
+		db.Exec("PRAGMA journal_mode=WAL;")
+		db.Exec("PRAGMA synchronous=NORMAL;")
+		db.Exec("PRAGMA foreign_keys=ON;")
+
+		// Force checkpoint
+		_, err = db.Exec("PRAGMA optimize;")
+		if err != nil {
+			dbLogger.Warn("PRAGMA optimize failed", "error", err)
+		}
+	}
+
+	// Refuse databases written by a newer grit before touching anything else
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if err := checkSchemaVersion(version); err != nil {
+		return err
+	}
+	if d.readOnly && version < LatestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is older than %d, run grit migrate first", version, LatestSchemaVersion())
+	}
+
+	if !d.readOnly && !opts.SkipMigrations {
+		dbLogger.Info("Initializing database schema")
+		if _, err := d.Migrate(); err != nil {
+			return err
+		}
+	}
 
-	// Force checkpoint
-	_, err = db.Exec("PRAGMA optimize;")
+	// Initialize the object store (BadgerDB unless configured otherwise)
+	spec, err := d.resolveObjectStore(opts.ObjectStore)
 	if err != nil {
-		dbLogger.Verbosef("Warning: PRAGMA optimize failed: %v\n", err)
+		return err
+	}
+	d.objects, err = OpenObjectStore(spec, d.repo_path, d.readOnly)
+	if err != nil && d.readOnly {
+		// BadgerDB can't be opened while a running pipeline has unflushed writes.
+		// Metadata queries still work; only reading object content fails.
+		dbLogger.Debug("Object store unavailable", "error", err)
+		d.objects = unavailableObjectStore{err}
+	} else if err != nil {
+		return err
 	}
 
-	dbLogger.Println("Initializing database schema")
-	_, err = db.Exec(schema)
+	if !d.readOnly && !opts.SkipMigrations {
+		orphans, discarded, err := d.RecoverOrphanedTasks()
+		if err != nil {
+			d.objects.Close()
+			return fmt.Errorf("failed to recover interrupted tasks: %w", err)
+		}
+		for _, t := range orphans {
+			dbLogger.Debug("Resetting task left running by a previous run", "task_id", t.ID, "pid", t.PID, "host", t.Host)
+		}
+		if len(orphans) > 0 {
+			dbLogger.Warn("Reset tasks interrupted by a previous run", "tasks", len(orphans), "discarded_outputs", discarded)
+		}
+
+		interrupted, err := d.RecoverInterruptedRuns()
+		if err != nil {
+			d.objects.Close()
+			return fmt.Errorf("failed to recover interrupted runs: %w", err)
+		}
+		if interrupted > 0 {
+			dbLogger.Warn("Marked runs left unfinished by a previous process as interrupted", "runs", interrupted)
+		}
+	}
+
+	if !opts.SkipMigrations {
+		if d.rawObjects, err = d.loadRawObjects(); err != nil {
+			d.objects.Close()
+			return fmt.Errorf("failed to read objects stored without a codec header: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// resolveObjectStore returns the spec of the object store to open: the one
+// recorded for the repository, which requested (from -object-store or the
+// manifest) has to match if given. The first writable open records the store,
+// so later commands find the objects without being told where they are.
+func (d Database) resolveObjectStore(requested string) (string, error) {
+	recorded, err := d.RecordedObjectStore()
 	if err != nil {
-		return Database{}, err
+		return "", err
 	}
+	if recorded != "" {
+		if requested != "" && requested != recorded {
+			return "", fmt.Errorf("the repository's objects are in %s, not %s (grit migrate -move-objects-to %s moves them)", recorded, requested, requested)
+		}
+		return recorded, nil
+	}
+
+	spec := requested
+	if spec == "" {
+		spec = "badger"
+	}
+	if d.readOnly {
+		return spec, nil
+	}
+	if exists, err := d.tableExists("setting"); err != nil || !exists {
+		// grit migrate opens databases before they can record anything
+		return spec, err
+	}
+
+	// A repository from before stores were recorded may already have objects
+	// elsewhere, so the default is only recorded for a new one
+	resources, err := d.CountResources()
+	if err != nil {
+		return "", err
+	}
+	if requested == "" && resources > 0 {
+		dbLogger.Warn("Object store of the repository is not recorded, assuming badger; pass -object-store once to record it")
+		return spec, nil
+	}
+	return spec, d.recordObjectStore(spec)
+}
+
+// RecordedObjectStore returns the spec of the object store the repository's
+// objects are in, or "" if it has not been recorded
+func (d Database) RecordedObjectStore() (string, error) {
+	if exists, err := d.tableExists("setting"); err != nil || !exists {
+		return "", err
+	}
+	var spec string
+	err := d.db.QueryRow("SELECT value FROM setting WHERE name = 'object_store'").Scan(&spec)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return spec, err
+}
+
+func (d Database) recordObjectStore(spec string) error {
+	_, err := d.db.Exec("INSERT INTO setting (name, value) VALUES ('object_store', ?) ON CONFLICT(name) DO UPDATE SET value = excluded.value", spec)
+	return err
+}
+
+func (d Database) tableExists(name string) (bool, error) {
+	var exists bool
+	err := d.db.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", name).Scan(&exists)
+	return exists, err
+}
 
-	// Initialize BadgerDB for object storage
-	badgerPath := fmt.Sprintf("%s/objects_db", repo_path)
-	dbLogger.Verbosef("Opening BadgerDB at %s\n", badgerPath)
-	badgerOpts := badger.DefaultOptions(badgerPath)
-	badgerOpts.Logger = nil // Disable BadgerDB's default logging
+// MoveObjects copies every object of the repository to the object store spec
+// and records it as the repository's store. Objects are copied as stored, so
+// compressed objects stay compressed. The old store is left as it was.
+func (d *Database) MoveObjects(spec string) (int, error) {
+	if !validObjectStoreSpec(spec) {
+		return 0, fmt.Errorf("unknown object store %q (expected badger, dir, dir:PATH or s3://BUCKET/PREFIX)", spec)
+	}
+	target, err := OpenObjectStore(spec, d.repo_path, false)
+	if err != nil {
+		return 0, err
+	}
+	defer target.Close()
+
+	rows, err := d.db.Query("SELECT DISTINCT object_hash FROM resource")
+	if err != nil {
+		return 0, err
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
 
-	// Performance tuning for sequential batch operations
-	// Objects are written in batches during output processing, then read sequentially during task execution
-	badgerOpts.SyncWrites = false           // Don't fsync on every write
-	badgerOpts.NumVersionsToKeep = 1        // No version history for immutable data
-	badgerOpts.CompactL0OnClose = false     // Faster shutdown
-	badgerOpts.ValueLogFileSize = 512 << 20 // Larger value log (512MB) for batch writes
-	badgerOpts.MemTableSize = 128 << 20     // Large memtable (128MB) for batch buffering
-	badgerOpts.NumMemtables = 3             // More memtables for write-heavy batches
-	badgerOpts.NumLevelZeroTables = 5       // Allow more L0 tables before compaction
-	badgerOpts.NumLevelZeroTablesStall = 10 // Higher stall threshold
-	badgerOpts.ValueThreshold = 1024        // Store larger values in value log for sequential read
-	badgerOpts.NumCompactors = 2            // More compactors for background work
+	var moved int
+	for _, hash := range hashes {
+		if target.Exists(hash) {
+			continue
+		}
+		data, err := d.objects.Get(hash)
+		if err != nil {
+			return moved, fmt.Errorf("object %s: %w", hash, err)
+		}
+		if err := target.Put(hash, data); err != nil {
+			return moved, fmt.Errorf("object %s: %w", hash, err)
+		}
+		moved++
+	}
+	return moved, d.recordObjectStore(spec)
+}
 
-	badgerDB, err := badger.Open(badgerOpts)
+// loadRawObjects returns the objects stored before objects had a codec header.
+// Only databases from before schema versioning have any.
+func (d Database) loadRawObjects() (map[string]bool, error) {
+	rows, err := d.db.Query("SELECT hash FROM raw_object")
 	if err != nil {
-		return Database{}, fmt.Errorf("failed to open BadgerDB: %w", err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	return Database{db, repo_path, badgerDB}, nil
+	raw := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		raw[hash] = true
+	}
+	return raw, rows.Err()
 }
 
 // Step CRUD operations
@@ -196,12 +547,14 @@ func (d Database) CreateStep(step Step) (int64, error) {
 		inputsStr = "[]"
 	}
 
-	// Check if a step with the same name, script, and inputs already exists
+	// Check if a step with the same name, script, runner and inputs already exists
+	runner := step.Runner.version()
 	var existingID int64
 	var existingInputs sql.NullString
-	err := d.db.QueryRow("SELECT id, inputs FROM step WHERE name = ? AND script = ? ORDER BY version DESC LIMIT 1", step.Name, step.Script).Scan(&existingID, &existingInputs)
+	script := step.storedScript()
+	err := d.db.QueryRow("SELECT id, inputs FROM step WHERE name = ? AND script = ? AND runner = ? ORDER BY version DESC LIMIT 1", step.Name, script, runner).Scan(&existingID, &existingInputs)
 	if err == nil {
-		// Step with same name and script exists, check if inputs match
+		// Step with same name, script and runner exists, check if inputs match
 		existingInputsStr := "[]"
 		if existingInputs.Valid && existingInputs.String != "" {
 			existingInputsStr = existingInputs.String
@@ -240,9 +593,9 @@ func (d Database) CreateStep(step Step) (int64, error) {
 	}
 
 	res, err := d.db.Exec(`
-INSERT INTO step (name, script, is_start, parallel, inputs, version)
-VALUES (?, ?, ?, ?, ?, ?)
-`, step.Name, step.Script, step.IsStart, step.Parallel, inputsStr, version)
+INSERT INTO step (name, script, is_start, parallel, inputs, version, runner)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+`, step.Name, script, step.IsStart, step.Parallel, inputsStr, version, runner)
 	if err != nil {
 		return 0, err
 	}
@@ -324,6 +677,18 @@ func (d Database) GetStartingStep() (*Step, error) {
 	return &step, nil
 }
 
+func (d Database) GetStepByNameAndVersion(name string, version int) (*Step, error) {
+	var id int64
+	err := d.db.QueryRow("SELECT id FROM step WHERE name = ? AND version = ?", name, version).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return d.GetStep(id)
+}
+
 func (d Database) DeleteStep(id int64) error {
 	_, err := d.db.Exec("DELETE FROM step WHERE id = ?", id)
 	return err
@@ -371,7 +736,7 @@ func (d Database) ListSteps() chan Step {
 			}
 			if inputsJSON.Valid && inputsJSON.String != "" {
 				if err := json.Unmarshal([]byte(inputsJSON.String), &step.Inputs); err != nil {
-					dbLogger.Verbosef("Warning: failed to unmarshal inputs for step %d: %v\n", step.ID, err)
+					dbLogger.Warn("Failed to unmarshal step inputs", "step_id", step.ID, "error", err)
 				}
 			}
 			stepChan <- step
@@ -391,13 +756,13 @@ func (d Database) GetTaintedSteps() chan Step {
 	go func() {
 		defer close(stepChan)
 
-		// Find all steps where there's a newer version with a different script or inputs
+		// Find all steps where there's a newer version with a different script, runner or inputs
 		rows, err := d.db.Query(`
 			SELECT s1.id, s1.name, s1.script, s1.is_start, s1.parallel, s1.inputs, s1.version
 			FROM step s1
 			INNER JOIN step s2 ON s1.name = s2.name
 			WHERE s1.version < s2.version
-			  AND (s1.script != s2.script OR COALESCE(s1.inputs, '') != COALESCE(s2.inputs, ''))
+			  AND (s1.script != s2.script OR s1.runner != s2.runner OR COALESCE(s1.inputs, '') != COALESCE(s2.inputs, ''))
 			GROUP BY s1.id
 			ORDER BY s1.name, s1.version
 		`)
@@ -419,7 +784,7 @@ func (d Database) GetTaintedSteps() chan Step {
 			}
 			if inputsJSON.Valid && inputsJSON.String != "" {
 				if err := json.Unmarshal([]byte(inputsJSON.String), &step.Inputs); err != nil {
-					dbLogger.Verbosef("Warning: failed to unmarshal inputs for step %d: %v\n", step.ID, err)
+					dbLogger.Warn("Failed to unmarshal step inputs", "step_id", step.ID, "error", err)
 				}
 			}
 			stepChan <- step
@@ -435,47 +800,71 @@ func (d Database) GetTaintedSteps() chan Step {
 
 // Resource CRUD operations
 
-// CreateResourceFromReader reads data from an io.Reader, stores it in BadgerDB, and creates a resource record in SQLite.
+// CreateResourceFromReader reads data from an io.Reader, stores it in the object store, and creates a resource record in SQLite.
 // Returns the resource ID and the calculated hash.
 func (d Database) CreateResourceFromReader(name string, reader io.Reader) (int64, string, error) {
-	// Read all data and calculate hash
-	data, err := io.ReadAll(reader)
+	return d.ImportResource(name, reader, "", CompressAuto)
+}
+
+// ImportResource is CreateResourceFromReader with an explicit compression mode.
+// A non-empty source is recorded on the resource unless it already has one.
+func (d Database) ImportResource(name string, reader io.Reader, source string, compress Compression) (int64, string, error) {
+	// Hash while spooling to a file in the repository, so that data of any
+	// size is read once and only held in memory if the object is new (object
+	// stores take whole objects)
+	spool, err := os.CreateTemp(d.repo_path, "import-*")
 	if err != nil {
-		return 0, "", fmt.Errorf("failed to read data: %w", err)
+		return 0, "", fmt.Errorf("failed to create spool file: %w", err)
 	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
 
-	// Calculate hash
 	hasher := sha256.New()
-	hasher.Write(data)
-	hashBytes := hasher.Sum(nil)
-	hash := hex.EncodeToString(hashBytes)
+	size, err := io.Copy(io.MultiWriter(spool, hasher), reader)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read data: %w", err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
 
-	// Check if object already exists in BadgerDB
+	// Check if object already exists in the object store
 	if !d.ObjectExists(hash) {
-		// Store in BadgerDB
-		if err := d.StoreObject(hash, data); err != nil {
+		data := make([]byte, size)
+		if _, err := spool.ReadAt(data, 0); err != nil {
+			return 0, "", fmt.Errorf("failed to read spool file: %w", err)
+		}
+		// Store in the object store
+		if err := d.StoreObjectCompressed(hash, data, compress); err != nil {
 			return 0, "", fmt.Errorf("failed to store object: %w", err)
 		}
 	}
 
 	// Create resource record in SQLite
-	resourceID, err := d.CreateResource(name, hash)
+	resourceID, err := d.CreateResource(name, hash, size)
 	if err != nil {
 		return 0, "", fmt.Errorf("failed to create resource record: %w", err)
 	}
 
+	if source != "" {
+		if _, err := d.db.Exec("UPDATE resource SET source = ? WHERE id = ? AND source IS NULL", source, resourceID); err != nil {
+			return 0, "", fmt.Errorf("failed to record source: %w", err)
+		}
+	}
+
 	return resourceID, hash, nil
 }
 
-func (d Database) CreateResource(name string, objectHash string) (int64, error) {
+// CreateResource records a resource with the object it points at and the
+// object's uncompressed size
+func (d Database) CreateResource(name string, objectHash string, size int64) (int64, error) {
 	// Use an upsert-like pattern to make this safe under concurrency:
 	// INSERT ... ON CONFLICT DO NOTHING, then SELECT the id. This avoids
 	// races where two goroutines attempt to insert the same resource.
+	// Resources recorded before sizes were get theirs filled in.
 	_, err := d.db.Exec(`
-INSERT INTO resource (name, object_hash)
-VALUES (?, ?)
-ON CONFLICT(name, object_hash) DO NOTHING
-`, name, objectHash)
+INSERT INTO resource (name, object_hash, size)
+VALUES (?, ?, ?)
+ON CONFLICT(name, object_hash) DO UPDATE SET size = excluded.size WHERE size IS NULL
+`, name, objectHash, size)
 	if err != nil {
 		return 0, err
 	}
@@ -489,6 +878,20 @@ ON CONFLICT(name, object_hash) DO NOTHING
 	return id, nil
 }
 
+// ObjectSize returns the uncompressed size of an object as recorded with the
+// resources pointing at it, and false if none of them has one
+func (d Database) ObjectSize(hash string) (int64, bool, error) {
+	var size int64
+	err := d.db.QueryRow("SELECT size FROM resource WHERE object_hash = ? AND size IS NOT NULL LIMIT 1", hash).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return size, true, nil
+}
+
 func (d Database) GetResource(id int64) (*Resource, error) {
 	var r Resource
 	err := d.db.QueryRow("SELECT id, name, object_hash, created_at FROM resource WHERE id = ?", id).Scan(
@@ -511,7 +914,7 @@ func (d Database) GetResourcesByName(name string) chan Resource {
 
 		rows, err := d.db.Query("SELECT id, name, object_hash, created_at FROM resource WHERE name = ? ORDER BY created_at DESC", name)
 		if err != nil {
-			dbLogger.Verbosef("Error querying resources by name %s: %v\n", name, err)
+			dbLogger.Error("Failed to query resources", "resource", name, "error", err)
 			return
 		}
 		defer rows.Close()
@@ -519,14 +922,14 @@ func (d Database) GetResourcesByName(name string) chan Resource {
 		for rows.Next() {
 			var r Resource
 			if err := rows.Scan(&r.ID, &r.Name, &r.ObjectHash, &r.CreatedAt); err != nil {
-				dbLogger.Verbosef("Error scanning resource: %v\n", err)
+				dbLogger.Error("Failed to scan resource", "error", err)
 				return
 			}
 			resourceChan <- r
 		}
 
 		if err := rows.Err(); err != nil {
-			dbLogger.Verbosef("Error iterating resources: %v\n", err)
+			dbLogger.Error("Failed to iterate resources", "error", err)
 		}
 	}()
 
@@ -547,7 +950,7 @@ func (d Database) GetAllResources() chan Resource {
 
 		rows, err := d.db.Query("SELECT id, name, object_hash, created_at FROM resource ORDER BY created_at DESC")
 		if err != nil {
-			dbLogger.Verbosef("Error querying all resources: %v\n", err)
+			dbLogger.Error("Failed to query resources", "error", err)
 			return
 		}
 		defer rows.Close()
@@ -555,14 +958,14 @@ func (d Database) GetAllResources() chan Resource {
 		for rows.Next() {
 			var r Resource
 			if err := rows.Scan(&r.ID, &r.Name, &r.ObjectHash, &r.CreatedAt); err != nil {
-				dbLogger.Verbosef("Error scanning resource: %v\n", err)
+				dbLogger.Error("Failed to scan resource", "error", err)
 				return
 			}
 			resourceChan <- r
 		}
 
 		if err := rows.Err(); err != nil {
-			dbLogger.Verbosef("Error iterating resources: %v\n", err)
+			dbLogger.Error("Failed to iterate resources", "error", err)
 		}
 	}()
 
@@ -588,7 +991,7 @@ func (d Database) GetUnconsumedResourcesByName(name string, consumingStepID int6
 			ORDER BY r.created_at DESC
 		`, name, consumingStepID)
 		if err != nil {
-			dbLogger.Verbosef("Error querying unconsumed resources for name %s, step %d: %v\n", name, consumingStepID, err)
+			dbLogger.Error("Failed to query unconsumed resources", "resource", name, "step_id", consumingStepID, "error", err)
 			return
 		}
 		defer rows.Close()
@@ -596,20 +999,199 @@ func (d Database) GetUnconsumedResourcesByName(name string, consumingStepID int6
 		for rows.Next() {
 			var r Resource
 			if err := rows.Scan(&r.ID, &r.Name, &r.ObjectHash, &r.CreatedAt); err != nil {
-				dbLogger.Verbosef("Error scanning resource: %v\n", err)
+				dbLogger.Error("Failed to scan resource", "error", err)
 				return
 			}
 			resourceChan <- r
 		}
 
 		if err := rows.Err(); err != nil {
-			dbLogger.Verbosef("Error iterating resources: %v\n", err)
+			dbLogger.Error("Failed to iterate resources", "error", err)
 		}
 	}()
 
 	return resourceChan
 }
 
+// RecordTaskOutput links a resource to the task that wrote it. Writing the same
+// filename twice in one task replaces the earlier output.
+func (d Database) RecordTaskOutput(taskID int64, resourceID int64, filename string) error {
+	_, err := d.db.Exec(`
+INSERT INTO task_output (task_id, resource_id, filename)
+VALUES (?, ?, ?)
+ON CONFLICT(task_id, filename) DO UPDATE SET resource_id = excluded.resource_id
+`, taskID, resourceID, filename)
+	return err
+}
+
+// GetTaskOutputs returns the resources a task produced, ordered by filename
+func (d Database) GetTaskOutputs(taskID int64) ([]TaskOutput, error) {
+	rows, err := d.db.Query(`
+		SELECT o.task_id, o.filename, r.id, r.name, r.object_hash, r.created_at
+		FROM task_output o
+		INNER JOIN resource r ON r.id = o.resource_id
+		WHERE o.task_id = ?
+		ORDER BY o.filename
+	`, taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var outputs []TaskOutput
+	for rows.Next() {
+		var o TaskOutput
+		if err := rows.Scan(&o.TaskID, &o.Filename, &o.Resource.ID, &o.Resource.Name, &o.Resource.ObjectHash, &o.Resource.CreatedAt); err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, o)
+	}
+	return outputs, rows.Err()
+}
+
+// FindResources returns the resources matching filter with their lineage, one
+// entry per producing task. Filtering by step or version only matches resources
+// with a recorded origin.
+func (d Database) FindResources(filter ResourceFilter) ([]ResourceLineage, error) {
+	query := `
+		SELECT r.id, r.name, r.object_hash, r.created_at, COALESCE(r.source, ''),
+		       o.task_id, o.filename, s.name, s.version,
+		       i.id, i.name, i.object_hash, i.created_at
+		FROM resource r
+		LEFT JOIN task_output o ON o.resource_id = r.id
+		LEFT JOIN task t ON t.id = o.task_id
+		LEFT JOIN step s ON s.id = t.step_id
+		LEFT JOIN resource i ON i.id = t.input_resource_id
+		WHERE 1 = 1`
+	var args []any
+
+	if len(filter.Names) > 0 {
+		query += " AND r.name IN (?" + strings.Repeat(", ?", len(filter.Names)-1) + ")"
+		for _, name := range filter.Names {
+			args = append(args, name)
+		}
+	}
+	if filter.Step != "" {
+		query += " AND s.name = ?"
+		args = append(args, filter.Step)
+	}
+	if filter.LatestVersion {
+		query += " AND s.version = (SELECT MAX(version) FROM step WHERE name = s.name)"
+	}
+	query += " ORDER BY r.name, r.created_at, r.id, o.task_id, o.filename"
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []ResourceLineage
+	for rows.Next() {
+		var l ResourceLineage
+		var taskID, stepVersion, inputID sql.NullInt64
+		var filename, stepName, inputName, inputHash, inputCreatedAt sql.NullString
+		if err := rows.Scan(&l.Resource.ID, &l.Resource.Name, &l.Resource.ObjectHash, &l.Resource.CreatedAt, &l.Resource.Source,
+			&taskID, &filename, &stepName, &stepVersion,
+			&inputID, &inputName, &inputHash, &inputCreatedAt); err != nil {
+			return nil, err
+		}
+
+		if taskID.Valid {
+			l.Origin = &ResourceOrigin{
+				TaskID:      taskID.Int64,
+				Filename:    filename.String,
+				StepName:    stepName.String,
+				StepVersion: int(stepVersion.Int64),
+			}
+			if inputID.Valid {
+				l.Origin.Input = &Resource{ID: inputID.Int64, Name: inputName.String, ObjectHash: inputHash.String, CreatedAt: inputCreatedAt.String}
+			}
+		}
+		results = append(results, l)
+	}
+	return results, rows.Err()
+}
+
+// ListResourceNames returns every distinct resource name
+func (d Database) ListResourceNames() ([]string, error) {
+	rows, err := d.db.Query("SELECT DISTINCT name FROM resource ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// CountResourcesByName returns how many resources there are of each name
+func (d Database) CountResourcesByName() (map[string]int64, error) {
+	rows, err := d.db.Query("SELECT name, COUNT(*) FROM resource GROUP BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var name string
+		var count int64
+		if err := rows.Scan(&name, &count); err != nil {
+			return nil, err
+		}
+		counts[name] = count
+	}
+	return counts, rows.Err()
+}
+
+// ListObjectHashes returns every distinct object hash referenced by a resource
+func (d Database) ListObjectHashes() ([]string, error) {
+	rows, err := d.db.Query("SELECT DISTINCT object_hash FROM resource ORDER BY object_hash")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+func (d Database) GetResourceByNameAndHash(name string, objectHash string) (*Resource, error) {
+	var r Resource
+	err := d.db.QueryRow("SELECT id, name, object_hash, created_at FROM resource WHERE name = ? AND object_hash = ?", name, objectHash).Scan(
+		&r.ID, &r.Name, &r.ObjectHash, &r.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ResourceHashExists reports whether any resource references the object hash
+func (d Database) ResourceHashExists(objectHash string) (bool, error) {
+	var exists bool
+	err := d.db.QueryRow("SELECT EXISTS(SELECT 1 FROM resource WHERE object_hash = ?)", objectHash).Scan(&exists)
+	return exists, err
+}
+
 func (d Database) DeleteResource(id int64) error {
 	_, err := d.db.Exec("DELETE FROM resource WHERE id = ?", id)
 	return err
@@ -752,7 +1334,7 @@ func (d Database) ScheduleTasksForStep(stepID int64) (int64, error) {
 	}
 
 	if len(step.Inputs) == 0 {
-		dbLogger.Verbosef("Step %d (%s) has no inputs, skipping scheduling\n", stepID, step.Name)
+		dbLogger.Debug("Step has no inputs, skipping scheduling", "step", step.Name, "step_id", stepID)
 		return 0, nil
 	}
 
@@ -762,7 +1344,7 @@ func (d Database) ScheduleTasksForStep(stepID int64) (int64, error) {
 		return 0, fmt.Errorf("failed to marshal inputs: %w", err)
 	}
 
-	dbLogger.Verbosef("Scheduling tasks for step %d (%s) with inputs: %s\n", stepID, step.Name, string(inputsJSON))
+	dbLogger.Debug("Scheduling tasks", "step", step.Name, "step_id", stepID, "inputs", string(inputsJSON))
 
 	// Single SQL statement to create tasks for all unconsumed resources
 	// that match the step's input names
@@ -788,19 +1370,16 @@ func (d Database) ScheduleTasksForStep(stepID int64) (int64, error) {
 	}
 
 	if rowsAffected > 0 {
-		dbLogger.Verbosef("Scheduled %d new tasks for step %d (%s)\n", rowsAffected, stepID, step.Name)
+		dbLogger.Debug("Scheduled new tasks", "step", step.Name, "step_id", stepID, "count", rowsAffected)
 	} else {
-		dbLogger.Verbosef("No new tasks scheduled for step %d (%s) - no matching unconsumed resources\n", stepID, step.Name)
+		dbLogger.Debug("No new tasks scheduled, no matching unconsumed resources", "step", step.Name, "step_id", stepID)
 	}
 
 	return rowsAffected, nil
 }
 
 func (d Database) GetTask(id int64) (*Task, error) {
-	var t Task
-	err := d.db.QueryRow("SELECT id, step_id, input_resource_id, processed, error FROM task WHERE id = ?", id).Scan(
-		&t.ID, &t.StepID, &t.InputResourceID, &t.Processed, &t.Error,
-	)
+	t, err := scanTask(d.db.QueryRow("SELECT "+taskColumns("")+" FROM task WHERE id = ?", id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -817,24 +1396,183 @@ func (d Database) TaskExists(id int64) (bool, error) {
 }
 
 func (d Database) UpdateTaskStatus(id int64, processed bool, errorMsg *string) error {
-	_, err := d.db.Exec(`
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	state := taskState(processed, errorMsg)
+	_, err = tx.Exec(`
 UPDATE task 
-SET processed = ?, error = ?
+SET processed = ?, error = ?, state = ?, finished_at = CASE WHEN ? THEN `+sqlNow+` END
 WHERE id = ?
-`, processed, errorMsg, id)
-	return err
+`, processed, errorMsg, state, processed, id)
+	if err != nil {
+		return err
+	}
+	// The run that started the task records how it ended
+	_, err = tx.Exec("UPDATE run_task SET outcome = ? WHERE task_id = ? AND run_id = (SELECT run_id FROM task WHERE id = ?)", state, id, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// StartTask records that a task is running in process pid on host, as part of
+// run runID if it is not nil
+func (d Database) StartTask(id int64, runID *int64, host string, pid int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+UPDATE task
+SET state = ?, started_at = `+sqlNow+`, finished_at = NULL, host = ?, pid = ?, run_id = ?, `+taskUsageReset+`
+WHERE id = ? AND processed = 0
+`, TaskRunning, host, pid, runID, id)
+	if err != nil {
+		return err
+	}
+	started, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	// task.run_id only holds the last run; run_task keeps every run the task was executed by
+	if started > 0 && runID != nil {
+		_, err = tx.Exec(`
+INSERT INTO run_task (run_id, task_id, outcome) VALUES (?, ?, ?)
+ON CONFLICT(run_id, task_id) DO UPDATE SET outcome = excluded.outcome
+`, *runID, id, TaskRunning)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func (d Database) MarkStepTasksUnprocessed(stepID int64) error {
 	// runtime.Breakpoint()
 	_, err := d.db.Exec(`
 UPDATE task 
-SET processed = 0, error = NULL
+SET processed = 0, error = NULL, state = ?, started_at = NULL, finished_at = NULL, host = NULL, pid = NULL, run_id = NULL, `+taskUsageReset+`
 WHERE step_id = ?
-`, stepID)
+`, TaskPending, stepID)
 	return err
 }
 
+// RecoverOrphanedTasks resets tasks left running by a process that died, such as
+// one killed by the OOM killer. The caller must hold the run lock: every process
+// that runs tasks holds it, so any task still marked running has lost its owner.
+// Returns the reset tasks and the number of partial outputs discarded.
+func (d Database) RecoverOrphanedTasks() ([]Task, int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT "+taskColumns("")+" FROM task WHERE state = ? ORDER BY id", TaskRunning)
+	if err != nil {
+		return nil, 0, err
+	}
+	var orphans []Task
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		orphans = append(orphans, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var discarded int64
+	for _, t := range orphans {
+		n, err := resetTask(tx, t.ID)
+		if err != nil {
+			return nil, 0, err
+		}
+		discarded += n
+	}
+	return orphans, discarded, tx.Commit()
+}
+
+// ResetTask makes an interrupted task pending again, discarding the outputs it
+// had already written. Returns the number of resources discarded.
+func (d Database) ResetTask(id int64) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	discarded, err := resetTask(tx, id)
+	if err != nil {
+		return 0, err
+	}
+	return discarded, tx.Commit()
+}
+
+// resetTask drops a task's task_output rows and log, and deletes the resources it
+// wrote unless they were imported, also produced by another task, or already
+// taken as input by a task
+func resetTask(tx *sql.Tx, id int64) (int64, error) {
+	rows, err := tx.Query("SELECT resource_id FROM task_output WHERE task_id = ?", id)
+	if err != nil {
+		return 0, err
+	}
+	var outputs []int64
+	for rows.Next() {
+		var resourceID int64
+		if err := rows.Scan(&resourceID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		outputs = append(outputs, resourceID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM task_output WHERE task_id = ?",
+		"DELETE FROM task_log WHERE task_id = ?",
+		"UPDATE run_task SET outcome = '" + RunTaskInterrupted + "' WHERE task_id = ? AND outcome = '" + TaskRunning + "'",
+		"UPDATE task SET processed = 0, error = NULL, state = 'pending', started_at = NULL, finished_at = NULL, host = NULL, pid = NULL, run_id = NULL, " + taskUsageReset + " WHERE id = ?",
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return 0, err
+		}
+	}
+
+	var discarded int64
+	for _, resourceID := range outputs {
+		result, err := tx.Exec(`
+DELETE FROM resource
+WHERE id = ?
+  AND source IS NULL
+  AND NOT EXISTS (SELECT 1 FROM task_output WHERE resource_id = resource.id)
+  AND NOT EXISTS (SELECT 1 FROM task WHERE input_resource_id = resource.id)
+`, resourceID)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		discarded += n
+	}
+	return discarded, nil
+}
+
 func (d Database) MarkStepUndone(stepID int64) error {
 	// Delete all tasks and resources for this step
 	tx, err := d.db.Begin()
@@ -855,7 +1593,7 @@ func (d Database) MarkStepUndone(stepID int64) error {
 		return err
 	}
 
-	dbLogger.Verbosef("Marked step %d as undone: deleted %d tasks and their resources\n", stepID, tasksDeleted)
+	dbLogger.Debug("Marked step as undone, deleted its tasks and their resources", "step_id", stepID, "tasks", tasksDeleted)
 	return nil
 }
 
@@ -870,15 +1608,15 @@ func (d Database) ListTasks() chan Task {
 	go func() {
 		defer close(taskChan)
 
-		rows, err := d.db.Query("SELECT id, step_id, input_resource_id, processed, error FROM task ORDER BY id")
+		rows, err := d.db.Query("SELECT " + taskColumns("") + " FROM task ORDER BY id")
 		if err != nil {
 			panic(err)
 		}
 		defer rows.Close()
 
 		for rows.Next() {
-			var t Task
-			if err := rows.Scan(&t.ID, &t.StepID, &t.InputResourceID, &t.Processed, &t.Error); err != nil {
+			t, err := scanTask(rows)
+			if err != nil {
 				panic(err)
 			}
 			taskChan <- t
@@ -901,7 +1639,7 @@ func (d Database) GetTasksForStep(stepID int64) chan Task {
 		defer close(taskChan)
 
 		rows, err := d.db.Query(`
-			SELECT id, step_id, input_resource_id, processed, error 
+			SELECT `+taskColumns("")+`
 			FROM task 
 			WHERE step_id = ?
 			ORDER BY id
@@ -912,8 +1650,8 @@ func (d Database) GetTasksForStep(stepID int64) chan Task {
 		defer rows.Close()
 
 		for rows.Next() {
-			var t Task
-			if err := rows.Scan(&t.ID, &t.StepID, &t.InputResourceID, &t.Processed, &t.Error); err != nil {
+			t, err := scanTask(rows)
+			if err != nil {
 				panic(err)
 			}
 			taskChan <- t
@@ -927,6 +1665,350 @@ func (d Database) GetTasksForStep(stepID int64) chan Task {
 	return taskChan
 }
 
+// SaveTaskLog stores the captured output of a task's script, replacing any earlier attempt's.
+// Empty output is not stored.
+func (d Database) SaveTaskLog(taskID int64, output string) error {
+	if output == "" {
+		_, err := d.db.Exec("DELETE FROM task_log WHERE task_id = ?", taskID)
+		return err
+	}
+	_, err := d.db.Exec(`
+INSERT INTO task_log (task_id, output)
+VALUES (?, ?)
+ON CONFLICT(task_id) DO UPDATE SET output = excluded.output
+`, taskID, output)
+	return err
+}
+
+// SaveTaskUsage records the time and resources a run of a task's script used
+func (d Database) SaveTaskUsage(taskID int64, u TaskUsage) error {
+	_, err := d.db.Exec(`
+UPDATE task
+SET wall_ms = ?, exit_code = ?, user_cpu_ms = ?, sys_cpu_ms = ?, max_rss_kb = ?, bytes_in = ?, bytes_out = ?
+WHERE id = ?
+`, u.WallMS, u.ExitCode, u.UserCPUMS, u.SysCPUMS, u.MaxRSSKB, u.BytesIn, u.BytesOut, taskID)
+	return err
+}
+
+// TaskStats is a task with recorded usage and the step version it ran
+type TaskStats struct {
+	Task
+	StepName    string
+	StepVersion int
+}
+
+// ListTaskStats returns the finished tasks that have recorded usage, of one step
+// (all versions) or of every step if stepName is empty, ordered by step and version
+func (d Database) ListTaskStats(stepName string) ([]TaskStats, error) {
+	query := `
+		SELECT ` + taskColumns("t.") + `, s.name, s.version
+		FROM task t
+		INNER JOIN step s ON s.id = t.step_id
+		WHERE t.wall_ms IS NOT NULL AND t.processed = 1`
+	var args []any
+	if stepName != "" {
+		query += " AND s.name = ?"
+		args = append(args, stepName)
+	}
+	query += " ORDER BY s.name, s.version, t.id"
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []TaskStats
+	for rows.Next() {
+		var st TaskStats
+		task, err := scanTask(scanFunc(func(dest ...any) error {
+			return rows.Scan(append(dest, &st.StepName, &st.StepVersion)...)
+		}))
+		if err != nil {
+			return nil, err
+		}
+		st.Task = task
+		stats = append(stats, st)
+	}
+	return stats, rows.Err()
+}
+
+// scanFunc adapts a function to rowScanner, to scan extra columns after a task's
+type scanFunc func(dest ...any) error
+
+func (f scanFunc) Scan(dest ...any) error {
+	return f(dest...)
+}
+
+// Run is one execution of the pipeline: a grit -run, a run started through the
+// API of grit serve, or a batch of grit watch
+type Run struct {
+	ID            int64
+	StartedAt     string
+	FinishedAt    *string
+	ManifestHash  string // sha256 of Manifest
+	Manifest      string // the manifest file as it was when the run started
+	Args          []string
+	Host          string
+	PID           int
+	Outcome       string // one of the Run* outcomes below
+	Error         *string
+	TasksExecuted int64
+	TasksFailed   int64
+}
+
+// Run outcomes
+const (
+	RunRunning     = "running"
+	RunSucceeded   = "succeeded"
+	RunFailed      = "failed"      // the run stopped with an error, or some of its tasks failed
+	RunInterrupted = "interrupted" // the process died before the run finished
+)
+
+// RunTaskInterrupted is the outcome in run_task of a task the run started but
+// did not finish, because its process died or its lease was lost. Otherwise the
+// outcome is the task state the run left it in.
+const RunTaskInterrupted = "interrupted"
+
+// runTaskCounts sets the task counts of a run from the tasks it executed
+const runTaskCounts = `tasks_executed = (SELECT COUNT(*) FROM run_task WHERE run_id = run.id
+      AND outcome IN ('` + TaskSucceeded + `', '` + TaskFailed + `', '` + TaskCancelled + `')),
+    tasks_failed = (SELECT COUNT(*) FROM run_task WHERE run_id = run.id AND outcome = '` + TaskFailed + `')`
+
+const runColumns = "id, started_at, finished_at, manifest_hash, manifest, args, host, pid, outcome, error, tasks_executed, tasks_failed"
+
+func scanRun(row rowScanner) (Run, error) {
+	var r Run
+	var args string
+	err := row.Scan(&r.ID, &r.StartedAt, &r.FinishedAt, &r.ManifestHash, &r.Manifest, &args, &r.Host, &r.PID,
+		&r.Outcome, &r.Error, &r.TasksExecuted, &r.TasksFailed)
+	if err == nil {
+		err = json.Unmarshal([]byte(args), &r.Args)
+	}
+	return r, err
+}
+
+// StartRun records a run as running from now and returns its ID
+func (d Database) StartRun(manifest []byte, args []string, host string, pid int) (int64, error) {
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return 0, err
+	}
+	hash := sha256.Sum256(manifest)
+	result, err := d.db.Exec(`
+INSERT INTO run (started_at, manifest_hash, manifest, args, host, pid, outcome)
+VALUES (`+sqlNow+`, ?, ?, ?, ?, ?, ?)
+`, hex.EncodeToString(hash[:]), string(manifest), string(argsJSON), host, pid, RunRunning)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// FinishRun records the end of a run. Its tasks are counted from the tasks linked
+// to it; the run failed if runErr is set or any of them failed.
+func (d Database) FinishRun(id int64, runErr error) error {
+	var errorMsg *string
+	if runErr != nil {
+		msg := runErr.Error()
+		errorMsg = &msg
+	}
+	_, err := d.db.Exec(`
+UPDATE run
+SET finished_at = `+sqlNow+`, error = ?, `+runTaskCounts+`
+WHERE id = ?
+`, errorMsg, id)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(`
+UPDATE run SET outcome = CASE WHEN error IS NOT NULL OR tasks_failed > 0 THEN ? ELSE ? END
+WHERE id = ?
+`, RunFailed, RunSucceeded, id)
+	return err
+}
+
+// RecoverInterruptedRuns marks runs left running by a process that died as
+// interrupted. Like RecoverOrphanedTasks, the caller must hold the run lock.
+func (d Database) RecoverInterruptedRuns() (int64, error) {
+	result, err := d.db.Exec(`
+UPDATE run
+SET outcome = ?, `+runTaskCounts+`
+WHERE outcome = ?
+`, RunInterrupted, RunRunning)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetRun returns a run, or nil if there is none with this ID
+func (d Database) GetRun(id int64) (*Run, error) {
+	r, err := scanRun(d.db.QueryRow("SELECT "+runColumns+" FROM run WHERE id = ?", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ListRuns returns runs newest first, at most limit of them (all if limit is 0)
+// and only those started at or after since if it is not empty
+func (d Database) ListRuns(limit int, since string) ([]Run, error) {
+	query := "SELECT " + runColumns + " FROM run"
+	var args []any
+	if since != "" {
+		query += " WHERE started_at >= ?"
+		args = append(args, since)
+	}
+	query += " ORDER BY id DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []Run
+	for rows.Next() {
+		r, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// RunStepTasks counts the tasks of one step version that a run executed
+type RunStepTasks struct {
+	StepName    string
+	StepVersion int
+	Tasks       int64
+	Failed      int64
+	Cancelled   int64
+}
+
+// ListRunSteps counts the tasks a run executed, by step version
+func (d Database) ListRunSteps(runID int64) ([]RunStepTasks, error) {
+	rows, err := d.db.Query(`
+		SELECT s.name, s.version, COUNT(*),
+		       COALESCE(SUM(rt.outcome = ?), 0), COALESCE(SUM(rt.outcome = ?), 0)
+		FROM run_task rt
+		INNER JOIN task t ON t.id = rt.task_id
+		INNER JOIN step s ON s.id = t.step_id
+		WHERE rt.run_id = ?
+		GROUP BY s.id
+		ORDER BY s.name, s.version
+	`, TaskFailed, TaskCancelled, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var steps []RunStepTasks
+	for rows.Next() {
+		var st RunStepTasks
+		if err := rows.Scan(&st.StepName, &st.StepVersion, &st.Tasks, &st.Failed, &st.Cancelled); err != nil {
+			return nil, err
+		}
+		steps = append(steps, st)
+	}
+	return steps, rows.Err()
+}
+
+// GetTaskLog returns the captured output of a task, or "" if none was recorded
+func (d Database) GetTaskLog(taskID int64) (string, error) {
+	var output string
+	err := d.db.QueryRow("SELECT output FROM task_log WHERE task_id = ?", taskID).Scan(&output)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return output, err
+}
+
+// ListStepOutputNames returns the resource names each step has produced, by step name
+func (d Database) ListStepOutputNames() (map[string][]string, error) {
+	rows, err := d.db.Query(`
+		SELECT DISTINCT s.name, r.name
+		FROM task_output o
+		INNER JOIN task t ON t.id = o.task_id
+		INNER JOIN step s ON s.id = t.step_id
+		INNER JOIN resource r ON r.id = o.resource_id
+		ORDER BY s.name, r.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	outputs := make(map[string][]string)
+	for rows.Next() {
+		var step, name string
+		if err := rows.Scan(&step, &name); err != nil {
+			return nil, err
+		}
+		outputs[step] = append(outputs[step], name)
+	}
+	return outputs, rows.Err()
+}
+
+// FindTasks returns tasks matching filter, newest first
+func (d Database) FindTasks(filter TaskFilter) ([]Task, error) {
+	query := `
+		SELECT ` + taskColumns("t.") + `
+		FROM task t
+		INNER JOIN step s ON s.id = t.step_id`
+	var args []any
+
+	// With a run, state is what the run left the task in rather than its current state
+	state := "t.state"
+	if filter.Run != 0 {
+		query += " INNER JOIN run_task rt ON rt.task_id = t.id AND rt.run_id = ?"
+		args = append(args, filter.Run)
+		state = "rt.outcome"
+	}
+	query += " WHERE 1 = 1"
+	if filter.Step != "" {
+		query += " AND s.name = ?"
+		args = append(args, filter.Step)
+	}
+	switch filter.State {
+	case "":
+	case TaskPending, TaskRunning, TaskSucceeded, TaskFailed, TaskCancelled:
+		query += " AND " + state + " = ?"
+		args = append(args, filter.State)
+	default:
+		return nil, fmt.Errorf("unknown task state %q (expected pending, running, succeeded, failed or cancelled)", filter.State)
+	}
+	query += " ORDER BY t.id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []Task
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
 func (d Database) CountUnprocessedTasks() (int64, error) {
 	row := d.db.QueryRow("SELECT COUNT(*) FROM task WHERE processed = 0")
 	var count int64
@@ -948,6 +2030,13 @@ func (d Database) CountUnprocessedTasksForStep(stepID int64) (int64, error) {
 	return count, err
 }
 
+func (d Database) CountFailedTasksForStep(stepID int64) (int64, error) {
+	row := d.db.QueryRow("SELECT COUNT(*) FROM task WHERE step_id = ? AND processed = 1 AND error IS NOT NULL", stepID)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
 // GetTaskCountsForStep returns (total tasks, processed tasks) for a given step
 func (d Database) GetTaskCountsForStep(stepID int64) (int64, int64, error) {
 	totalTasks, err := d.CountTasksForStep(stepID)
@@ -990,7 +2079,7 @@ func (d Database) CheckAndMarkStepComplete(stepID int64) (bool, error) {
 			if err != nil {
 				return false, err
 			}
-			dbLogger.Verbosef("Step %d (%s) marked as complete\n", stepID, step.Name)
+			dbLogger.Debug("Step marked as complete", "step", step.Name, "step_id", stepID)
 		}
 	}
 
@@ -1024,27 +2113,27 @@ func (d Database) GetUnprocessedTasks(stepID int64) chan Task {
 		defer close(taskChan)
 		var taskCount int64 = 0
 		defer func() {
-			dbLogger.Verbosef("GetUnprocessedTasks(step=%d) found %d unprocessed tasks\n", stepID, taskCount)
+			dbLogger.Debug("Found unprocessed tasks", "step_id", stepID, "count", taskCount)
 		}()
 
 		// Get all unprocessed tasks for this step
 		rows, err := d.db.Query(`
-			SELECT t.id, t.step_id, t.input_resource_id, t.processed, t.error
+			SELECT `+taskColumns("t.")+`
 			FROM task t
 			WHERE t.step_id = ? 
 			  AND t.processed = 0
 			ORDER BY t.id
 		`, stepID)
 		if err != nil {
-			dbLogger.Verbosef("Error querying unprocessed tasks for step %d: %v\n", stepID, err)
+			dbLogger.Error("Failed to query unprocessed tasks", "step_id", stepID, "error", err)
 			return
 		}
 		defer rows.Close()
 
 		for rows.Next() {
-			var t Task
-			if err := rows.Scan(&t.ID, &t.StepID, &t.InputResourceID, &t.Processed, &t.Error); err != nil {
-				dbLogger.Verbosef("Error scanning task for step %d: %v\n", stepID, err)
+			t, err := scanTask(rows)
+			if err != nil {
+				dbLogger.Error("Failed to scan task", "step_id", stepID, "error", err)
 				return
 			}
 			taskCount++
@@ -1052,7 +2141,7 @@ func (d Database) GetUnprocessedTasks(stepID int64) chan Task {
 		}
 
 		if err := rows.Err(); err != nil {
-			dbLogger.Verbosef("Error iterating tasks for step %d: %v\n", stepID, err)
+			dbLogger.Error("Failed to iterate tasks", "step_id", stepID, "error", err)
 		}
 	}()
 
@@ -1061,76 +2150,79 @@ func (d Database) GetUnprocessedTasks(stepID int64) chan Task {
 
 // Utility functions
 
-// StoreObject stores object data in BadgerDB
+// StoreObject stores object data in the object store, compressing it when that saves space
 func (d Database) StoreObject(hash string, data []byte) error {
-	// Use WriteBatch for better performance even for single writes
-	wb := d.badgerDB.NewWriteBatch()
-	defer wb.Cancel()
+	return d.StoreObjectCompressed(hash, data, CompressAuto)
+}
 
-	if err := wb.Set([]byte(hash), data); err != nil {
+// StoreObjectCompressed stores object data in the object store using the given compression mode.
+// The hash must be computed over the uncompressed data.
+func (d Database) StoreObjectCompressed(hash string, data []byte, mode Compression) error {
+	if d.rawObjects[hash] {
+		// Content addressed: the object is already stored, without a header
+		return nil
+	}
+	encoded, err := encodeObject(data, mode)
+	if err != nil {
 		return err
 	}
-
-	return wb.Flush()
+	if err := d.objects.Put(hash, encoded); err != nil {
+		return err
+	}
+	metrics.ObjectStored(len(data))
+	return nil
 }
 
 // StoreObjectBatch stores multiple objects in a single batch (much faster)
 func (d Database) StoreObjectBatch(objects map[string][]byte) error {
-	wb := d.badgerDB.NewWriteBatch()
-	defer wb.Cancel()
-
+	encoded := make(map[string][]byte, len(objects))
 	for hash, data := range objects {
-		if err := wb.Set([]byte(hash), data); err != nil {
+		if d.rawObjects[hash] {
+			continue
+		}
+		var err error
+		if encoded[hash], err = encodeObject(data, CompressAuto); err != nil {
 			return err
 		}
 	}
-
-	return wb.Flush()
+	if err := d.objects.PutBatch(encoded); err != nil {
+		return err
+	}
+	for _, data := range objects {
+		metrics.ObjectStored(len(data))
+	}
+	return nil
 }
 
-// GetObject retrieves object data from BadgerDB
+// GetObject retrieves object data from the object store, returning the original uncompressed bytes
 func (d Database) GetObject(hash string) ([]byte, error) {
-	var data []byte
-	err := d.badgerDB.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(hash))
-		if err != nil {
-			return err
-		}
-		data, err = item.ValueCopy(nil)
-		return err
-	})
-	return data, err
+	data, err := d.objects.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	return decodeObject(data, !d.rawObjects[hash])
 }
 
-// GetObjectBatch retrieves multiple objects in a single transaction (faster for sequential reads)
+// GetObjectBatch retrieves multiple objects at once (faster for sequential reads)
 func (d Database) GetObjectBatch(hashes []string) (map[string][]byte, error) {
-	results := make(map[string][]byte)
+	results, err := d.objects.GetBatch(hashes)
+	if err != nil {
+		return nil, err
+	}
 
-	err := d.badgerDB.View(func(txn *badger.Txn) error {
-		for _, hash := range hashes {
-			item, err := txn.Get([]byte(hash))
-			if err != nil {
-				return err
-			}
-			data, err := item.ValueCopy(nil)
-			if err != nil {
-				return err
-			}
-			results[hash] = data
+	for hash, raw := range results {
+		data, err := decodeObject(raw, !d.rawObjects[hash])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode object %s: %w", hash, err)
 		}
-		return nil
-	})
-
-	return results, err
+		results[hash] = data
+	}
+	return results, nil
 }
 
-// ObjectExists checks if an object exists in BadgerDB
+// ObjectExists checks if an object exists in the object store
 func (d Database) ObjectExists(hash string) bool {
-	err := d.badgerDB.View(func(txn *badger.Txn) error {
-		_, err := txn.Get([]byte(hash))
-		return err
-	})
-	return err == nil
+	return d.objects.Exists(hash)
 }
 
 func (d *Database) CreateAndGetTask(t Task) (*Task, error) {
@@ -1144,52 +2236,76 @@ func (d *Database) CreateAndGetTask(t Task) (*Task, error) {
 
 // ForceSaveWAL performs a WAL checkpoint to ensure data is persisted to the database file
 func (d Database) ForceSaveWAL() error {
-	dbLogger.Println("Checkpointing WAL...")
+	dbLogger.Info("Checkpointing WAL")
 	_, err := d.db.Exec("PRAGMA wal_checkpoint(RESTART);")
 	if err != nil {
-		dbLogger.Verbosef("Error checkpointing WAL: %v\n", err)
+		dbLogger.Error("Failed to checkpoint WAL", "error", err)
 		return err
 	}
-	dbLogger.Println("WAL checkpoint complete")
+	dbLogger.Info("WAL checkpoint complete")
 	return nil
 }
 
-// Close closes both SQLite and BadgerDB connections
-func (d Database) Close() error {
-	if err := d.db.Close(); err != nil {
-		return fmt.Errorf("failed to close SQLite: %w", err)
+// Close closes both the SQLite connection and the object store and releases the run lock
+func (d Database) Close() (err error) {
+	// The run lock is released whatever else fails, or other writers would be
+	// refused for as long as this process lives
+	defer func() {
+		if lockErr := d.lock.Release(); lockErr != nil && err == nil {
+			err = fmt.Errorf("failed to release run lock: %w", lockErr)
+		}
+	}()
+	sqliteErr := d.db.Close()
+	if err := d.objects.Close(); err != nil {
+		return fmt.Errorf("failed to close object store: %w", err)
 	}
-	if err := d.badgerDB.Close(); err != nil {
-		return fmt.Errorf("failed to close BadgerDB: %w", err)
+	if sqliteErr != nil {
+		return fmt.Errorf("failed to close SQLite: %w", sqliteErr)
 	}
 	return nil
 }
 
 func (db Database) MakeResourceConsumer() chan FileData {
 	outputChan := make(chan FileData, 100) // Buffered to prevent deadlock
+	metrics.addConsumer(outputChan)
 
-	// Jobs for background storage and DB insert
+	// Jobs for background storage and DB insert. A file is only recorded as a
+	// resource once its object is stored; done reports the outcome of both to
+	// FileData.Committed.
 	type storeJob struct {
-		hash string
-		data []byte
-		name string
+		hash     string
+		data     []byte
+		resource string
+		taskID   int64
+		filename string
+		compress Compression
+		done     func(error)
 	}
 	type dbJob struct {
-		name string
-		hash string
+		name     string
+		hash     string
+		size     int64
+		taskID   int64
+		filename string
+		done     func(error)
 	}
 
 	storeChan := make(chan storeJob, runtime.NumCPU())
 	dbJobChan := make(chan dbJob, 100)
 
-	// Worker pool: read FileData, compute hash, and dispatch store + db jobs using workers.Parallel0
+	// Worker pool: read FileData, compute hash, and dispatch store jobs using workers.Parallel0
 	numWorkers := runtime.NumCPU()
 	go func() {
 		workers.Parallel0(outputChan, numWorkers, func(fd FileData) {
-			resourceName := strings.Split(fd.Name, "_")[0]
+			done := func(err error) {
+				if fd.Committed != nil {
+					fd.Committed(err)
+				}
+			}
 			data, err := io.ReadAll(fd.Reader)
 			if err != nil {
-				pipelineLogger.Verbosef("Error reading file %s: %v\n", fd.Name, err)
+				pipelineLogger.Error("Failed to read output file", "task_id", fd.TaskID, "file", fd.Name, "error", err)
+				done(fmt.Errorf("failed to read output %s: %w", fd.Name, err))
 				return
 			}
 
@@ -1198,39 +2314,48 @@ func (db Database) MakeResourceConsumer() chan FileData {
 			hasher.Write(data)
 			hash := hex.EncodeToString(hasher.Sum(nil))
 
-			// Enqueue store job; if storeChan is full, spawn a goroutine so the worker doesn't block
-			storeChan <- storeJob{hash: hash, data: data, name: fd.Name}
-
-			// Enqueue DB job (should be quick)
-			dbJobChan <- dbJob{name: resourceName, hash: hash}
+			storeChan <- storeJob{hash: hash, data: data, resource: resourceName(fd.Name), taskID: fd.TaskID, filename: fd.Name, compress: fd.Compress, done: done}
 		})
 
-		// When output processing finishes, close the downstream channels
+		// When output processing finishes, close the downstream channel
 		close(storeChan)
-		close(dbJobChan)
 	}()
 
-	// Store workers using workers.Parallel0
+	// Store workers using workers.Parallel0; the DB job follows a stored object
 	numStoreWorkers := 2
 	go func() {
 		workers.Parallel0(storeChan, numStoreWorkers, func(s storeJob) {
 			if !db.ObjectExists(s.hash) {
-				if err := db.StoreObject(s.hash, s.data); err != nil {
-					pipelineLogger.Verbosef("Error storing object %s: %v\n", s.hash[:16]+"...", err)
+				if err := db.StoreObjectCompressed(s.hash, s.data, s.compress); err != nil {
+					pipelineLogger.Error("Failed to store object", "task_id", s.taskID, "file", s.filename, "hash", s.hash, "error", err)
+					s.done(fmt.Errorf("failed to store output %s: %w", s.filename, err))
+					return
 				}
 			}
+			dbJobChan <- dbJob{name: s.resource, hash: s.hash, size: int64(len(s.data)), taskID: s.taskID, filename: s.filename, done: s.done}
 		})
+		close(dbJobChan)
 	}()
 
 	// DB inserter (parallel workers to improve SQLite concurrency)
 	numDBWorkers := runtime.NumCPU()
 	go func() {
 		workers.Parallel0(dbJobChan, numDBWorkers, func(j dbJob) {
-			if _, err := db.CreateResource(j.name, j.hash); err != nil {
-				pipelineLogger.Verbosef("Error creating resource %s: %v\n", j.name, err)
+			resourceID, err := db.CreateResource(j.name, j.hash, j.size)
+			if err != nil {
+				pipelineLogger.Error("Failed to create resource", "task_id", j.taskID, "resource", j.name, "hash", j.hash, "error", err)
+				j.done(fmt.Errorf("failed to record output %s: %w", j.filename, err))
 				return
 			}
-			pipelineLogger.Verbosef("Created resource %s (hash: %s)\n", j.name, j.hash[:16]+"...")
+			if j.taskID != 0 {
+				if err := db.RecordTaskOutput(j.taskID, resourceID, j.filename); err != nil {
+					pipelineLogger.Error("Failed to record task output", "task_id", j.taskID, "file", j.filename, "error", err)
+					j.done(fmt.Errorf("failed to record output %s: %w", j.filename, err))
+					return
+				}
+			}
+			pipelineLogger.Debug("Created resource", "task_id", j.taskID, "resource", j.name, "hash", j.hash)
+			j.done(nil)
 		})
 	}()
 
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// commitOutput hands one file to a resource consumer and returns the error it
+// was committed with
+func commitOutput(database Database, name, content string) error {
+	result := make(chan error, 1)
+	consumer := database.MakeResourceConsumer()
+	consumer <- FileData{Name: name, Reader: strings.NewReader(content), Committed: func(err error) { result <- err }}
+	close(consumer)
+	return <-result
+}
+
+func TestResourceIsOnlyRecordedWithItsObject(t *testing.T) {
+	database, err := NewDatabase(filepath.Join(t.TempDir(), "db"), DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	store := database.objects
+	database.objects = unavailableObjectStore{errors.New("disk full")}
+	if err := commitOutput(database, "result", "lost"); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("committing to a failing store: got %v, want the store's error", err)
+	}
+	if n, err := database.CountResources(); err != nil || n != 0 {
+		t.Fatalf("got %d resources, %v after the store failed, want none", n, err)
+	}
+
+	database.objects = store
+	if err := commitOutput(database, "result", "kept"); err != nil {
+		t.Fatalf("committing: %v", err)
+	}
+	var resources []Resource
+	for r := range database.GetResourcesByName("result") {
+		resources = append(resources, r)
+	}
+	if len(resources) != 1 {
+		t.Fatalf("got %v, want one resource", resources)
+	}
+	if data, err := database.GetObject(resources[0].ObjectHash); err != nil || string(data) != "kept" {
+		t.Errorf("object of the resource: got %q, %v", data, err)
+	}
+}
+
+// newLegacyRepository creates a repository as grit wrote them before schema
+// versioning and compression: the original tables, with one resource whose
+// object is stored without a codec header in a directory object store
+func newLegacyRepository(t *testing.T, content string) (repo, hash string) {
+	repo = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repo, "sqlite"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(repo, "sqlite", "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	hash = sha256Hex([]byte(content))
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO resource (name, object_hash) VALUES ('legacy', ?)", hash); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenObjectStore("dir", repo, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Put(hash, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	return repo, hash
+}
+
+func TestLegacyObjectsAreReadRaw(t *testing.T) {
+	// Content that happens to start like a codec header must still come back as stored
+	content := string(objectMagic) + "\x01 not zstd"
+	repo, hash := newLegacyRepository(t, content)
+
+	database, err := NewDatabase(repo, DatabaseOptions{ObjectStore: "dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if data, err := database.GetObject(hash); err != nil || string(data) != content {
+		t.Fatalf("legacy object: got %q, %v, want %q", data, err, content)
+	}
+
+	// Storing the same content again keeps the raw object, new content gets a header
+	if err := database.StoreObject(hash, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := database.GetObject(hash); err != nil || string(data) != content {
+		t.Fatalf("legacy object after storing it again: got %q, %v", data, err)
+	}
+	newHash := sha256Hex([]byte("new"))
+	if err := database.StoreObject(newHash, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := database.objects.Get(newHash)
+	if err != nil || !bytes.HasPrefix(raw, objectMagic) {
+		t.Errorf("new object stored as %q, %v, want a codec header", raw, err)
+	}
+}
+
+func TestTaskState(t *testing.T) {
+	failed, cancelled := "exit status 1", ErrTaskCancelled
+	tests := []struct {
+		processed bool
+		err       *string
+		want      string
+	}{
+		{false, nil, TaskPending},
+		{false, &failed, TaskPending},
+		{true, nil, TaskSucceeded},
+		{true, &failed, TaskFailed},
+		{true, &cancelled, TaskCancelled},
+	}
+	for _, tt := range tests {
+		if got := taskState(tt.processed, tt.err); got != tt.want {
+			t.Errorf("taskState(%v, %v) = %s, want %s", tt.processed, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRecoverOrphanedTasks(t *testing.T) {
+	database, err := NewDatabase(filepath.Join(t.TempDir(), "db"), DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	must := func(id int64, err error) int64 {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	stepID := must(database.CreateStep(Step{Name: "train", Script: "true"}))
+	runID := must(database.StartRun([]byte("manifest"), nil, "host", 1))
+	start := func() int64 {
+		id := must(database.CreateTask(Task{StepID: stepID}))
+		must(0, database.StartTask(id, &runID, "host", 1))
+		return id
+	}
+	pending := must(database.CreateTask(Task{StepID: stepID}))
+	finished := start()
+	must(0, database.UpdateTaskStatus(finished, true, nil))
+	orphan := start()
+
+	// The outputs the orphan had written, and whether they survive its reset
+	outputs := []struct {
+		name  string
+		setup func(resourceID int64)
+		kept  bool
+	}{
+		{"partial", func(int64) {}, false},
+		{"shared", func(id int64) { must(0, database.RecordTaskOutput(finished, id, "shared")) }, true},
+		{"consumed", func(id int64) { must(database.CreateTask(Task{StepID: stepID, InputResourceID: &id})) }, true},
+		{"imported", func(id int64) {
+			if _, err := database.db.Exec("UPDATE resource SET source = 'rsync' WHERE id = ?", id); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+	}
+	resources := map[string]int64{}
+	for _, o := range outputs {
+		id := must(database.CreateResource(o.name, strings.Repeat("0", 63)+"1", 1))
+		must(0, database.RecordTaskOutput(orphan, id, o.name))
+		o.setup(id)
+		resources[o.name] = id
+	}
+
+	orphans, discarded, err := database.RecoverOrphanedTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].ID != orphan || discarded != 1 {
+		t.Fatalf("got orphans %+v and %d discarded, want task %d and 1", orphans, discarded, orphan)
+	}
+
+	for id, want := range map[int64]string{pending: TaskPending, finished: TaskSucceeded, orphan: TaskPending} {
+		task, err := database.GetTask(id)
+		if err != nil || task.State != want {
+			t.Errorf("task %d: got %+v, %v, want %s", id, task, err, want)
+		}
+		if id == orphan && (task.Host != "" || task.StartedAt != nil || task.RunID != nil) {
+			t.Errorf("reset task still records its last run: %+v", task)
+		}
+	}
+	for _, o := range outputs {
+		resource, err := database.GetResource(resources[o.name])
+		if err != nil || (resource != nil) != o.kept {
+			t.Errorf("resource %s: got %+v, %v, want kept %v", o.name, resource, err, o.kept)
+		}
+	}
+	var outcome string
+	if err := database.db.QueryRow("SELECT outcome FROM run_task WHERE task_id = ?", orphan).Scan(&outcome); err != nil || outcome != RunTaskInterrupted {
+		t.Errorf("run_task outcome of the orphan: got %q, %v, want %s", outcome, err, RunTaskInterrupted)
+	}
+
+	if n, err := database.RecoverInterruptedRuns(); err != nil || n != 1 {
+		t.Fatalf("got %d interrupted runs, %v, want 1", n, err)
+	}
+	run, err := database.GetRun(runID)
+	if err != nil || run.Outcome != RunInterrupted || run.TasksExecuted != 1 {
+		t.Errorf("got run %+v, %v, want interrupted with one task executed", run, err)
+	}
+
+	// Nothing is left to recover the second time around
+	if orphans, _, err := database.RecoverOrphanedTasks(); err != nil || len(orphans) != 0 {
+		t.Errorf("second recovery: got %+v, %v", orphans, err)
+	}
+}
@@ -2,31 +2,42 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"sync"
+	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type ScriptExecutor struct {
-	db       *Database
-	pipeline *Pipeline
+	db            *Database
+	pipeline      *Pipeline
+	processGroups bool // see Pipeline.ProcessGroups
 }
 
 func NewScriptExecutor(db *Database, pipeline *Pipeline) *ScriptExecutor {
 	return &ScriptExecutor{
-		db:       db,
-		pipeline: pipeline,
+		db:            db,
+		pipeline:      pipeline,
+		processGroups: pipeline.ProcessGroups,
 	}
 }
 
 var executeLogger = NewLogger("EXEC")
 
-func (e *ScriptExecutor) Execute(task Task, step Step, outputChan chan FileData) error {
-	// executeLogger.Printf("Executing task ID=%d for step '%s' (step_id=%d)\n", task.ID, step.Name, task.StepID)
+func (e *ScriptExecutor) Execute(ctx context.Context, task Task, step Step, outputChan chan FileData) (err error) {
+	// executeLogger.Debug("Executing task", "task_id", task.ID, "step", step.Name, "step_id", task.StepID)
 
-	start := time.Now()
+	metrics.TaskStarted(step.Name)
+	ctx, span := tracer.Start(ctx, "task "+step.Name, taskSpanAttributes(task.ID, step))
+	defer func(start time.Time) {
+		metrics.TaskFinished(step.Name, time.Since(start), err != nil)
+		endSpan(span, err)
+	}(time.Now())
 
 	// Create input file
 	inputFile, err := os.CreateTemp("/tmp", "input-*")
@@ -36,61 +47,167 @@ func (e *ScriptExecutor) Execute(task Task, step Step, outputChan chan FileData)
 	defer os.Remove(inputFile.Name())
 
 	// Write input data if exists
-	if err := e.prepareInput(task, inputFile); err != nil {
+	_, prepareSpan := tracer.Start(ctx, "prepare input")
+	bytesIn, err := e.prepareInput(task, inputFile)
+	endSpan(prepareSpan, err)
+	if err != nil {
 		return err
 	}
 	inputFile.Close()
 
-	// Execute the script
-	executeLogger.Verbosef("Executing: %s\n", step.Script)
-	cmd := e.buildCommand(step, inputFile.Name(), e.pipeline.fuseWatcher.mountPath)
+	// Each task writes into its own directory so outputs can be traced back to it
+	outputDir := e.pipeline.fuseWatcher.AddTaskDir(task.ID, step.Compress, step.Outputs)
+	defer e.pipeline.fuseWatcher.RemoveTaskDir(task.ID)
 
-	// Run script and capture output
-	if err := e.runScript(cmd, step); err != nil {
+	// Execute the script
+	executeLogger.Debug("Executing script", "task_id", task.ID, "step", step.Name, "script", step.Script)
+	cmd, cleanup, err := e.buildCommand(ctx, step, inputFile.Name(), outputDir)
+	if err != nil {
 		return err
 	}
+	defer cleanup()
 
-	elapsedTime := time.Now().Sub(start)
+	// Run script and capture output, keeping the tail of it for the task log
+	output := newLogTail(maxTaskLogSize)
+	_, scriptSpan := tracer.Start(ctx, "script")
+	start := time.Now()
+	err = e.runScript(cmd, task.ID, step, output)
+	usage := scriptUsage(cmd, time.Since(start))
+	scriptSpan.SetAttributes(usage.spanAttributes()...)
+	endSpan(scriptSpan, err)
+
+	// Wait for the outputs to be stored, so the task is only recorded as
+	// finished once its outputs are visible to the next step
+	_, commitSpan := tracer.Start(ctx, "commit outputs")
+	commitErr := e.pipeline.fuseWatcher.WaitForTaskOutputs(task.ID)
+	if err == nil {
+		err = commitErr
+	}
+	if err == nil {
+		err = step.Outputs.check(e.pipeline.fuseWatcher.TaskOutputs(task.ID))
+	}
+	usage.BytesIn = bytesIn
+	usage.BytesOut = e.pipeline.fuseWatcher.TaskOutputSize(task.ID)
+	commitSpan.SetAttributes(attribute.Int64("grit.bytes_out", usage.BytesOut))
+	commitSpan.End()
+	if logErr := e.db.SaveTaskLog(task.ID, output.String()); logErr != nil {
+		executeLogger.Warn("Failed to save task log", "task_id", task.ID, "error", logErr)
+	}
+	if usageErr := e.db.SaveTaskUsage(task.ID, usage); usageErr != nil {
+		executeLogger.Warn("Failed to save task usage", "task_id", task.ID, "error", usageErr)
+	}
+	if err != nil {
+		return err
+	}
 
-	executeLogger.Printf("Executed task ID=%d for step '%s' successfully in %s\n", task.ID, step.Name, elapsedTime.String())
+	executeLogger.Info("Executed task", "task_id", task.ID, "step", step.Name, "duration", usage.Wall())
 	return nil
 }
 
-func (e *ScriptExecutor) prepareInput(task Task, inputFile *os.File) error {
+// prepareInput writes the task's input to inputFile and returns its size
+func (e *ScriptExecutor) prepareInput(task Task, inputFile *os.File) (int64, error) {
 	// Get input resource if task has one
 	if task.InputResourceID != nil {
 		inputResource, err := e.db.GetResource(*task.InputResourceID)
 		if err != nil {
-			return fmt.Errorf("failed to get input resource: %w", err)
+			return 0, fmt.Errorf("failed to get input resource: %w", err)
 		}
 
 		data, err := e.db.GetObject(inputResource.ObjectHash)
 		if err != nil {
-			return fmt.Errorf("failed to get object: %w", err)
+			return 0, fmt.Errorf("failed to get object: %w", err)
 		}
 
 		n, err := inputFile.Write(data)
 		if err != nil {
-			return fmt.Errorf("failed to write input data: %w", err)
+			return 0, fmt.Errorf("failed to write input data: %w", err)
 		}
-		executeLogger.Verbosef("Input: %d bytes from resource '%s' (hash: %s)\n", n, inputResource.Name, inputResource.ObjectHash[:16]+"...")
-	} else {
-		executeLogger.Verbosef("Input: (empty - start step)\n")
+		executeLogger.Debug("Prepared input", "task_id", task.ID, "resource", inputResource.Name, "hash", inputResource.ObjectHash, "bytes", n)
+		return int64(n), nil
 	}
 
-	return nil
+	executeLogger.Debug("No input, start step", "task_id", task.ID)
+	return 0, nil
+}
+
+// TaskUsage is the time and resources one run of a task's script used
+type TaskUsage struct {
+	WallMS    int64 `json:"wall_ms"`
+	ExitCode  *int  `json:"exit_code"` // -1 if killed by a signal, nil if the script did not start
+	UserCPUMS int64 `json:"user_cpu_ms"`
+	SysCPUMS  int64 `json:"sys_cpu_ms"`
+	MaxRSSKB  int64 `json:"max_rss_kb"` // largest process in the script; see scriptUsage
+	BytesIn   int64 `json:"bytes_in"`
+	BytesOut  int64 `json:"bytes_out"`
 }
 
-func (e *ScriptExecutor) buildCommand(step Step, inputFile, outputDir string) *exec.Cmd {
-	cmd := exec.Command("sh", "-c", step.Script)
-	cmd.Env = append(os.Environ(),
+func (u TaskUsage) Wall() time.Duration {
+	return time.Duration(u.WallMS) * time.Millisecond
+}
+
+// CPU is the user plus system CPU time of the script and the children it waited for
+func (u TaskUsage) CPU() time.Duration {
+	return time.Duration(u.UserCPUMS+u.SysCPUMS) * time.Millisecond
+}
+
+func (u TaskUsage) spanAttributes() []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.Int64("grit.user_cpu_ms", u.UserCPUMS),
+		attribute.Int64("grit.sys_cpu_ms", u.SysCPUMS),
+		attribute.Int64("grit.max_rss_kb", u.MaxRSSKB),
+	}
+	if u.ExitCode != nil {
+		attrs = append(attrs, attribute.Int("grit.exit_code", *u.ExitCode))
+	}
+	return attrs
+}
+
+// scriptUsage reads the exit code and rusage of a finished command. Linux charges
+// the memory of the process that started the script to it at exec, so max RSS is
+// never less than that of the grit process that ran the task.
+func scriptUsage(cmd *exec.Cmd, wall time.Duration) TaskUsage {
+	usage := TaskUsage{WallMS: wall.Milliseconds()}
+	state := cmd.ProcessState
+	if state == nil {
+		return usage
+	}
+	code := state.ExitCode()
+	usage.ExitCode = &code
+	usage.UserCPUMS = state.UserTime().Milliseconds()
+	usage.SysCPUMS = state.SystemTime().Milliseconds()
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		usage.MaxRSSKB = int64(rusage.Maxrss) // kilobytes on Linux
+	}
+	return usage
+}
+
+// buildCommand returns the command running a step's script, and a function
+// removing the files it needs once it has run
+func (e *ScriptExecutor) buildCommand(ctx context.Context, step Step, inputFile, outputDir string) (*exec.Cmd, func(), error) {
+	cmd, cleanup, err := step.Runner.command(ctx, step.Script)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.processGroups {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+	// Don't wait forever on children still holding the script's output after it is killed
+	cmd.WaitDelay = 5 * time.Second
+	cmd.Dir = step.Runner.dir()
+	cmd.Env = append(step.Runner.environ(),
 		fmt.Sprintf("INPUT_FILE=%s", inputFile),
 		fmt.Sprintf("OUTPUT_DIR=%s", outputDir),
 	)
-	return cmd
+	cmd.Env = append(cmd.Env, matrixEnv(step.Params)...)
+	// Lets scripts that support tracing nest their spans under the task's
+	cmd.Env = append(cmd.Env, traceEnv(traceHeaders(ctx))...)
+	return cmd, cleanup, nil
 }
 
-func (e *ScriptExecutor) runScript(cmd *exec.Cmd, step Step) error {
+func (e *ScriptExecutor) runScript(cmd *exec.Cmd, taskID int64, step Step, output *logTail) error {
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("failed to create stdout pipe: %w", err)
@@ -102,11 +219,11 @@ func (e *ScriptExecutor) runScript(cmd *exec.Cmd, step Step) error {
 	}
 
 	if err := cmd.Start(); err != nil {
-		executeLogger.Printf("Error starting script: %v\n", err)
+		executeLogger.Error("Failed to start script", "task_id", taskID, "step", step.Name, "error", err)
 		return fmt.Errorf("failed to start script: %w", err)
 	}
 
-	scriptLogger := NewLogger(fmt.Sprintf("SCRIPT:%s ", step.Name))
+	scriptLogger := NewLogger("SCRIPT").With("task_id", taskID, "step", step.Name)
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -115,7 +232,8 @@ func (e *ScriptExecutor) runScript(cmd *exec.Cmd, step Step) error {
 		defer wg.Done()
 		scanner := bufio.NewScanner(stdoutPipe)
 		for scanner.Scan() {
-			scriptLogger.Verbosef("[stdout] %s\n", scanner.Text())
+			scriptLogger.Debug(scanner.Text(), "stream", "stdout")
+			output.WriteLine("", scanner.Text())
 		}
 	}()
 
@@ -123,7 +241,8 @@ func (e *ScriptExecutor) runScript(cmd *exec.Cmd, step Step) error {
 		defer wg.Done()
 		scanner := bufio.NewScanner(stderrPipe)
 		for scanner.Scan() {
-			scriptLogger.Verbosef("[stderr] %s\n", scanner.Text())
+			scriptLogger.Debug(scanner.Text(), "stream", "stderr")
+			output.WriteLine("[stderr] ", scanner.Text())
 		}
 	}()
 
@@ -134,9 +253,47 @@ func (e *ScriptExecutor) runScript(cmd *exec.Cmd, step Step) error {
 	wg.Wait()
 
 	if err != nil {
-		executeLogger.Printf("Error executing script: %v\n", err)
+		executeLogger.Warn("Script failed", "task_id", taskID, "step", step.Name, "error", err)
 		return fmt.Errorf("script execution failed: %w", err)
 	}
 
 	return nil
 }
+
+// maxTaskLogSize is how much of a script's output is kept in the task log
+const maxTaskLogSize = 64 << 10
+
+// logTail keeps the last max bytes of interleaved stdout and stderr lines
+type logTail struct {
+	mu        sync.Mutex
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func newLogTail(max int) *logTail {
+	return &logTail{max: max}
+}
+
+func (l *logTail) WriteLine(prefix string, line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = append(l.buf, prefix...)
+	l.buf = append(l.buf, line...)
+	l.buf = append(l.buf, '\n')
+	if over := len(l.buf) - l.max; over > 0 {
+		l.buf = append(l.buf[:0], l.buf[over:]...)
+		l.truncated = true
+	}
+}
+
+func (l *logTail) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.truncated {
+		return "[earlier output truncated]\n" + string(l.buf)
+	}
+	return string(l.buf)
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
-
-	"github.com/fatih/color"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 var exportLogger = NewLogger("EXPORT")
 
 func exportResourcesByName(database Database, resourceName string) {
-	exportLogger.Printf("Listing resources with name: %s\n", color.MagentaString(resourceName))
+	exportLogger.Info("Listing resources", "resource", resourceName)
 
 	// List all resources with the given name
 	resourceCount := 0
@@ -21,31 +27,362 @@ func exportResourcesByName(database Database, resourceName string) {
 	}
 
 	if resourceCount == 0 {
-		exportLogger.Printf("No resources found with name '%s'\n", resourceName)
+		exportLogger.Error("No resources found", "resource", resourceName)
 		os.Exit(1)
 	} else {
-		exportLogger.Printf("Listed %d resource(s)\n", resourceCount)
+		exportLogger.Info("Listed resources", "resource", resourceName, "count", resourceCount)
 	}
 }
 
 func exportResourceByHash(database Database, hash string) {
-	exportLogger.Printf("Exporting resource with hash: %s\n", color.MagentaString(hash[:16]+"..."))
-
-	// Check if object exists
-	if !database.ObjectExists(hash) {
-		exportLogger.Printf("Object with hash '%s' not found\n", hash)
-		os.Exit(1)
-	}
+	exportLogger.Info("Exporting resource", "hash", hash)
 
 	// Get object data
 	data, err := database.GetObject(hash)
+	if errors.Is(err, ErrObjectNotFound) {
+		exportLogger.Error("Object not found", "hash", hash)
+		os.Exit(1)
+	}
 	if err != nil {
-		exportLogger.Printf("Failed to get object %s: %v\n", hash[:16], err)
+		exportLogger.Error("Failed to get object", "hash", hash, "error", err)
 		os.Exit(1)
 	}
 
 	// Write raw content to stdout
 	os.Stdout.Write(data)
 	
-	exportLogger.Printf("Exported %d bytes\n", len(data))
+	exportLogger.Info("Exported resource", "hash", hash, "bytes", len(data))
+}
+
+// exportManifestName is the sidecar manifest written at the root of every bulk export
+const exportManifestName = "grit-export.json"
+
+// exportCommand materializes every matching resource as a file in a directory,
+// tar or zip archive, alongside a JSON manifest of hashes and lineage.
+func exportCommand(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	addLogFlags(fs)
+	dbFlags := addDatabaseFlags(fs)
+	var names stringSlice
+	fs.Var(&names, "name", "export resources with this name (can be used multiple times)")
+	step := fs.String("step", "", "export resources produced by this step")
+	latestVersion := fs.Bool("latest-version", false, "only export resources produced by the latest version of their step")
+	format := fs.String("format", "", "output format: dir, tar or zip (defaults to the --to extension, or dir)")
+	to := fs.String("to", "", "output directory or archive path (- writes the archive to stdout)")
+	commandUsage(fs, "export [--name NAME]... [--step STEP] [--latest-version] [--format dir|tar|zip] --to PATH")
+	fs.Parse(args)
+
+	if *to == "" || (len(names) == 0 && *step == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *format == "" {
+		*format = exportFormatFor(*to)
+	}
+
+	database := dbFlags.open(DatabaseOptions{ReadOnly: true})
+	defer database.Close()
+
+	filter := ResourceFilter{Names: names, Step: *step, LatestVersion: *latestVersion}
+	found, err := database.FindResources(filter)
+	if err != nil {
+		fatal("Failed to query resources", "error", err)
+	}
+
+	// Step exports mirror the task layout; name exports have one file per distinct resource
+	entries, err := buildExportEntries(found, *step != "")
+	if err != nil {
+		fatal("Failed to build export", "error", err)
+	}
+	if len(entries) == 0 {
+		exportLogger.Error("No resources matched")
+		os.Exit(1)
+	}
+
+	writer, err := newExportWriter(*format, *to)
+	if err != nil {
+		fatal("Failed to create export", "path", *to, "error", err)
+	}
+
+	var total int64
+	for i := range entries {
+		entry := &entries[i]
+		data, err := database.GetObject(entry.Hash)
+		if err != nil {
+			fatal("Failed to get object", "hash", entry.Hash, "path", entry.Path, "error", err)
+		}
+		entry.Size = len(data)
+		total += int64(len(data))
+
+		if err := writer.WriteFile(entry.Path, data, parseResourceTime(entry.CreatedAt)); err != nil {
+			fatal("Failed to write file", "path", entry.Path, "error", err)
+		}
+		exportLogger.Debug("Exported file", "path", entry.Path, "hash", entry.Hash, "bytes", len(data))
+	}
+
+	manifest, err := json.MarshalIndent(exportManifest{
+		ExportedAt: time.Now().UTC(),
+		Database:   *dbFlags.path,
+		Query: exportQuery{
+			Names:         filter.Names,
+			Step:          filter.Step,
+			LatestVersion: filter.LatestVersion,
+		},
+		Resources: entries,
+	}, "", "  ")
+	if err != nil {
+		fatal("Failed to encode export manifest", "path", exportManifestName, "error", err)
+	}
+	if err := writer.WriteFile(exportManifestName, append(manifest, '\n'), time.Now()); err != nil {
+		fatal("Failed to write export manifest", "path", exportManifestName, "error", err)
+	}
+	if err := writer.Close(); err != nil {
+		fatal("Failed to finish export", "path", *to, "error", err)
+	}
+
+	exportLogger.Info("Exported files", "count", len(entries), "bytes", total, "path", *to, "format", *format)
+}
+
+// exportManifest is the content of grit-export.json
+type exportManifest struct {
+	ExportedAt time.Time     `json:"exported_at"`
+	Database   string        `json:"database"`
+	Query      exportQuery   `json:"query"`
+	Resources  []exportEntry `json:"resources"`
+}
+
+type exportQuery struct {
+	Names         []string `json:"names,omitempty"`
+	Step          string   `json:"step,omitempty"`
+	LatestVersion bool     `json:"latest_version,omitempty"`
+}
+
+type exportEntry struct {
+	Path       string         `json:"path"`
+	Name       string         `json:"name"`
+	Hash       string         `json:"hash"`
+	Size       int            `json:"size"`
+	CreatedAt  string         `json:"created_at"`
+	Source     string         `json:"source,omitempty"` // set for imported resources
+	ProducedBy []exportOrigin `json:"produced_by"`      // empty if the producing task was not recorded
+}
+
+type exportOrigin struct {
+	Step        string       `json:"step"`
+	StepVersion int          `json:"step_version"`
+	TaskID      int64        `json:"task_id"`
+	Filename    string       `json:"filename"`
+	Input       *exportInput `json:"input,omitempty"` // absent for start steps
+}
+
+type exportInput struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+// buildExportEntries assigns each resource its path in the export:
+//
+//	byStep:  <step>/v<version>/<task-id>/<filename>
+//	byName:  <name>/<hash prefix>-<name>
+//
+// Name exports merge every task that produced the same resource into one entry.
+func buildExportEntries(found []ResourceLineage, byStep bool) ([]exportEntry, error) {
+	var entries []exportEntry
+	byResource := make(map[int64]int)
+
+	for _, l := range found {
+		var origins []exportOrigin
+		if l.Origin != nil {
+			origin := exportOrigin{
+				Step:        l.Origin.StepName,
+				StepVersion: l.Origin.StepVersion,
+				TaskID:      l.Origin.TaskID,
+				Filename:    l.Origin.Filename,
+			}
+			if l.Origin.Input != nil {
+				origin.Input = &exportInput{Name: l.Origin.Input.Name, Hash: l.Origin.Input.ObjectHash}
+			}
+			origins = append(origins, origin)
+		}
+
+		var path string
+		if byStep {
+			path = fmt.Sprintf("%s/v%d/%d/%s", l.Origin.StepName, l.Origin.StepVersion, l.Origin.TaskID, l.Origin.Filename)
+		} else {
+			if i, ok := byResource[l.Resource.ID]; ok {
+				entries[i].ProducedBy = append(entries[i].ProducedBy, origins...)
+				continue
+			}
+			byResource[l.Resource.ID] = len(entries)
+			path = fmt.Sprintf("%s/%s-%s", l.Resource.Name, l.Resource.ObjectHash[:16], l.Resource.Name)
+		}
+
+		// Names come from the database, which may hold anything; an export must
+		// not write outside its root, including when a tar or zip is unpacked
+		if err := checkExportPath(path); err != nil {
+			return nil, err
+		}
+		if strings.SplitN(path, "/", 2)[0] == exportManifestName {
+			return nil, fmt.Errorf("%s conflicts with the export manifest %s", path, exportManifestName)
+		}
+
+		entries = append(entries, exportEntry{
+			Path:       path,
+			Name:       l.Resource.Name,
+			Hash:       l.Resource.ObjectHash,
+			CreatedAt:  l.Resource.CreatedAt,
+			Source:     l.Resource.Source,
+			ProducedBy: origins,
+		})
+	}
+
+	return entries, nil
+}
+
+// checkExportPath rejects a path that is absolute, leaves the export root or is
+// not already clean
+func checkExportPath(path string) error {
+	for _, part := range strings.Split(path, "/") {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "\\\x00") {
+			return fmt.Errorf("cannot export %q: not a relative path inside the export", path)
+		}
+	}
+	if !filepath.IsLocal(filepath.FromSlash(path)) {
+		return fmt.Errorf("cannot export %q: not a relative path inside the export", path)
+	}
+	return nil
+}
+
+func exportFormatFor(to string) string {
+	switch {
+	case strings.HasSuffix(to, ".tar"):
+		return "tar"
+	case strings.HasSuffix(to, ".zip"):
+		return "zip"
+	case to == "-":
+		return "tar"
+	}
+	return "dir"
+}
+
+// parseResourceTime converts a resource created_at column to a file modification time
+func parseResourceTime(createdAt string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, time.DateTime} {
+		if t, err := time.Parse(layout, createdAt); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+// exportWriter receives the files of a bulk export
+type exportWriter interface {
+	WriteFile(path string, data []byte, modTime time.Time) error
+	Close() error
+}
+
+func newExportWriter(format string, to string) (exportWriter, error) {
+	if format == "dir" {
+		if to == "-" {
+			return nil, fmt.Errorf("dir exports cannot be written to stdout")
+		}
+		return dirExportWriter{root: to}, os.MkdirAll(to, 0755)
+	}
+
+	out := os.Stdout
+	if to != "-" {
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.Create(to)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+
+	switch format {
+	case "tar":
+		return &tarExportWriter{tw: tar.NewWriter(out), out: out}, nil
+	case "zip":
+		return &zipExportWriter{zw: zip.NewWriter(out), out: out}, nil
+	}
+	out.Close()
+	return nil, fmt.Errorf("unknown export format %q (expected dir, tar or zip)", format)
+}
+
+type dirExportWriter struct {
+	root string
+}
+
+func (w dirExportWriter) WriteFile(path string, data []byte, modTime time.Time) error {
+	full := filepath.Join(w.root, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(full, data, 0644); err != nil {
+		return err
+	}
+	return os.Chtimes(full, modTime, modTime)
+}
+
+func (w dirExportWriter) Close() error { return nil }
+
+type tarExportWriter struct {
+	tw  *tar.Writer
+	out *os.File
+}
+
+func (w *tarExportWriter) WriteFile(path string, data []byte, modTime time.Time) error {
+	err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.tw.Write(data)
+	return err
+}
+
+func (w *tarExportWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	return closeExportOutput(w.out)
+}
+
+type zipExportWriter struct {
+	zw  *zip.Writer
+	out *os.File
+}
+
+func (w *zipExportWriter) WriteFile(path string, data []byte, modTime time.Time) error {
+	f, err := w.zw.CreateHeader(&zip.FileHeader{
+		Name:     path,
+		Method:   zip.Deflate,
+		Modified: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+func (w *zipExportWriter) Close() error {
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+	return closeExportOutput(w.out)
+}
+
+func closeExportOutput(out *os.File) error {
+	if out == os.Stdout {
+		return nil
+	}
+	return out.Close()
 }
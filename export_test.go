@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckExportPath(t *testing.T) {
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"results/0123456789abcdef-results", true},
+		{"train/v2/17/model.bin", true},
+		{"name with spaces/file", true},
+		{"..", false},
+		{"../escape", false},
+		{"results/../../escape", false},
+		{"/etc/passwd", false},
+		{"results//file", false},
+		{"./results/file", false},
+		{"results/file/", false},
+		{"", false},
+		{`results\..\escape`, false},
+		{"results/\x00", false},
+	}
+	for _, tt := range tests {
+		if err := checkExportPath(tt.path); (err == nil) != tt.ok {
+			t.Errorf("checkExportPath(%q) = %v, want ok %v", tt.path, err, tt.ok)
+		}
+	}
+}
+
+func TestBuildExportEntries(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	lineage := func(name, filename string) ResourceLineage {
+		return ResourceLineage{
+			Resource: Resource{ID: int64(len(name)), Name: name, ObjectHash: hash},
+			Origin:   &ResourceOrigin{TaskID: 7, Filename: filename, StepName: "train", StepVersion: 2},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		resource ResourceLineage
+		byStep   bool
+		want     string // the entry's path, or "" for an error
+	}{
+		{"by name", lineage("model", "model"), false, "model/abababababababab-model"},
+		{"by step", lineage("model", "model"), true, "train/v2/7/model"},
+		{"name leaving the root", lineage("..", ".."), false, ""},
+		{"filename leaving the root", lineage("model", "../../model"), true, ""},
+		{"absolute name", lineage("/tmp", "tmp"), false, ""},
+		{"export manifest", lineage(exportManifestName, exportManifestName), false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := buildExportEntries([]ResourceLineage{tt.resource}, tt.byStep)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("got entries %+v, want an error", entries)
+				}
+				return
+			}
+			if err != nil || len(entries) != 1 || entries[0].Path != tt.want {
+				t.Fatalf("got %+v, %v, want one entry at %s", entries, err, tt.want)
+			}
+		})
+	}
+}
@@ -21,7 +21,7 @@
             pname = "grit";
             version = "0.2.2";
             src = self;
-            vendorHash = "sha256-NEWUHUio0oPZdSB9obpZEOD5RQcIsAwnosQg2yESXME=";
+            vendorHash = "sha256-y/wuQhVeJNwdPwuDh8WYQM2334e7P9yT2YHWh93l/F4=";
             subPackages = [ "." ];
 
             GO_PATH = "${self.outPath}/.go";
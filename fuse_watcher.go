@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,17 +24,42 @@ type FuseWatcher struct {
 	files      map[string]*fileData
 	closed     bool
 	outputChan chan<- FileData
-	openFiles  sync.WaitGroup // Track open files
+	openFiles  sync.WaitGroup        // Track open files
+	pending    sync.WaitGroup        // Files handed to outputChan but not yet committed
+	taskDirs   map[string]taskOutput // Per-task output directories, keyed by directory name
+}
+
+// taskOutput describes who owns a task output directory
+type taskOutput struct {
+	taskID   int64
+	compress Compression
+	outputs  OutputRules
+	files    *taskFiles
+}
+
+// taskFiles tracks the files of one task, so its outputs can be waited for
+type taskFiles struct {
+	open       sync.WaitGroup // Files the task has open
+	committed  sync.WaitGroup // Files handed to outputChan but not yet committed
+	undeclared []string       // Files the step's outputs do not allow, guarded by FuseWatcher.mu
+	commitErr  error          // First file that failed to be stored or recorded, guarded by FuseWatcher.mu
 }
 
 // FileData contains the filename and content of a file written to the FUSE mount
 type FileData struct {
-	Name   string
-	Reader io.Reader
+	Name     string
+	Reader   io.Reader
+	TaskID   int64 // Task that wrote the file
+	Compress Compression
+
+	// Committed is called once the file is stored and recorded, with the error
+	// that kept it from being either, if set
+	Committed func(err error)
 }
 
 type fileData struct {
 	content []byte
+	owner   taskOutput
 	mu      sync.Mutex
 }
 
@@ -43,12 +72,13 @@ func NewFuseWatcher(mountPath string, outputChan chan<- FileData) (*FuseWatcher,
 		return nil, err
 	}
 
-	fuseLogger.Println("New FUSE watcher at", mountPath)
+	fuseLogger.Info("New FUSE watcher", "path", mountPath)
 
 	fw := &FuseWatcher{
 		mountPath:  mountPath,
 		files:      make(map[string]*fileData),
 		outputChan: outputChan,
+		taskDirs:   make(map[string]taskOutput),
 	}
 
 	fs := pathfs.NewPathNodeFs(&fuseFS{
@@ -81,7 +111,7 @@ func NewTempDirFuseWatcher(outputChan chan<- FileData) (*FuseWatcher, error) {
 
 // Start begins serving the FUSE filesystem
 func (fw *FuseWatcher) Start() {
-	fuseLogger.Verbosef("Starting server at %s\n", fw.mountPath)
+	fuseLogger.Debug("Starting server", "path", fw.mountPath)
 	go fw.server.Serve()
 }
 
@@ -90,6 +120,105 @@ func (fw *FuseWatcher) GetMountPath() string {
 	return fw.mountPath
 }
 
+// AddTaskDir creates an output directory for a task and returns its path.
+// Files written under it are attributed to the task and stored with the given
+// compression; files the output rules do not allow are refused or warned about.
+func (fw *FuseWatcher) AddTaskDir(taskID int64, compress Compression, outputs OutputRules) string {
+	name := strconv.FormatInt(taskID, 10)
+
+	fw.mu.Lock()
+	fw.taskDirs[name] = taskOutput{taskID: taskID, compress: compress, outputs: outputs, files: &taskFiles{}}
+	fw.mu.Unlock()
+
+	return filepath.Join(fw.mountPath, name)
+}
+
+// RemoveTaskDir removes a task's output directory once the task has finished.
+// Files still open keep their owner and are consumed normally when released.
+func (fw *FuseWatcher) RemoveTaskDir(taskID int64) {
+	name := strconv.FormatInt(taskID, 10)
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	delete(fw.taskDirs, name)
+	for path := range fw.files {
+		if dir, _ := splitOutputPath(path); dir == name {
+			delete(fw.files, path)
+		}
+	}
+}
+
+// WaitForTaskOutputs blocks until the files a task wrote have been closed, stored
+// and recorded as resources, and returns the first error storing or recording
+// one. Must be called before RemoveTaskDir.
+func (fw *FuseWatcher) WaitForTaskOutputs(taskID int64) error {
+	fw.mu.Lock()
+	owner, ok := fw.taskDirs[strconv.FormatInt(taskID, 10)]
+	fw.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	owner.files.open.Wait()
+	owner.files.committed.Wait()
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return owner.files.commitErr
+}
+
+// TaskOutputSize returns the total size of the files a task has written to its
+// output directory
+func (fw *FuseWatcher) TaskOutputSize(taskID int64) int64 {
+	name := strconv.FormatInt(taskID, 10)
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	var size int64
+	for path, fd := range fw.files {
+		if dir, _ := splitOutputPath(path); dir == name {
+			fd.mu.Lock()
+			size += int64(len(fd.content))
+			fd.mu.Unlock()
+		}
+	}
+	return size
+}
+
+// TaskOutputs returns the files a task has written to its output directory, and
+// the undeclared files it was refused. Empty files are not outputs.
+func (fw *FuseWatcher) TaskOutputs(taskID int64) (written, refused []string) {
+	name := strconv.FormatInt(taskID, 10)
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	for path, fd := range fw.files {
+		if dir, file := splitOutputPath(path); dir == name {
+			fd.mu.Lock()
+			if len(fd.content) > 0 {
+				written = append(written, file)
+			}
+			fd.mu.Unlock()
+		}
+	}
+	if owner, ok := fw.taskDirs[name]; ok && !owner.outputs.WarnUndeclared {
+		refused = owner.files.undeclared
+	}
+	return written, refused
+}
+
+// splitOutputPath splits "<task dir>/<file>" into its two parts
+func splitOutputPath(name string) (string, string) {
+	dir, file, found := strings.Cut(name, "/")
+	if !found {
+		return "", name
+	}
+	return dir, file
+}
+
 // WaitForWrites blocks until all open files have been closed
 func (fw *FuseWatcher) WaitForWrites() {
 	if fw == nil {
@@ -108,7 +237,7 @@ func (fw *FuseWatcher) Stop() error {
 	fw.closed = true
 	fw.mu.Unlock()
 
-	fuseLogger.Verbosef("Stopping server at %s\n", fw.mountPath)
+	fuseLogger.Debug("Stopping server", "path", fw.mountPath)
 
 	// Wait for any open files to be closed (with short timeout)
 	done := make(chan struct{})
@@ -119,28 +248,55 @@ func (fw *FuseWatcher) Stop() error {
 
 	select {
 	case <-done:
-		fuseLogger.Verbosef("All files closed gracefully\n")
+		fuseLogger.Debug("All files closed gracefully")
 	case <-time.After(2 * time.Second):
-		fuseLogger.Verbosef("Timeout waiting for open files, continuing shutdown\n")
+		fuseLogger.Warn("Timeout waiting for open files, continuing shutdown")
 	}
 
 	// Unmount the filesystem
 	err := fw.server.Unmount()
 	if err != nil {
-		fuseLogger.Verbosef("Error unmounting: %v\n", err)
+		fuseLogger.Warn("Failed to unmount", "path", fw.mountPath, "error", err)
 	}
 
 	// Clean up the mount directory
 	if err := os.RemoveAll(fw.mountPath); err != nil {
-		fuseLogger.Verbosef("Error removing mount directory %s: %v\n", fw.mountPath, err)
+		fuseLogger.Warn("Failed to remove mount directory", "path", fw.mountPath, "error", err)
 		return err
 	}
 
-	fuseLogger.Verbosef("Cleaned up mount directory %s\n", fw.mountPath)
+	fuseLogger.Debug("Cleaned up mount directory", "path", fw.mountPath)
 
 	return nil
 }
 
+// ownerOf returns the task owning a file path. Files may only be created inside
+// a task output directory. Must be called with fw.mu held.
+func (fw *FuseWatcher) ownerOf(name string) (taskOutput, fuse.Status) {
+	dir, file := splitOutputPath(name)
+	owner, ok := fw.taskDirs[dir]
+	if !ok || file == "" || strings.Contains(file, "/") {
+		fuseLogger.Debug("create refused, not in a task output directory", "path", name)
+		return taskOutput{}, fuse.EACCES
+	}
+	if !owner.outputs.allows(file) {
+		first := !slices.Contains(owner.files.undeclared, file)
+		if first {
+			owner.files.undeclared = append(owner.files.undeclared, file)
+		}
+		if !owner.outputs.WarnUndeclared {
+			if first {
+				fuseLogger.Warn("Undeclared output refused", "task_id", owner.taskID, "file", file)
+			}
+			return taskOutput{}, fuse.EACCES
+		}
+		if first {
+			fuseLogger.Warn("Undeclared output", "task_id", owner.taskID, "file", file)
+		}
+	}
+	return owner, fuse.OK
+}
+
 // fuseFS implements the FUSE filesystem interface
 type fuseFS struct {
 	pathfs.FileSystem
@@ -156,23 +312,31 @@ func (fs *fuseFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.
 	}
 
 	fs.watcher.mu.Lock()
+	_, isTaskDir := fs.watcher.taskDirs[name]
 	_, exists := fs.watcher.files[name]
 	fs.watcher.mu.Unlock()
 
+	if isTaskDir {
+		// Task output directory - write-only like the root
+		return &fuse.Attr{
+			Mode: fuse.S_IFDIR | 0200,
+		}, fuse.OK
+	}
+
 	if exists {
 		return &fuse.Attr{
 			Mode: fuse.S_IFREG | 0200, // Write-only file
 		}, fuse.OK
 	}
 
-	fuseLogger.Verbosef("getattr %s\n", name)
+	fuseLogger.Debug("getattr", "path", name)
 
 	return nil, fuse.ENOENT
 }
 
 func (fs *fuseFS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	// Deny directory listing - write-only directory
-	fuseLogger.Verbosef("opendir refused %s\n", name)
+	fuseLogger.Debug("opendir refused", "path", name)
 	return nil, fuse.EACCES
 }
 
@@ -187,17 +351,23 @@ func (fs *fuseFS) Open(name string, flags uint32, context *fuse.Context) (nodefs
 	// Check if opening for read - deny read access (write-only filesystem)
 	accessMode := flags & 0x3 // O_RDONLY=0, O_WRONLY=1, O_RDWR=2
 	if accessMode == 0 {      // O_RDONLY
-		fuseLogger.Verbosef("open %s denied - read access not permitted\n", name)
+		fuseLogger.Debug("open denied, read access not permitted", "path", name)
 		return nil, fuse.EACCES
 	}
 
+	owner, status := fs.watcher.ownerOf(name)
+	if status != fuse.OK {
+		return nil, status
+	}
+
 	// For write-only filesystem: allow opening any file for write
 	// Each open creates fresh content (like O_TRUNC behavior)
-	fd := &fileData{content: make([]byte, 0)}
+	fd := &fileData{content: make([]byte, 0), owner: owner}
 	fs.watcher.files[name] = fd
 	fs.watcher.openFiles.Add(1) // Track this open file
+	owner.files.open.Add(1)
 
-	fuseLogger.Verbosef("open %s flags=0x%x (write)\n", name, flags)
+	fuseLogger.Debug("open for write", "task_id", owner.taskID, "path", name, "flags", flags)
 
 	return &fuseFile{
 		File:    nodefs.NewDefaultFile(),
@@ -215,11 +385,17 @@ func (fs *fuseFS) Create(name string, flags uint32, mode uint32, context *fuse.C
 		return nil, fuse.EROFS
 	}
 
-	fd := &fileData{content: make([]byte, 0)}
+	owner, status := fs.watcher.ownerOf(name)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	fd := &fileData{content: make([]byte, 0), owner: owner}
 	fs.watcher.files[name] = fd
 	fs.watcher.openFiles.Add(1) // Track this open file
+	owner.files.open.Add(1)
 
-	fuseLogger.Verbosef("create %s flags=%d mode=%d\n", name, flags, mode)
+	fuseLogger.Debug("create", "task_id", owner.taskID, "path", name, "flags", flags, "mode", mode)
 
 	return &fuseFile{
 		File:    nodefs.NewDefaultFile(),
@@ -233,7 +409,7 @@ func (fs *fuseFS) Unlink(name string, context *fuse.Context) fuse.Status {
 	fs.watcher.mu.Lock()
 	defer fs.watcher.mu.Unlock()
 
-	fuseLogger.Verbosef("unlink %s\n", name)
+	fuseLogger.Debug("unlink", "path", name)
 	delete(fs.watcher.files, name)
 	return fuse.OK
 }
@@ -260,9 +436,10 @@ func (f *fuseFile) Write(data []byte, off int64) (uint32, fuse.Status) {
 
 	// Only log first write to avoid spam for large files
 	if off == 0 {
-		fuseLogger.Verbosef("write %s started\n", f.name)
+		fuseLogger.Debug("write started", "task_id", f.data.owner.taskID, "path", f.name)
 	}
 	copy(f.data.content[off:], data)
+	metrics.fuseBytes.Add(int64(len(data)))
 	return uint32(len(data)), fuse.OK
 }
 
@@ -325,16 +502,37 @@ func (f *fuseFile) Release() {
 			// Send file data to output channel - blocks until consumed
 			if f.watcher.outputChan != nil {
 				reader := bytes.NewReader(content)
-				f.watcher.outputChan <- FileData{Name: f.name, Reader: reader}
+				_, file := splitOutputPath(f.name)
+				owner := f.data.owner
+				f.watcher.pending.Add(1)
+				owner.files.committed.Add(1)
+				f.watcher.outputChan <- FileData{
+					Name:     owner.outputs.storedName(file),
+					Reader:   reader,
+					TaskID:   owner.taskID,
+					Compress: owner.compress,
+					Committed: func(err error) {
+						if err != nil {
+							f.watcher.mu.Lock()
+							if owner.files.commitErr == nil {
+								owner.files.commitErr = err
+							}
+							f.watcher.mu.Unlock()
+						}
+						f.watcher.pending.Done()
+						owner.files.committed.Done()
+					},
+				}
 			}
 		}
 	}
 
-	fuseLogger.Verbosef("release %s\n", f.name)
+	fuseLogger.Debug("release", "task_id", f.data.owner.taskID, "path", f.name)
 
 	// DON'T delete from map - allow file to be opened/written again
 	// Each Create() will replace the entry with fresh data
 
 	// Signal that this file is closed
+	f.data.owner.files.open.Done()
 	f.watcher.openFiles.Done()
 }
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// graphCommand prints the step graph of a manifest: steps, the resource names
+// they write and the steps that take those resources as input. With --counts
+// the nodes are annotated with task and resource counts from the database.
+func graphCommand(args []string) {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	addLogFlags(fs)
+	dbFlags := addDatabaseFlags(fs)
+	manifestPath := fs.String("manifest", "", "manifest path (or give it as an argument)")
+	format := fs.String("format", "dot", "output format: dot, mermaid or json")
+	counts := fs.Bool("counts", false, "annotate steps and resources with counts from the database")
+	vars := addVarFlag(fs)
+	commandUsage(fs, "graph [--format dot|mermaid|json] [--counts [-db PATH]] [-var NAME=VALUE] MANIFEST")
+	positional := parseArgs(fs, args)
+	if len(positional) == 1 && *manifestPath == "" {
+		*manifestPath = positional[0]
+	} else if len(positional) != 0 || *manifestPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var write func(io.Writer, stepGraph)
+	switch *format {
+	case "dot":
+		write = writeDotGraph
+	case "mermaid":
+		write = writeMermaidGraph
+	case "json":
+		write = func(w io.Writer, graph stepGraph) {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(graph)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q (expected dot, mermaid or json)\n", *format)
+		os.Exit(2)
+	}
+
+	manifest, err := LoadManifest(*manifestPath, vars)
+	if err != nil {
+		fatal("Failed to load manifest", "path", *manifestPath, "error", err)
+	}
+
+	graph := buildStepGraph(manifest)
+	if *counts {
+		storeSpec := *dbFlags.objectStore
+		if storeSpec == "" {
+			storeSpec = manifest.ObjectStore
+		}
+		database := dbFlags.open(DatabaseOptions{ObjectStore: storeSpec, ReadOnly: true})
+		defer database.Close()
+		if err := graph.addCounts(database); err != nil {
+			fatal("Failed to count tasks", "error", err)
+		}
+	}
+	write(os.Stdout, graph)
+}
+
+// stepGraph is the graph of a manifest. Edges go from a step to a resource name
+// it writes ("writes") and from a resource name to a step taking it as input ("reads").
+type stepGraph struct {
+	Steps     []graphStep     `json:"steps"`
+	Resources []graphResource `json:"resources"`
+	Edges     []graphEdge     `json:"edges"`
+}
+
+type graphStep struct {
+	Name   string   `json:"name"`
+	Start  bool     `json:"start,omitempty"`
+	Inputs []string `json:"inputs,omitempty"`
+	// OutputsKnown is false when the step declares no outputs and its script
+	// computes the names it writes, so some of its edges may be missing
+	OutputsKnown bool         `json:"outputs_known"`
+	Counts       *graphCounts `json:"counts,omitempty"`
+}
+
+// graphCounts are the tasks of the latest version of a step
+type graphCounts struct {
+	Version int   `json:"version"`
+	Tasks   int64 `json:"tasks"`
+	Done    int64 `json:"done"`
+	Failed  int64 `json:"failed"`
+	Pending int64 `json:"pending"`
+}
+
+type graphResource struct {
+	Name string `json:"name"`
+	// Imported is set when no step writes the name, so it can only come from grit import or watch
+	Imported bool   `json:"imported,omitempty"`
+	Count    *int64 `json:"count,omitempty"`
+}
+
+type graphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// buildStepGraph links the steps of manifest through the resource names they
+// write (declared, or read from their scripts) and their inputs
+func buildStepGraph(manifest Manifest) stepGraph {
+	graph := stepGraph{Steps: []graphStep{}, Resources: []graphResource{}, Edges: []graphEdge{}}
+	for _, step := range manifest.Steps {
+		outputs, known := stepOutputs(step)
+		graph.Steps = append(graph.Steps, graphStep{Name: step.Name, Start: step.Start, Inputs: step.Inputs, OutputsKnown: known})
+		for _, name := range outputs {
+			graph.addWrite(step.Name, name)
+		}
+	}
+	for _, step := range manifest.Steps {
+		for _, input := range step.Inputs {
+			if graph.resource(input) == nil {
+				graph.Resources = append(graph.Resources, graphResource{Name: input, Imported: true})
+			}
+			graph.Edges = append(graph.Edges, graphEdge{From: input, To: step.Name, Kind: "reads"})
+		}
+	}
+	return graph
+}
+
+func (g *stepGraph) resource(name string) *graphResource {
+	for i := range g.Resources {
+		if g.Resources[i].Name == name {
+			return &g.Resources[i]
+		}
+	}
+	return nil
+}
+
+func (g *stepGraph) addWrite(step, name string) {
+	edge := graphEdge{From: step, To: name, Kind: "writes"}
+	if slices.Contains(g.Edges, edge) {
+		return
+	}
+	if r := g.resource(name); r == nil {
+		g.Resources = append(g.Resources, graphResource{Name: name})
+	} else {
+		r.Imported = false
+	}
+	g.Edges = append(g.Edges, edge)
+}
+
+// addCounts annotates the graph with task counts from the database, and adds
+// the resource names steps have actually written that their scripts do not show
+func (g *stepGraph) addCounts(database Database) error {
+	for i := range g.Steps {
+		step, err := database.GetStepByName(g.Steps[i].Name)
+		if err != nil {
+			return err
+		}
+		if step == nil {
+			continue
+		}
+		total, processed, err := database.GetTaskCountsForStep(step.ID)
+		if err != nil {
+			return err
+		}
+		failed, err := database.CountFailedTasksForStep(step.ID)
+		if err != nil {
+			return err
+		}
+		g.Steps[i].Counts = &graphCounts{Version: step.Version, Tasks: total, Done: processed - failed, Failed: failed, Pending: total - processed}
+	}
+
+	outputs, err := database.ListStepOutputNames()
+	if err != nil {
+		return err
+	}
+	for _, step := range g.Steps {
+		for _, name := range outputs[step.Name] {
+			g.addWrite(step.Name, name)
+		}
+	}
+
+	resources, err := database.CountResourcesByName()
+	if err != nil {
+		return err
+	}
+	for i := range g.Resources {
+		count := resources[g.Resources[i].Name]
+		g.Resources[i].Count = &count
+	}
+	return nil
+}
+
+func (s graphStep) label() string {
+	label := s.Name
+	if s.Counts != nil {
+		label += fmt.Sprintf("\nv%d: %d done", s.Counts.Version, s.Counts.Done)
+		if s.Counts.Failed > 0 {
+			label += fmt.Sprintf(", %d failed", s.Counts.Failed)
+		}
+		if s.Counts.Pending > 0 {
+			label += fmt.Sprintf(", %d pending", s.Counts.Pending)
+		}
+	}
+	return label
+}
+
+func (r graphResource) label() string {
+	label := r.Name
+	if r.Imported {
+		label += " (imported)"
+	}
+	if r.Count != nil {
+		label += fmt.Sprintf("\n%d", *r.Count)
+	}
+	return label
+}
+
+// writeDotGraph writes the graph for Graphviz: steps are boxes (bold for the
+// start step, red when tasks failed, dashed when their outputs are not all
+// known) and resource names are ellipses
+func writeDotGraph(w io.Writer, graph stepGraph) {
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+	}
+	fmt.Fprintln(w, "digraph grit {")
+	fmt.Fprintln(w, "\trankdir=LR;")
+	for _, step := range graph.Steps {
+		var style []string
+		if step.Start {
+			style = append(style, "bold")
+		}
+		if !step.OutputsKnown {
+			style = append(style, "dashed")
+		}
+		attrs := "shape=box"
+		if len(style) > 0 {
+			attrs += ", style=" + quote(strings.Join(style, ","))
+		}
+		if step.Counts != nil && step.Counts.Failed > 0 {
+			attrs += ", color=red"
+		}
+		fmt.Fprintf(w, "\t%s [label=%s, %s];\n", quote("step:"+step.Name), quote(step.label()), attrs)
+	}
+	for _, r := range graph.Resources {
+		attrs := "shape=ellipse"
+		if r.Imported {
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(w, "\t%s [label=%s, %s];\n", quote("resource:"+r.Name), quote(r.label()), attrs)
+	}
+	for _, e := range graph.Edges {
+		from, to := "step:"+e.From, "resource:"+e.To
+		if e.Kind == "reads" {
+			from, to = "resource:"+e.From, "step:"+e.To
+		}
+		fmt.Fprintf(w, "\t%s -> %s;\n", quote(from), quote(to))
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// writeMermaidGraph writes the graph as a Mermaid flowchart, which GitHub and
+// most documentation tools render inline
+func writeMermaidGraph(w io.Writer, graph stepGraph) {
+	label := func(s string) string {
+		return `"` + strings.NewReplacer(`"`, "#quot;", "\n", "<br/>").Replace(s) + `"`
+	}
+	stepIDs := make(map[string]string)
+	resourceIDs := make(map[string]string)
+
+	fmt.Fprintln(w, "flowchart LR")
+	for i, step := range graph.Steps {
+		id := fmt.Sprintf("s%d", i)
+		stepIDs[step.Name] = id
+		class := ""
+		switch {
+		case step.Counts != nil && step.Counts.Failed > 0:
+			class = ":::failed"
+		case step.Start:
+			class = ":::start"
+		}
+		fmt.Fprintf(w, "    %s[%s]%s\n", id, label(step.label()), class)
+	}
+	for i, r := range graph.Resources {
+		id := fmt.Sprintf("r%d", i)
+		resourceIDs[r.Name] = id
+		fmt.Fprintf(w, "    %s([%s])\n", id, label(r.label()))
+	}
+	for _, e := range graph.Edges {
+		if e.Kind == "reads" {
+			fmt.Fprintf(w, "    %s --> %s\n", resourceIDs[e.From], stepIDs[e.To])
+		} else {
+			fmt.Fprintf(w, "    %s --> %s\n", stepIDs[e.From], resourceIDs[e.To])
+		}
+	}
+	fmt.Fprintln(w, "    classDef start stroke-width:3px")
+	fmt.Fprintln(w, "    classDef failed stroke:#d33,stroke-width:3px")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestBuildStepGraph(t *testing.T) {
+	tests := []struct {
+		name      string
+		steps     []ManifestStep
+		edges     []graphEdge
+		imported  []string
+		uncertain []string // steps whose outputs are not all known
+	}{
+		{
+			name: "chain",
+			steps: []ManifestStep{
+				{Name: "fetch", Start: true, Script: "date > $OUTPUT_DIR/raw"},
+				{Name: "clean", Inputs: []string{"raw"}, Script: "sort $INPUT_FILE > $OUTPUT_DIR/clean"},
+			},
+			edges: []graphEdge{{"fetch", "raw", "writes"}, {"clean", "clean", "writes"}, {"raw", "clean", "reads"}},
+		},
+		{
+			name: "declared outputs and imports",
+			steps: []ManifestStep{
+				{Name: "split", Inputs: []string{"corpus"}, Outputs: []string{"train", "test"}, Script: "split $INPUT_FILE"},
+				{Name: "eval", Inputs: []string{"test", "model"}, Script: "eval > $OUTPUT_DIR/$METRIC"},
+			},
+			edges: []graphEdge{
+				{"split", "train", "writes"}, {"split", "test", "writes"},
+				{"corpus", "split", "reads"}, {"test", "eval", "reads"}, {"model", "eval", "reads"},
+			},
+			imported:  []string{"corpus", "model"},
+			uncertain: []string{"eval"},
+		},
+		{
+			name: "one resource written twice by a step",
+			steps: []ManifestStep{
+				{Name: "fetch", Start: true, Script: "a > $OUTPUT_DIR/raw_1; b > $OUTPUT_DIR/raw_2"},
+			},
+			edges: []graphEdge{{"fetch", "raw", "writes"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			graph := buildStepGraph(Manifest{Steps: tt.steps})
+			if !slices.Equal(graph.Edges, tt.edges) {
+				t.Errorf("got edges %v, want %v", graph.Edges, tt.edges)
+			}
+			var imported, uncertain []string
+			for _, r := range graph.Resources {
+				if r.Imported {
+					imported = append(imported, r.Name)
+				}
+			}
+			for _, s := range graph.Steps {
+				if !s.OutputsKnown {
+					uncertain = append(uncertain, s.Name)
+				}
+			}
+			if !slices.Equal(imported, tt.imported) {
+				t.Errorf("got imported resources %v, want %v", imported, tt.imported)
+			}
+			if !slices.Equal(uncertain, tt.uncertain) {
+				t.Errorf("got steps with unknown outputs %v, want %v", uncertain, tt.uncertain)
+			}
+		})
+	}
+}
+
+func TestWriteGraph(t *testing.T) {
+	count := int64(3)
+	graph := buildStepGraph(Manifest{Steps: []ManifestStep{
+		{Name: "fetch", Start: true, Script: "date > $OUTPUT_DIR/raw"},
+		{Name: `say "hi"`, Inputs: []string{"raw", "extra"}, Script: "cat $INPUT_FILE"},
+	}})
+	graph.Steps[1].Counts = &graphCounts{Version: 2, Tasks: 4, Done: 2, Failed: 1, Pending: 1}
+	graph.Resources[0].Count = &count
+
+	tests := []struct {
+		name  string
+		write func(*bytes.Buffer, stepGraph)
+		want  string
+	}{
+		{"dot", func(b *bytes.Buffer, g stepGraph) { writeDotGraph(b, g) }, `digraph grit {
+	rankdir=LR;
+	"step:fetch" [label="fetch", shape=box, style="bold"];
+	"step:say \"hi\"" [label="say \"hi\"\nv2: 2 done, 1 failed, 1 pending", shape=box, color=red];
+	"resource:raw" [label="raw\n3", shape=ellipse];
+	"resource:extra" [label="extra (imported)", shape=ellipse, style=dashed];
+	"step:fetch" -> "resource:raw";
+	"resource:raw" -> "step:say \"hi\"";
+	"resource:extra" -> "step:say \"hi\"";
+}
+`},
+		{"mermaid", func(b *bytes.Buffer, g stepGraph) { writeMermaidGraph(b, g) }, `flowchart LR
+    s0["fetch"]:::start
+    s1["say #quot;hi#quot;<br/>v2: 2 done, 1 failed, 1 pending"]:::failed
+    r0(["raw<br/>3"])
+    r1(["extra (imported)"])
+    s0 --> r0
+    r0 --> s1
+    r1 --> s1
+    classDef start stroke-width:3px
+    classDef failed stroke:#d33,stroke-width:3px
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			tt.write(&out, graph)
+			if out.String() != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var hooksLogger = NewLogger("HOOK")
+
+// Hooks are the [hooks] of a manifest. Each one is a shell command, or an
+// http:// or https:// URL the event is POSTed to as JSON. Empty hooks are skipped.
+type Hooks struct {
+	OnFailure     string `toml:"on_failure"`      // a run finished with an error or failed tasks
+	OnSuccess     string `toml:"on_success"`      // a run finished and none of its tasks failed
+	OnTaskFailure string `toml:"on_task_failure"` // a task failed (cancelled tasks are not failures)
+}
+
+// hookTimeout bounds how long a hook command or request may take
+const hookTimeout = 30 * time.Second
+
+// maxConcurrentHooks bounds how many hooks run at once; the rest wait their turn
+const maxConcurrentHooks = 4
+
+// maxTaskFailureHooks is how many task failures of a run fire on_task_failure.
+// Later ones are only counted, in the run's own event, so that a step failing
+// for every input does not flood the hook.
+const maxTaskFailureHooks = 10
+
+var hookSlots = make(chan struct{}, maxConcurrentHooks)
+
+// taskFailureHooks counts the task failures of each run that reached taskFailed
+var taskFailureHooks = struct {
+	sync.Mutex
+	byRun map[int64]int64
+}{byRun: make(map[int64]int64)}
+
+// Hook events
+const (
+	HookRunSucceeded = "run_succeeded"
+	HookRunFailed    = "run_failed"
+	HookTaskFailed   = "task_failed"
+)
+
+// HookEvent is the JSON a hook receives: on stdin for commands, as the request
+// body for URLs. Text is a one-line summary, so Slack-compatible incoming
+// webhooks can take the payload as it is.
+type HookEvent struct {
+	Event string       `json:"event"`
+	Text  string       `json:"text"`
+	Run   *apiRun      `json:"run,omitempty"`
+	Task  *hookTask    `json:"task,omitempty"`
+	Steps []apiRunStep `json:"steps,omitempty"` // tasks of the run by step, for run events
+
+	// Task failures of the run that did not fire on_task_failure, for run events
+	SuppressedTaskFailures int64 `json:"suppressed_task_failures,omitempty"`
+}
+
+type hookTask struct {
+	ID          int64  `json:"id"`
+	Step        string `json:"step"`
+	StepVersion int    `json:"step_version"`
+	Error       string `json:"error"`
+	Host        string `json:"host,omitempty"`
+	ExitCode    *int   `json:"exit_code,omitempty"`
+}
+
+// pendingHooks are the hooks still running; waitForHooks waits for them
+var pendingHooks sync.WaitGroup
+
+// waitForHooks waits for hooks fired so far to finish, so they are not cut
+// short when grit exits
+func waitForHooks() {
+	pendingHooks.Wait()
+}
+
+// runFinished fires on_success or on_failure for a run FinishRun has recorded
+func (h Hooks) runFinished(database Database, runID int64) {
+	taskFailureHooks.Lock()
+	suppressed := max(taskFailureHooks.byRun[runID]-maxTaskFailureHooks, 0)
+	delete(taskFailureHooks.byRun, runID)
+	taskFailureHooks.Unlock()
+
+	if h.OnSuccess == "" && h.OnFailure == "" {
+		return
+	}
+	run, err := database.GetRun(runID)
+	if err != nil || run == nil {
+		hooksLogger.Error("Failed to get run for hooks", "run_id", runID, "error", err)
+		return
+	}
+	steps, err := database.ListRunSteps(runID)
+	if err != nil {
+		hooksLogger.Error("Failed to count tasks of run for hooks", "run_id", runID, "error", err)
+	}
+
+	described := describeRun(*run)
+	event := HookEvent{Run: &described, SuppressedTaskFailures: suppressed}
+	for _, st := range steps {
+		event.Steps = append(event.Steps, apiRunStep{Step: st.StepName, Version: st.StepVersion, Tasks: st.Tasks, Failed: st.Failed, Cancelled: st.Cancelled})
+	}
+
+	hook := h.OnSuccess
+	event.Event = HookRunSucceeded
+	event.Text = fmt.Sprintf("grit run %d succeeded on %s: %d tasks in %s", run.ID, run.Host, run.TasksExecuted, runDuration(*run))
+	if run.Outcome == RunFailed {
+		hook = h.OnFailure
+		event.Event = HookRunFailed
+		if run.Error != nil {
+			event.Text = fmt.Sprintf("grit run %d failed on %s: %s", run.ID, run.Host, *run.Error)
+		} else {
+			event.Text = fmt.Sprintf("grit run %d failed on %s: %d of %d tasks failed", run.ID, run.Host, run.TasksFailed, run.TasksExecuted)
+		}
+	}
+	fireHook(hook, event)
+}
+
+// taskFailed fires on_task_failure for a task whose failure has been recorded
+func (h Hooks) taskFailed(database Database, runID *int64, taskID int64, step Step, errorMsg string) {
+	if h.OnTaskFailure == "" || errorMsg == ErrTaskCancelled {
+		return
+	}
+	var run int64
+	if runID != nil {
+		run = *runID
+	}
+	taskFailureHooks.Lock()
+	taskFailureHooks.byRun[run]++
+	failures := taskFailureHooks.byRun[run]
+	taskFailureHooks.Unlock()
+	if failures > maxTaskFailureHooks {
+		if failures == maxTaskFailureHooks+1 {
+			hooksLogger.Warn("Too many failed tasks, further ones only count in the run's hook", "run_id", run, "limit", maxTaskFailureHooks)
+		}
+		return
+	}
+
+	task := &hookTask{ID: taskID, Step: step.Name, StepVersion: step.Version, Error: errorMsg}
+	if t, err := database.GetTask(taskID); err == nil && t != nil {
+		task.Host = t.Host
+		if t.Usage != nil {
+			task.ExitCode = t.Usage.ExitCode
+		}
+	}
+	event := HookEvent{
+		Event: HookTaskFailed,
+		Text:  fmt.Sprintf("grit task %d (step %s) failed: %s", taskID, step.Name, errorMsg),
+		Task:  task,
+	}
+	if task.Host != "" {
+		event.Text = fmt.Sprintf("grit task %d (step %s) failed on %s: %s", taskID, step.Name, task.Host, errorMsg)
+	}
+	if runID != nil {
+		if run, err := database.GetRun(*runID); err == nil && run != nil {
+			described := describeRun(*run)
+			event.Run = &described
+		}
+	}
+	fireHook(h.OnTaskFailure, event)
+}
+
+// fireHook runs hook for event in the background. Failures are logged and
+// never affect the run.
+func fireHook(hook string, event HookEvent) {
+	if hook == "" {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		hooksLogger.Error("Failed to encode hook event", "event", event.Event, "error", err)
+		return
+	}
+
+	pendingHooks.Add(1)
+	go func() {
+		defer pendingHooks.Done()
+		hookSlots <- struct{}{}
+		defer func() { <-hookSlots }()
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		defer cancel()
+
+		var err error
+		if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+			err = postHook(ctx, hook, payload)
+		} else {
+			err = runHookCommand(ctx, hook, event, payload)
+		}
+		if err != nil {
+			hooksLogger.Warn("Hook failed", "event", event.Event, "hook", hook, "error", err)
+			return
+		}
+		hooksLogger.Debug("Hook ran", "event", event.Event, "hook", hook)
+	}()
+}
+
+func postHook(ctx context.Context, url string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+	return nil
+}
+
+// runHookCommand runs a hook with the event as JSON on stdin and its main
+// fields in GRIT_* environment variables
+func runHookCommand(ctx context.Context, command string, event HookEvent, payload []byte) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "GRIT_EVENT="+event.Event, "GRIT_TEXT="+event.Text)
+	if event.Run != nil {
+		cmd.Env = append(cmd.Env, "GRIT_RUN_ID="+strconv.FormatInt(event.Run.ID, 10), "GRIT_RUN_OUTCOME="+event.Run.Outcome)
+		if event.Run.Error != nil {
+			cmd.Env = append(cmd.Env, "GRIT_ERROR="+*event.Run.Error)
+		}
+	}
+	if event.Task != nil {
+		cmd.Env = append(cmd.Env, "GRIT_TASK_ID="+strconv.FormatInt(event.Task.ID, 10), "GRIT_STEP="+event.Task.Step, "GRIT_ERROR="+event.Task.Error)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		hooksLogger.Debug("Hook output", "event", event.Event, "output", strings.TrimSpace(string(output)))
+	}
+	if err != nil && len(output) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookReceiver is a local stand-in for a webhook endpoint: it records the
+// events posted to it and how many requests it was handling at once
+type hookReceiver struct {
+	mu      sync.Mutex
+	events  []HookEvent
+	active  int
+	highest int
+}
+
+func (h *hookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.active++
+	h.highest = max(h.highest, h.active)
+	h.mu.Unlock()
+
+	var event HookEvent
+	err := json.NewDecoder(r.Body).Decode(&event)
+	time.Sleep(20 * time.Millisecond) // a slow endpoint, so concurrent hooks overlap
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.active--
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.events = append(h.events, event)
+}
+
+func TestTaskFailureHooksAreLimited(t *testing.T) {
+	receiver := &hookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	database, err := NewDatabase(filepath.Join(t.TempDir(), "db"), DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	runID, err := database.StartRun(nil, nil, "host", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hooks := Hooks{OnTaskFailure: server.URL, OnSuccess: server.URL, OnFailure: server.URL}
+	const failures = 3 * maxTaskFailureHooks
+	for i := range int64(failures) {
+		hooks.taskFailed(database, &runID, i+1, Step{Name: "process", Version: 1}, "exit status 1")
+	}
+	hooks.taskFailed(database, &runID, failures+1, Step{Name: "process", Version: 1}, ErrTaskCancelled)
+	waitForHooks()
+
+	receiver.mu.Lock()
+	taskEvents := len(receiver.events)
+	highest := receiver.highest
+	receiver.mu.Unlock()
+	if taskEvents != maxTaskFailureHooks {
+		t.Errorf("got %d task_failed events, want %d", taskEvents, maxTaskFailureHooks)
+	}
+	if highest > maxConcurrentHooks {
+		t.Errorf("%d hooks ran at once, want at most %d", highest, maxConcurrentHooks)
+	}
+
+	// The run's event counts the failures that did not fire the hook
+	if err := database.FinishRun(runID, nil); err != nil {
+		t.Fatal(err)
+	}
+	hooks.runFinished(database, runID)
+	waitForHooks()
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.events) != taskEvents+1 {
+		t.Fatalf("got %d events after the run finished, want %d", len(receiver.events), taskEvents+1)
+	}
+	last := receiver.events[len(receiver.events)-1]
+	if last.Run == nil || last.Run.ID != runID || last.SuppressedTaskFailures != failures-maxTaskFailureHooks {
+		t.Errorf("run event %+v, want run %d with %d suppressed task failures", last, runID, failures-maxTaskFailureHooks)
+	}
+
+	// Counting starts over for the next run
+	taskFailureHooks.Lock()
+	_, counted := taskFailureHooks.byRun[runID]
+	taskFailureHooks.Unlock()
+	if counted {
+		t.Error("task failures of a finished run are still counted")
+	}
+}
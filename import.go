@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var importLogger = NewLogger("IMPORT")
+
+// importCommand stores external files as resources so downstream steps consume
+// them on the next run, without wrapping the data in a seed script.
+func importCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	addLogFlags(flags)
+	dbFlags := addDatabaseFlags(flags)
+	name := flags.String("name", "", "resource name to import the files as (required)")
+	recordSource := flags.Bool("source", false, "record each file's absolute path as the resource source")
+	compress := flags.String("compress", "", "object compression: auto, zstd or none (defaults to auto)")
+	commandUsage(flags, "import --name NAME [--source] [--compress MODE] FILE|DIR|- ...")
+	paths := parseArgs(flags, args)
+
+	if *name == "" || len(paths) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := checkResourceName(*name); err != nil {
+		fatal("Invalid resource name", "name", *name, "error", err)
+	}
+	mode, err := ParseCompression(*compress)
+	if err != nil {
+		fatal("Invalid compression", "error", err)
+	}
+
+	database := dbFlags.open(DatabaseOptions{})
+	defer database.Close()
+
+	before, err := database.CountResources()
+	if err != nil {
+		fatal("Failed to count resources", "error", err)
+	}
+
+	imported := 0
+	for _, path := range paths {
+		if path == "-" {
+			source := ""
+			if *recordSource {
+				source = "stdin"
+			}
+			if _, _, err := database.ImportResource(*name, os.Stdin, source, mode); err != nil {
+				fatal("Failed to import stdin", "resource", *name, "error", err)
+			}
+			imported++
+			continue
+		}
+
+		err := walkFiles(path, func(file string) error {
+			if err := importFile(database, *name, file, *recordSource, mode); err != nil {
+				return err
+			}
+			imported++
+			return nil
+		})
+		if err != nil {
+			fatal("Failed to import", "resource", *name, "path", path, "error", err)
+		}
+	}
+
+	after, err := database.CountResources()
+	if err != nil {
+		fatal("Failed to count resources", "error", err)
+	}
+
+	importLogger.Info("Imported files", "resource", *name, "count", imported, "new", after-before, "existing", int64(imported)-(after-before))
+}
+
+// importFile stores one file as a resource named name
+func importFile(database Database, name string, path string, recordSource bool, mode Compression) error {
+	source := ""
+	if recordSource {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		source = abs
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, hash, err := database.ImportResource(name, file, source, mode)
+	if err != nil {
+		return err
+	}
+	importLogger.Debug("Imported file", "resource", name, "path", path, "hash", hash)
+	return nil
+}
+
+// walkFiles calls fn for every regular file under root (or root itself if it is a
+// file). Symlinks to files are followed; symlinked directories are not descended into.
+func walkFiles(root string, fn func(path string) error) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			if !info.IsDir() {
+				importLogger.Warn("Skipping file, not a regular file", "path", path)
+			}
+			return nil
+		}
+		return fn(path)
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCheckResourceName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"raw-data", true},
+		{"model.bin", true},
+		{"..data", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../raw", false},
+		{"raw/data", false},
+		{"raw_data", false},
+		{"raw\x00", false},
+	}
+	for _, tt := range tests {
+		if err := checkResourceName(tt.name); (err == nil) != tt.ok {
+			t.Errorf("checkResourceName(%q) = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestWalkFiles(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	for _, path := range []string{
+		filepath.Join(root, "a"),
+		filepath.Join(root, "sub", "b"),
+		filepath.Join(root, "sub", "deeper", "c"),
+		filepath.Join(outside, "skipped"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Symlinked files are followed, symlinked directories are not descended into
+	if err := os.Symlink(filepath.Join(root, "a"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "linked-dir")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		root string
+		want []string
+	}{
+		{root, []string{"a", "link", "sub/b", "sub/deeper/c"}},
+		{filepath.Join(root, "sub"), []string{"sub/b", "sub/deeper/c"}},
+		{filepath.Join(root, "a"), []string{"a"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		err := walkFiles(tt.root, func(path string) error {
+			rel, err := filepath.Rel(root, path)
+			got = append(got, filepath.ToSlash(rel))
+			return err
+		})
+		if err != nil {
+			t.Fatalf("walkFiles(%s): %v", tt.root, err)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("walkFiles(%s) = %v, want %v", tt.root, got, tt.want)
+		}
+	}
+
+	if err := walkFiles(filepath.Join(root, "missing"), func(string) error { return nil }); err == nil {
+		t.Error("walking a missing path: got no error")
+	}
+}
+
+func TestImportFile(t *testing.T) {
+	database, err := NewDatabase(filepath.Join(t.TempDir(), "db"), DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"one": "same", "two": "same", "three": "other"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		file          string
+		recordSource  bool
+		wantResources int64
+	}{
+		{"one", true, 1},
+		// Same content under the same name is the same resource, and keeps its first source
+		{"two", true, 1},
+		{"three", false, 2},
+	}
+	for _, tt := range tests {
+		if err := importFile(database, "raw-data", filepath.Join(dir, tt.file), tt.recordSource, CompressAuto); err != nil {
+			t.Fatalf("importing %s: %v", tt.file, err)
+		}
+		if n, err := database.CountResources(); err != nil || n != tt.wantResources {
+			t.Errorf("after importing %s: got %d resources, %v, want %d", tt.file, n, err, tt.wantResources)
+		}
+	}
+
+	sources := map[string]string{}
+	rows, err := database.db.Query("SELECT object_hash, COALESCE(source, '') FROM resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash, source string
+		if err := rows.Scan(&hash, &source); err != nil {
+			t.Fatal(err)
+		}
+		data, err := database.GetObject(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[string(data)] = source
+	}
+	want := map[string]string{"same": filepath.Join(dir, "one"), "other": ""}
+	if len(sources) != len(want) || sources["same"] != want["same"] || sources["other"] != want["other"] {
+		t.Errorf("got sources %v, want %v", sources, want)
+	}
+}
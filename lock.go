@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var lockLogger = NewLogger("LOCK")
+
+// ErrDatabaseLocked is returned when another grit process holds the run lock
+var ErrDatabaseLocked = errors.New("database is locked")
+
+// LockOwner is written into the lock file so a blocked process can report who holds it
+type LockOwner struct {
+	PID       int       `json:"pid"`
+	Host      string    `json:"host"`
+	StartedAt time.Time `json:"started_at"`
+	Command   string    `json:"command"`
+}
+
+func (o LockOwner) String() string {
+	return fmt.Sprintf("pid %d on %s since %s (%s)", o.PID, o.Host, o.StartedAt.Format(time.RFC3339), o.Command)
+}
+
+// RunLock is an exclusive lock on a repository held for the lifetime of a
+// writing process. It is an flock on <repo>/run.lock, so the kernel releases
+// it when the owner exits, however it exits.
+type RunLock struct {
+	file *os.File
+	path string
+}
+
+// AcquireRunLock takes the run lock for repoPath without blocking
+func AcquireRunLock(repoPath string) (*RunLock, error) {
+	path := filepath.Join(repoPath, "run.lock")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, _ := readLockOwner(file)
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			if previous != nil {
+				return nil, fmt.Errorf("%w: %s is in use by %s", ErrDatabaseLocked, repoPath, previous)
+			}
+			return nil, fmt.Errorf("%w: %s is in use by another grit process", ErrDatabaseLocked, repoPath)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	// The lock was free, so any recorded owner died without cleaning up
+	if previous != nil {
+		lockLogger.Warn("Removing stale lock", "path", path, "owner", previous)
+	}
+
+	host, _ := os.Hostname()
+	owner := LockOwner{
+		PID:       os.Getpid(),
+		Host:      host,
+		StartedAt: time.Now(),
+		Command:   strings.Join(os.Args, " "),
+	}
+	if err := writeLockOwner(file, owner); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	lockLogger.Debug("Acquired run lock", "path", path)
+	return &RunLock{file: file, path: path}, nil
+}
+
+// Release clears the owner record and drops the lock
+func (l *RunLock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+
+	l.file.Truncate(0)
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	l.file = nil
+
+	lockLogger.Debug("Released run lock", "path", l.path)
+	return err
+}
+
+func readLockOwner(file *os.File) (*LockOwner, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+
+	var owner LockOwner
+	if err := json.Unmarshal(data, &owner); err != nil {
+		return nil, err
+	}
+	return &owner, nil
+}
+
+func writeLockOwner(file *os.File, owner LockOwner) error {
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(append(data, '\n'), 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
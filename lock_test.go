@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunLock(t *testing.T) {
+	repo := t.TempDir()
+	lock, err := AcquireRunLock(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flock locks belong to the open file, so a second open conflicts even in this process
+	_, err = AcquireRunLock(repo)
+	if !errors.Is(err, ErrDatabaseLocked) || !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+		t.Fatalf("second lock: got %v, want ErrDatabaseLocked naming the owner", err)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Errorf("releasing twice: %v", err)
+	}
+	lock, err = AcquireRunLock(repo)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	lock.Release()
+}
+
+func TestStaleRunLockIsTakenOver(t *testing.T) {
+	repo := t.TempDir()
+	// An owner record without an flock is what a killed process leaves behind
+	stale := `{"pid":999999,"host":"gone","started_at":"2020-01-01T00:00:00Z","command":"grit -run"}`
+	if err := os.WriteFile(filepath.Join(repo, "run.lock"), []byte(stale), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := AcquireRunLock(repo)
+	if err != nil {
+		t.Fatalf("stale lock: %v", err)
+	}
+	defer lock.Release()
+
+	file, err := os.Open(filepath.Join(repo, "run.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if owner, err := readLockOwner(file); err != nil || owner.PID != os.Getpid() {
+		t.Errorf("lock owner %+v, %v, want this process", owner, err)
+	}
+}
+
+func TestDatabaseHoldsRunLock(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "db")
+	database, err := NewDatabase(repo, DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if other, err := NewDatabase(repo, DatabaseOptions{}); !errors.Is(err, ErrDatabaseLocked) {
+		if err == nil {
+			other.Close()
+		}
+		t.Fatalf("second writer: got %v, want ErrDatabaseLocked", err)
+	}
+	reader, err := NewDatabase(repo, DatabaseOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("reader alongside the writer: %v", err)
+	}
+	reader.Close()
+
+	if err := database.Close(); err != nil {
+		t.Fatal(err)
+	}
+	database, err = NewDatabase(repo, DatabaseOptions{})
+	if err != nil {
+		t.Fatalf("writer after the first closed: %v", err)
+	}
+	database.Close()
+}
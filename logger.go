@@ -1,45 +1,222 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// MyLogger is a slog.Logger tagged with the component it logs for (RUN,
+// PIPELINE, DB, ...). Messages are constant and details go in key/value
+// fields, using the same keys everywhere: step, task_id, resource, hash,
+// path, error.
 type MyLogger struct {
-	logger *log.Logger
-	prefix string
+	*slog.Logger
 }
 
-func NewLogger(prefix string) MyLogger {
-	l := log.New(os.Stderr, fmt.Sprintf("[%s] ", prefix), log.Ldate|log.Lmicroseconds)
+func NewLogger(component string) MyLogger {
+	return MyLogger{slog.New(&componentHandler{ops: []handlerOp{{attrs: []slog.Attr{slog.String("component", component)}}}})}
+}
+
+// logLevel is shared by all loggers and set by -verbose and -quiet. VERBOSE=1
+// in the environment still turns on debug messages, as it did before the flag.
+var logLevel = new(slog.LevelVar)
+
+// logHandler formats every log record, as text (the default) or JSON
+var logHandler slog.Handler = newTextHandler(os.Stderr)
+
+var logVerbose, logQuiet bool
+
+func init() {
+	logVerbose = os.Getenv("VERBOSE") != ""
+	updateLogLevel()
+}
+
+// addLogFlags adds -verbose, -quiet and -log-format to fs. They take effect as
+// they are parsed, so every command that calls this shares them.
+func addLogFlags(fs *flag.FlagSet) {
+	fs.BoolFunc("verbose", "also log debug messages (task details, script output, database operations)", func(value string) error {
+		return setLogBool(&logVerbose, value)
+	})
+	fs.BoolFunc("quiet", "only log errors (overrides -verbose)", func(value string) error {
+		return setLogBool(&logQuiet, value)
+	})
+	fs.Func("log-format", "log format: text or json (default text)", setLogFormat)
+}
+
+func setLogBool(flag *bool, value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*flag = b
+	updateLogLevel()
+	return nil
+}
+
+func updateLogLevel() {
+	switch {
+	case logQuiet:
+		logLevel.Set(slog.LevelError)
+	case logVerbose:
+		logLevel.Set(slog.LevelDebug)
+	default:
+		logLevel.Set(slog.LevelInfo)
+	}
+}
+
+func setLogFormat(format string) error {
+	switch format {
+	case "text":
+		logHandler = newTextHandler(os.Stderr)
+	case "json":
+		logHandler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
+	default:
+		return fmt.Errorf("unknown log format %q (expected text or json)", format)
+	}
+	return nil
+}
+
+// componentHandler defers to whichever logHandler is current when a record is
+// logged. Loggers are package variables created before flags are parsed, so
+// their attributes and groups are replayed onto the chosen handler.
+type componentHandler struct {
+	ops []handlerOp
+}
+
+type handlerOp struct {
+	attrs []slog.Attr
+	group string
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	handler := logHandler
+	for _, op := range h.ops {
+		if op.group != "" {
+			handler = handler.WithGroup(op.group)
+		} else {
+			handler = handler.WithAttrs(op.attrs)
+		}
+	}
+	return handler.Handle(ctx, r)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &componentHandler{append(h.ops[:len(h.ops):len(h.ops)], handlerOp{attrs: attrs})}
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &componentHandler{append(h.ops[:len(h.ops):len(h.ops)], handlerOp{group: name})}
+}
+
+// textHandler writes the human-readable format:
+//
+//	[PIPELINE] 2025/01/02 15:04:05.000000 Task failed task_id=12 step=parse error="exit status 1"
+//
+// Warnings and errors carry their level before the message.
+type textHandler struct {
+	mu        *sync.Mutex
+	w         io.Writer
+	component string
+	attrs     string // preformatted " key=value" pairs
+	prefix    string // group prefix for keys, "group."
+}
 
-	return MyLogger{l, prefix}
+func newTextHandler(w io.Writer) *textHandler {
+	return &textHandler{mu: new(sync.Mutex), w: w}
 }
 
-func (m MyLogger) Printf(format string, v ...any) {
-	m.logger.Printf(format, v...)
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
 }
 
-func (m MyLogger) Println(v ...any) {
-	m.logger.Println(v...)
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	if h.component != "" {
+		buf.WriteString("[" + h.component + "] ")
+	}
+	buf.WriteString(r.Time.Format("2006/01/02 15:04:05.000000 "))
+	if r.Level >= slog.LevelWarn {
+		buf.WriteString(r.Level.String() + " ")
+	}
+	buf.WriteString(r.Message)
+	buf.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		writeTextAttr(&buf, h.prefix, a)
+		return true
+	})
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
 }
 
-func (m MyLogger) Verbosef(format string, v ...any) {
-	if len(os.Getenv("VERBOSE")) >= 1 {
-		m.Printf(format, v...)
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	var buf bytes.Buffer
+	for _, a := range attrs {
+		if a.Key == "component" && h.prefix == "" {
+			h2.component = a.Value.String()
+			continue
+		}
+		writeTextAttr(&buf, h.prefix, a)
 	}
+	h2.attrs += buf.String()
+	return &h2
 }
 
-func (m MyLogger) Verboseln(v ...any) {
-	if len(os.Getenv("VERBOSE")) >= 1 {
-		m.logger.Println(v...)
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
 	}
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
 }
 
-func (m MyLogger) Context(c string) MyLogger {
-	p := fmt.Sprintf("[%s:%s] ", m.prefix, c)
-	l := log.New(os.Stderr, p, log.Ldate|log.Lmicroseconds|log.Lshortfile)
+func writeTextAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			writeTextAttr(buf, prefix, ga)
+		}
+		return
+	}
 
-	return MyLogger{l, p}
+	var value string
+	switch a.Value.Kind() {
+	case slog.KindTime:
+		value = a.Value.Time().Format(time.RFC3339)
+	case slog.KindDuration:
+		value = a.Value.Duration().String()
+	default:
+		value = a.Value.String()
+	}
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") || !strconv.CanBackquote(value) {
+		value = strconv.Quote(value)
+	}
+	buf.WriteString(" " + prefix + a.Key + "=" + value)
 }
@@ -6,8 +6,6 @@ import (
 	"log"
 	"os"
 	"runtime"
-
-	"github.com/pelletier/go-toml"
 )
 
 const LOG_FLAGS = log.Lshortfile | log.Lmicroseconds | log.Ldate
@@ -26,44 +24,67 @@ func (s *stringSlice) Set(value string) error {
 var mainLogger = NewLogger("MAIN")
 
 func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
 	manifest_path := flag.String("manifest", "", "manifest path")
 	db_path := flag.String("db", "./db", "database path")
+	objectStore := flag.String("object-store", "", "object store: badger, dir, dir:PATH or s3://BUCKET/PREFIX (overrides the manifest, defaults to badger)")
 	parallel := flag.Int("parallel", runtime.NumCPU(), "number of processes to run in parallel")
 	exportName := flag.String("export", "", "list resource hashes by name")
 	exportHash := flag.String("export-hash", "", "export file content by hash")
 	runPipeline := flag.Bool("run", false, "run the pipeline")
 	startStep := flag.String("start", "", "step to start from (optional, defaults to start step in manifest)")
+	traceSpec := flag.String("trace", "", "export trace spans of runs, steps and tasks: otlp, http://HOST:PORT (OTLP collector) or file:PATH (JSON)")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics at /metrics on this address: HOST:PORT or unix:PATH")
 
 	var enabledSteps stringSlice
 	flag.Var(&enabledSteps, "step", "steps to run")
+	vars := addVarFlag(flag.CommandLine)
+	addLogFlags(flag.CommandLine)
 
 	flag.Parse()
 
-	mainLogger.Printf("Loading manifest from: %s\n", *manifest_path)
-
-	manifest_toml, err := os.ReadFile(*manifest_path)
-	if err != nil {
-		panic(err)
-	}
+	mainLogger.Info("Loading manifest", "path", *manifest_path)
 
-	var manifest Manifest
-	err = toml.Unmarshal(manifest_toml, &manifest)
+	manifest, err := LoadManifest(*manifest_path, vars)
 	if err != nil {
-		panic(err)
+		fatal("Failed to load manifest", "path", *manifest_path, "error", err)
 	}
-	mainLogger.Printf("Loaded %d steps from manifest\n", len(manifest.Steps))
+	mainLogger.Info("Loaded manifest", "steps", len(manifest.Steps))
 
 	// Check disk space before opening database
 	checkDiskSpace(*db_path)
 
-	mainLogger.Printf("Initializing database at: %s\n", *db_path)
-	database, err := NewDatabase(*db_path)
+	mainLogger.Info("Initializing database", "path", *db_path)
+	storeSpec := *objectStore
+	if storeSpec == "" {
+		storeSpec = manifest.ObjectStore
+	}
+	// Exports only read, so they can run alongside a pipeline holding the run lock
+	database, err := NewDatabase(*db_path, DatabaseOptions{ObjectStore: storeSpec, ReadOnly: !*runPipeline})
 	if err != nil {
 		panic(err)
 	}
+	defer database.Close()
+
+	if *runPipeline && *traceSpec != "" {
+		shutdown, err := setupTracing(*traceSpec)
+		if err != nil {
+			panic(err)
+		}
+		defer shutdown()
+	}
+
+	if *runPipeline && *metricsAddr != "" {
+		if err := serveMetrics(*metricsAddr, &database); err != nil {
+			panic(err)
+		}
+	}
 
 	if *runPipeline {
-		run(manifest, database, *parallel, *startStep, enabledSteps)
+		run(*manifest_path, vars, manifest, database, *parallel, *startStep, enabledSteps)
 	} else if exportName != nil && *exportName != "" {
 		exportResourcesByName(database, *exportName)
 	} else if exportHash != nil && *exportHash != "" {
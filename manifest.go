@@ -1,13 +1,94 @@
 package main
 
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
 type Manifest struct {
-	Steps []ManifestStep `toml:"step"`
+	ObjectStore string         `toml:"object_store"`
+	Hooks       Hooks          `toml:"hooks"`
+	Include     []string       `toml:"include"`   // globs of manifest files, relative to this one, whose steps are added
+	Namespace   string         `toml:"namespace"` // in an included file, the prefix of its step names (default: the file name)
+	Vars        map[string]any `toml:"vars"`      // substituted for {{name}} in settings, see interpolate
+	Steps       []ManifestStep `toml:"step"`
+
+	Included []string `toml:"-"` // the files included, in order
 }
 
 type ManifestStep struct {
-	Name     string   `toml:"name"`
-	Script   string   `toml:"script"`
-	Start    bool     `toml:"start"`
-	Parallel *int     `toml:"parallel"`
-	Inputs   []string `toml:"inputs"`
+	Name           string   `toml:"name"`
+	Script         string   `toml:"script"`
+	ScriptTemplate string   `toml:"-"` // script with {{env.NAME}} left as written, see interpolateVars
+	Start          bool     `toml:"start"`
+	Parallel       *int     `toml:"parallel"`
+	Inputs         []string `toml:"inputs"`
+	Compress       string   `toml:"compress"`
+
+	// Declared outputs, see OutputRules
+	Outputs           []string `toml:"outputs"`
+	RequiredOutputs   []string `toml:"required_outputs"`
+	UndeclaredOutputs string   `toml:"undeclared_outputs"`
+
+	// How the script is run, see ScriptRunner
+	Shell       any               `toml:"shell"`
+	Interpreter any               `toml:"interpreter"`
+	Env         map[string]string `toml:"env"`
+	EnvTemplate map[string]string `toml:"-"` // env with {{env.NAME}} left as written
+	ClearEnv    bool              `toml:"clear_env"`
+	Workdir     string            `toml:"workdir"`
+	WorkdirBase string            `toml:"-"` // directory of the file the step is in
+
+	// Parameters to run the step with every combination of, see expandMatrix
+	Matrix     map[string]any `toml:"matrix"`
+	MatrixStep string         `toml:"-"` // in a step expanded from a matrix, the name of the step with the matrix
+	Params     []MatrixParam  `toml:"-"` // and its parameters
+}
+
+// LoadManifest reads the manifest at path, with vars overriding its [vars], and
+// checks it with CheckManifest. Warnings are logged; errors are logged too and
+// fail the load.
+func LoadManifest(path string, vars map[string]string) (Manifest, error) {
+	manifest, problems, err := CheckManifest(path, vars)
+	if err != nil {
+		return manifest, err
+	}
+	var errorCount int
+	for _, p := range problems {
+		if p.Warning {
+			manifestLogger.Warn("Manifest problem", "path", p.File, "line", p.Line, "col", p.Col, "problem", p.Message)
+		} else {
+			manifestLogger.Error("Manifest problem", "path", p.File, "line", p.Line, "col", p.Col, "problem", p.Message)
+			errorCount++
+		}
+	}
+	if errorCount > 0 {
+		return manifest, fmt.Errorf("%d errors in manifest (see grit validate %s)", errorCount, path)
+	}
+	return manifest, nil
+}
+
+// readManifestSource returns the manifest file at path followed by each file it
+// includes, as a run records it
+func readManifestSource(path string, vars map[string]string) ([]byte, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest, _, err := CheckManifest(path, vars)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range manifest.Included {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if len(source) > 0 && !bytes.HasSuffix(source, []byte("\n")) {
+			source = append(source, '\n')
+		}
+		source = fmt.Appendf(source, "\n# --- included: %s ---\n%s", file, data)
+	}
+	return source, nil
 }
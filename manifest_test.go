@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeManifests writes files, by path relative to a new directory, and returns
+// the directory
+func writeManifests(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestIncludes(t *testing.T) {
+	const main = `
+include = ["common/*.toml"]
+
+[[step]]
+name = "fetch"
+start = true
+script = "date > $OUTPUT_DIR/raw"
+`
+	tests := []struct {
+		name   string
+		files  map[string]string
+		steps  []string
+		errors []string // start of each error, in order
+	}{
+		{
+			name: "namespaced by file name",
+			files: map[string]string{
+				"common/normalize.toml": "[[step]]\nname = \"clean\"\ninputs = [\"raw\"]\nscript = \"true\"\n",
+				"common/stats.toml":     "[[step]]\nname = \"clean\"\ninputs = [\"raw\"]\nscript = \"true\"\n",
+			},
+			steps: []string{"fetch", "normalize.clean", "stats.clean"},
+		},
+		{
+			name: "declared namespace and nested includes",
+			files: map[string]string{
+				"common/lib.toml":     "namespace = \"std\"\ninclude = [\"inner/*.toml\"]\n\n[[step]]\nname = \"clean\"\ninputs = [\"raw\"]\nscript = \"true\"\n",
+				"common/inner/x.toml": "[[step]]\nname = \"deep\"\ninputs = [\"raw\"]\nscript = \"true\"\n",
+			},
+			steps: []string{"fetch", "std.clean", "std.x.deep"},
+		},
+		{
+			name:   "matches nothing",
+			files:  map[string]string{"common/README": ""},
+			steps:  []string{"fetch"},
+			errors: []string{`include "common/*.toml" matches no files`},
+		},
+		{
+			name: "included twice",
+			files: map[string]string{
+				"common/a.toml": "include = [\"b.toml\"]\n[[step]]\nname = \"s\"\ninputs = [\"raw\"]\nscript = \"true\"\n",
+				"common/b.toml": "include = [\"a.toml\"]\n[[step]]\nname = \"s\"\ninputs = [\"raw\"]\nscript = \"true\"\n",
+			},
+			// a includes b before the glob gets to it, and b's include of a goes
+			// back up; problems are in the order of the files they are in
+			steps:  []string{"fetch", "a.s", "a.b.s"},
+			errors: []string{"b.toml is included more than once", "a.toml is included more than once"},
+		},
+		{
+			name: "settings only the main manifest may have",
+			files: map[string]string{
+				"common/lib.toml": "object_store = \"dir\"\n\n[vars]\nn = 1\n\n[hooks]\non_failure = \"true\"\n\n[[step]]\nname = \"s\"\ninputs = [\"raw\"]\nscript = \"true\"\n",
+			},
+			steps: []string{"fetch", "lib.s"},
+			errors: []string{
+				"object_store is only allowed in the main manifest",
+				"vars are only allowed in the main manifest",
+				"hooks are only allowed in the main manifest",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{"grit.toml": main}
+			for name, content := range tt.files {
+				files[name] = content
+			}
+			dir := writeManifests(t, files)
+			manifest, problems, err := CheckManifest(filepath.Join(dir, "grit.toml"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var steps, errors []string
+			for _, step := range manifest.Steps {
+				steps = append(steps, step.Name)
+			}
+			for _, p := range problems {
+				if !p.Warning {
+					errors = append(errors, p.Message)
+				}
+			}
+			if !slices.Equal(steps, tt.steps) {
+				t.Errorf("got steps %v, want %v", steps, tt.steps)
+			}
+			if len(errors) != len(tt.errors) {
+				t.Fatalf("got errors %q, want %q", errors, tt.errors)
+			}
+			for i := range errors {
+				if !strings.Contains(errors[i], tt.errors[i]) {
+					t.Errorf("error %d: got %q, want %q", i, errors[i], tt.errors[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIncludedStepsResolveAgainstTheirFile(t *testing.T) {
+	dir := writeManifests(t, map[string]string{
+		"grit.toml":            "include = [\"lib/steps.toml\"]\n\n[[step]]\nname = \"fetch\"\nstart = true\nworkdir = \"data\"\nscript = \"date > $OUTPUT_DIR/raw\"\n",
+		"data/.keep":           "",
+		"lib/steps.toml":       "[[step]]\nname = \"clean\"\ninputs = [\"raw\"]\nworkdir = \"scripts\"\nscript = \"./clean.sh\"\n",
+		"lib/scripts/clean.sh": "",
+	})
+	manifest, err := LoadManifest(filepath.Join(dir, "grit.toml"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"fetch": dir, "steps.clean": filepath.Join(dir, "lib")}
+	for _, step := range manifest.Steps {
+		if step.WorkdirBase != want[step.Name] {
+			t.Errorf("step %s: got workdir base %s, want %s", step.Name, step.WorkdirBase, want[step.Name])
+		}
+	}
+	if !slices.Equal(manifest.Included, []string{filepath.Join(dir, "lib", "steps.toml")}) {
+		t.Errorf("got included files %v", manifest.Included)
+	}
+
+	source, err := readManifestSource(filepath.Join(dir, "grit.toml"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(source), "# --- included: "+filepath.Join(dir, "lib", "steps.toml")+" ---\n[[step]]") {
+		t.Errorf("recorded source does not hold the included file:\n%s", source)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// MatrixParam is one parameter of a step expanded from a matrix
+type MatrixParam struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// matrixParamName is what a matrix parameter can be called: it becomes part of
+// an environment variable name and of resource names, which cannot contain _
+var matrixParamName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+// expandMatrix replaces each step with a matrix by one step per combination of
+// its parameters, named like eval[model=a,seed=1]. The expanded steps share the
+// step's table, so their problems point at it.
+func (c *manifestChecker) expandMatrix() {
+	var steps []ManifestStep
+	var tables []manifestTable
+	for i, step := range c.manifest.Steps {
+		table := c.steps[i]
+		if len(step.Matrix) == 0 {
+			steps = append(steps, step)
+			tables = append(tables, table)
+			continue
+		}
+		combinations, ok := c.matrixCombinations(table, step)
+		if !ok {
+			steps = append(steps, step)
+			tables = append(tables, table)
+			continue
+		}
+		for _, params := range combinations {
+			expanded := step
+			expanded.Matrix = nil
+			expanded.MatrixStep = step.Name
+			expanded.Params = params
+			expanded.Name = step.Name + matrixSuffix(params)
+			steps = append(steps, expanded)
+			tables = append(tables, table)
+		}
+	}
+	c.manifest.Steps = steps
+	c.steps = tables
+}
+
+// matrixCombinations checks the matrix of step and returns every combination of
+// its parameters, with the parameters sorted by name and the last one varying fastest
+func (c *manifestChecker) matrixCombinations(table manifestTable, step ManifestStep) ([][]MatrixParam, bool) {
+	ok := true
+	if step.Start {
+		c.errorf(table, "matrix", "step %q: the start step cannot have a matrix", step.Name)
+		ok = false
+	}
+	names := slices.Sorted(maps.Keys(step.Matrix))
+	values := make([][]string, len(names))
+	for i, name := range names {
+		switch {
+		case !matrixParamName.MatchString(name):
+			c.errorf(table, "matrix", "step %q: invalid matrix parameter %q (use letters and digits)", step.Name, name)
+			ok = false
+		case name == "matrix":
+			c.errorf(table, "matrix", "step %q: matrix parameter %q is reserved for {{matrix}}", step.Name, name)
+			ok = false
+		case c.manifest.Vars[name] != nil:
+			c.errorf(table, "matrix", "step %q: matrix parameter %q has the name of a variable in [vars]", step.Name, name)
+			ok = false
+		}
+
+		list, isList := step.Matrix[name].([]any)
+		if !isList || len(list) == 0 {
+			c.errorf(table, "matrix", "step %q: matrix parameter %q must be a non-empty list", step.Name, name)
+			ok = false
+			continue
+		}
+		for _, value := range list {
+			switch value.(type) {
+			case string, int64, float64, bool:
+			default:
+				c.errorf(table, "matrix", "step %q: values of matrix parameter %q must be strings, numbers or booleans", step.Name, name)
+				ok = false
+				continue
+			}
+			s := fmt.Sprint(value)
+			switch {
+			case s == "" || strings.ContainsAny(s, "/_,=[] \t\n"):
+				c.errorf(table, "matrix", "step %q: invalid value %q of matrix parameter %q (values go into resource names and cannot be empty or contain /, _, ',', =, [, ] or spaces)", step.Name, s, name)
+				ok = false
+			case slices.Contains(values[i], s):
+				c.errorf(table, "matrix", "step %q: matrix parameter %q has the value %q twice", step.Name, name, s)
+				ok = false
+			}
+			values[i] = append(values[i], s)
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+
+	combinations := [][]MatrixParam{nil}
+	for i, name := range names {
+		var next [][]MatrixParam
+		for _, combination := range combinations {
+			for _, value := range values[i] {
+				next = append(next, append(slices.Clip(combination), MatrixParam{Name: name, Value: value}))
+			}
+		}
+		combinations = next
+	}
+	return combinations, true
+}
+
+// matrixSuffix is what the parameters add to the names of a step expanded from a
+// matrix and of the resources it writes: [model=a,seed=1]
+func matrixSuffix(params []MatrixParam) string {
+	if len(params) == 0 {
+		return ""
+	}
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.Name + "=" + p.Value
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+// matrixVars adds the parameters to the variables a step is interpolated with,
+// with {{matrix}} for their suffix
+func matrixVars(vars map[string]string, params []MatrixParam) map[string]string {
+	if len(params) == 0 {
+		return vars
+	}
+	vars = maps.Clone(vars)
+	for _, p := range params {
+		vars[p.Name] = p.Value
+	}
+	vars["matrix"] = matrixSuffix(params)
+	return vars
+}
+
+// matrixEnv returns the parameters as MATRIX_NAME=VALUE environment variables
+func matrixEnv(params []MatrixParam) []string {
+	env := make([]string, 0, len(params))
+	for _, p := range params {
+		env = append(env, "MATRIX_"+strings.ToUpper(p.Name)+"="+p.Value)
+	}
+	return env
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	const fetch = `
+[vars]
+data = "raw"
+
+[[step]]
+name = "fetch"
+start = true
+script = "date > $OUTPUT_DIR/raw"
+`
+	tests := []struct {
+		name    string
+		step    string
+		steps   []string // names after expansion
+		scripts []string // of the expanded steps
+		errors  []string
+	}{
+		{
+			name: "combinations",
+			step: `matrix = { seed = [1, 2], model = ["a", "b"] }
+script = "eval --model {{model}} --seed {{seed}} {{data}} > $OUTPUT_DIR/score{{matrix}}"`,
+			steps: []string{"fetch", "eval[model=a,seed=1]", "eval[model=a,seed=2]", "eval[model=b,seed=1]", "eval[model=b,seed=2]"},
+			scripts: []string{
+				"eval --model a --seed 1 raw > $OUTPUT_DIR/score[model=a,seed=1]",
+				"eval --model a --seed 2 raw > $OUTPUT_DIR/score[model=a,seed=2]",
+				"eval --model b --seed 1 raw > $OUTPUT_DIR/score[model=b,seed=1]",
+				"eval --model b --seed 2 raw > $OUTPUT_DIR/score[model=b,seed=2]",
+			},
+		},
+		{
+			name:   "start step",
+			step:   "start = true\nmatrix = { seed = [1] }\nscript = \"true\"",
+			steps:  []string{"fetch", "eval"},
+			errors: []string{"the start step cannot have a matrix", "is a second start step"},
+		},
+		{
+			name:   "invalid parameter names",
+			step:   "matrix = { model_size = [1], matrix = [1], data = [1] }\nscript = \"true\"",
+			steps:  []string{"fetch", "eval"},
+			errors: []string{`matrix parameter "data" has the name of a variable`, `matrix parameter "matrix" is reserved`, `invalid matrix parameter "model_size"`},
+		},
+		{
+			name:   "invalid values",
+			step:   "matrix = { a = 1, b = [], c = [\"x_y\"], d = [\"v\", \"v\"], e = [[1]] }\nscript = \"true\"",
+			steps:  []string{"fetch", "eval"},
+			errors: []string{`"a" must be a non-empty list`, `"b" must be a non-empty list`, `invalid value "x_y"`, `has the value "v" twice`, `values of matrix parameter "e" must be`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := fetch + "\n[[step]]\nname = \"eval\"\ninputs = [\"raw\"]\n" + tt.step + "\n"
+			path := filepath.Join(writeManifests(t, map[string]string{"grit.toml": manifest}), "grit.toml")
+			m, problems, err := CheckManifest(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names, scripts, errors []string
+			for _, step := range m.Steps {
+				names = append(names, step.Name)
+				if len(step.Params) > 0 {
+					scripts = append(scripts, step.Script)
+				}
+			}
+			for _, p := range problems {
+				if !p.Warning {
+					errors = append(errors, p.Message)
+				}
+			}
+			if !slices.Equal(names, tt.steps) {
+				t.Errorf("got steps %v, want %v", names, tt.steps)
+			}
+			if !slices.Equal(scripts, tt.scripts) {
+				t.Errorf("got scripts %q, want %q", scripts, tt.scripts)
+			}
+			if len(errors) != len(tt.errors) {
+				t.Fatalf("got errors %q, want %q", errors, tt.errors)
+			}
+			for i := range errors {
+				if !strings.Contains(errors[i], tt.errors[i]) {
+					t.Errorf("error %d: got %q, want %q", i, errors[i], tt.errors[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMatrixParams(t *testing.T) {
+	params := []MatrixParam{{"model", "a"}, {"seed", "1"}}
+	vars := map[string]string{"data": "raw"}
+
+	tests := []struct {
+		params []MatrixParam
+		suffix string
+		env    []string
+		vars   map[string]string
+	}{
+		{nil, "", []string{}, vars},
+		{params, "[model=a,seed=1]", []string{"MATRIX_MODEL=a", "MATRIX_SEED=1"},
+			map[string]string{"data": "raw", "model": "a", "seed": "1", "matrix": "[model=a,seed=1]"}},
+	}
+	for _, tt := range tests {
+		if got := matrixSuffix(tt.params); got != tt.suffix {
+			t.Errorf("matrixSuffix(%v) = %q, want %q", tt.params, got, tt.suffix)
+		}
+		if got := matrixEnv(tt.params); !slices.Equal(got, tt.env) {
+			t.Errorf("matrixEnv(%v) = %q, want %q", tt.params, got, tt.env)
+		}
+		if got := matrixVars(vars, tt.params); !maps.Equal(got, tt.vars) {
+			t.Errorf("matrixVars(%v) = %v, want %v", tt.params, got, tt.vars)
+		}
+	}
+	if len(vars) != 1 {
+		t.Errorf("matrixVars changed the variables it was given: %v", vars)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var metricsLogger = NewLogger("METRICS")
+
+// metrics collects process-wide counters for the Prometheus endpoint. They are
+// always collected; -metrics-addr only decides whether they are served.
+var metrics = newMetricsRegistry()
+
+// taskDurationBuckets are the upper bounds, in seconds, of the task duration histogram
+var taskDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600}
+
+type metricsRegistry struct {
+	mu        sync.Mutex
+	started   map[string]int64 // by step name
+	succeeded map[string]int64
+	failed    map[string]int64 // including cancelled tasks
+	durations map[string]*histogram
+	consumers []chan FileData // resource consumers whose backlog is reported
+
+	fuseBytes     atomic.Int64
+	objectsStored atomic.Int64
+	bytesStored   atomic.Int64
+}
+
+type histogram struct {
+	counts []int64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  int64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		started:   make(map[string]int64),
+		succeeded: make(map[string]int64),
+		failed:    make(map[string]int64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+func (m *metricsRegistry) TaskStarted(step string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started[step]++
+}
+
+func (m *metricsRegistry) TaskFinished(step string, duration time.Duration, failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if failed {
+		m.failed[step]++
+	} else {
+		m.succeeded[step]++
+	}
+
+	h, ok := m.durations[step]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(taskDurationBuckets)+1)}
+		m.durations[step] = h
+	}
+	seconds := duration.Seconds()
+	i, _ := slices.BinarySearch(taskDurationBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+func (m *metricsRegistry) ObjectStored(size int) {
+	m.objectsStored.Add(1)
+	m.bytesStored.Add(int64(size))
+}
+
+// addConsumer reports the backlog of a MakeResourceConsumer channel
+func (m *metricsRegistry) addConsumer(ch chan FileData) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consumers = append(m.consumers, ch)
+}
+
+// serveMetrics serves the metrics at /metrics on address (HOST:PORT or unix:PATH)
+// in the background, for as long as the process runs
+func serveMetrics(address string, db *Database) error {
+	var listener net.Listener
+	var err error
+	if strings.HasPrefix(address, "unix:") {
+		listener, err = listenAPI(address)
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.write(w, db)
+	})
+
+	metricsLogger.Info("Serving metrics", "url", metricsURL(address))
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			metricsLogger.Error("Metrics server error", "error", err)
+		}
+	}()
+	return nil
+}
+
+func metricsURL(address string) string {
+	if strings.HasPrefix(address, "unix:") {
+		return address
+	}
+	return "http://" + address + "/metrics"
+}
+
+// write renders the metrics in the Prometheus text exposition format
+func (m *metricsRegistry) write(w io.Writer, db *Database) {
+	m.mu.Lock()
+	writeCounter(w, "grit_tasks_started_total", "Tasks started, by step.", m.started)
+	writeCounter(w, "grit_tasks_succeeded_total", "Tasks that finished successfully, by step.", m.succeeded)
+	writeCounter(w, "grit_tasks_failed_total", "Tasks that failed or were cancelled, by step.", m.failed)
+
+	fmt.Fprintln(w, "# HELP grit_task_duration_seconds Wall time of task scripts, by step.")
+	fmt.Fprintln(w, "# TYPE grit_task_duration_seconds histogram")
+	for _, step := range sortedKeys(m.durations) {
+		h := m.durations[step]
+		var cumulative int64
+		for i, bound := range taskDurationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "grit_task_duration_seconds_bucket{step=%s,le=\"%s\"} %d\n", quoteLabel(step), strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "grit_task_duration_seconds_bucket{step=%s,le=\"+Inf\"} %d\n", quoteLabel(step), h.count)
+		fmt.Fprintf(w, "grit_task_duration_seconds_sum{step=%s} %s\n", quoteLabel(step), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "grit_task_duration_seconds_count{step=%s} %d\n", quoteLabel(step), h.count)
+	}
+
+	var backlog int
+	for _, ch := range m.consumers {
+		backlog += len(ch)
+	}
+	m.mu.Unlock()
+
+	writeGauge(w, "grit_resource_consumer_backlog", "Output files waiting to be hashed and stored.", int64(backlog))
+	writeSingleCounter(w, "grit_fuse_bytes_written_total", "Bytes scripts wrote to their FUSE output directories.", m.fuseBytes.Load())
+	writeSingleCounter(w, "grit_objects_stored_total", "Objects written to the object store.", m.objectsStored.Load())
+	writeSingleCounter(w, "grit_object_bytes_stored_total", "Uncompressed bytes of the objects written to the object store.", m.bytesStored.Load())
+
+	if db == nil {
+		return
+	}
+
+	// Queue depth is read from the database at scrape time, for the latest version of each step
+	latest := make(map[string]Step)
+	for step := range db.ListSteps() {
+		if step.Version >= latest[step.Name].Version {
+			latest[step.Name] = step
+		}
+	}
+	queue := make(map[string]int64, len(latest))
+	for name, step := range latest {
+		n, err := db.CountUnprocessedTasksForStep(step.ID)
+		if err != nil {
+			metricsLogger.Warn("Failed to count unprocessed tasks", "step", name, "error", err)
+			continue
+		}
+		queue[name] = n
+	}
+	fmt.Fprintln(w, "# HELP grit_step_queue_depth Unprocessed tasks of the latest version of each step.")
+	fmt.Fprintln(w, "# TYPE grit_step_queue_depth gauge")
+	for _, name := range sortedKeys(queue) {
+		fmt.Fprintf(w, "grit_step_queue_depth{step=%s} %d\n", quoteLabel(name), queue[name])
+	}
+
+	if sized, ok := db.objects.(interface{ Size() (int64, int64) }); ok {
+		lsm, vlog := sized.Size()
+		fmt.Fprintln(w, "# HELP grit_badger_size_bytes Size of the Badger object store on disk, by part.")
+		fmt.Fprintln(w, "# TYPE grit_badger_size_bytes gauge")
+		fmt.Fprintf(w, "grit_badger_size_bytes{part=\"lsm\"} %d\n", lsm)
+		fmt.Fprintf(w, "grit_badger_size_bytes{part=\"vlog\"} %d\n", vlog)
+	}
+}
+
+func writeCounter(w io.Writer, name, help string, values map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, step := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{step=%s} %d\n", name, quoteLabel(step), values[step])
+	}
+}
+
+func writeSingleCounter(w io.Writer, name, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+func writeGauge(w io.Writer, name, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+// quoteLabel quotes a label value, escaping backslashes, quotes and newlines
+func quoteLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
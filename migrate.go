@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var migrateLogger = NewLogger("MIGRATE")
+
+func migrateCommand(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	addLogFlags(fs)
+	dbFlags := addDatabaseFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "list pending migrations without applying them")
+	moveTo := fs.String("move-objects-to", "", "copy every object to this object store and use it from now on: badger, dir, dir:PATH or s3://BUCKET/PREFIX")
+	commandUsage(fs, "migrate [-db PATH] [-dry-run] [-move-objects-to STORE]")
+	fs.Parse(args)
+
+	database := dbFlags.open(DatabaseOptions{SkipMigrations: true})
+	defer database.Close()
+
+	applyMigrations(&database, *dryRun)
+	if *dryRun {
+		return
+	}
+	// The store the repository was opened with is only recorded once the schema can hold it
+	if _, err := database.resolveObjectStore(*dbFlags.objectStore); err != nil {
+		fatal("Failed to record the object store of the repository", "error", err)
+	}
+	if *moveTo != "" {
+		moveObjects(&database, *moveTo)
+	}
+}
+
+// applyMigrations upgrades the schema of database, or lists the pending
+// migrations if dryRun is set
+func applyMigrations(database *Database, dryRun bool) {
+	version, err := database.SchemaVersion()
+	if err != nil {
+		fatal("Failed to read schema version", "error", err)
+	}
+
+	pending, err := database.PendingMigrations()
+	if err != nil {
+		fatal("Failed to list pending migrations", "error", err)
+	}
+
+	migrateLogger.Info("Schema version", "version", version, "latest", LatestSchemaVersion())
+
+	if len(pending) == 0 {
+		migrateLogger.Info("Database is up to date")
+		return
+	}
+
+	if dryRun {
+		for _, m := range pending {
+			fmt.Printf("%d\t%s\n", m.Version, m.Description)
+		}
+		migrateLogger.Info("Pending migrations not applied (dry run)", "count", len(pending))
+		return
+	}
+
+	applied, err := database.Migrate()
+	if err != nil {
+		fatal("Migration failed", "version", version, "error", err)
+	}
+
+	for _, m := range applied {
+		fmt.Printf("%d\t%s\n", m.Version, m.Description)
+	}
+	migrateLogger.Info("Applied migrations", "count", len(applied))
+}
+
+// moveObjects moves the repository's objects to another object store
+func moveObjects(database *Database, spec string) {
+	from, err := database.RecordedObjectStore()
+	if err != nil {
+		fatal("Failed to read the object store of the repository", "error", err)
+	}
+	moved, err := database.MoveObjects(spec)
+	if err != nil {
+		fatal("Failed to move objects", "to", spec, "moved", moved, "error", err)
+	}
+	migrateLogger.Info("Moved objects", "from", from, "to", spec, "objects", moved)
+}
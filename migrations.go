@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Migration upgrades the SQLite schema from version-1 to version.
+// Migrations are append-only: never edit one that has shipped, add a new one instead.
+type Migration struct {
+	Version     int
+	Description string
+	SQL         string
+}
+
+// migrations is the ordered list of schema changes. Databases created before
+// versioning existed have no schema_version table and start at version 0;
+// migration 1 creates the original tables with IF NOT EXISTS so for them it
+// only adds the tables grit gained before versioning.
+var migrations = []Migration{
+	// Databases from before schema versioning were written before objects had a
+	// codec header, so their objects are recorded as raw instead of being sniffed
+	{1, "initial schema", schema + `
+CREATE TABLE raw_object (hash TEXT PRIMARY KEY);
+INSERT INTO raw_object SELECT DISTINCT object_hash FROM resource;
+
+CREATE TABLE setting (
+  name  TEXT PRIMARY KEY,
+  value TEXT NOT NULL
+);
+`},
+	{2, "record which task produced each resource and its size", `
+CREATE TABLE task_output (
+  task_id     INTEGER NOT NULL,
+  resource_id INTEGER NOT NULL,
+  filename    TEXT NOT NULL,
+
+  FOREIGN KEY(task_id) REFERENCES task(id),
+  FOREIGN KEY(resource_id) REFERENCES resource(id),
+  PRIMARY KEY(task_id, filename)
+);
+CREATE INDEX idx_task_output_resource ON task_output(resource_id);
+ALTER TABLE resource ADD COLUMN size INTEGER;
+CREATE INDEX idx_resource_object_hash ON resource(object_hash);
+`},
+	{3, "record where imported resources came from", `
+ALTER TABLE resource ADD COLUMN source TEXT;
+`},
+	{4, "keep the output of each task", `
+CREATE TABLE task_log (
+  task_id INTEGER PRIMARY KEY,
+  output  TEXT NOT NULL,
+
+  FOREIGN KEY(task_id) REFERENCES task(id)
+);
+`},
+	{5, "track task states and which process ran each task", `
+ALTER TABLE task ADD COLUMN state TEXT NOT NULL DEFAULT 'pending';
+ALTER TABLE task ADD COLUMN started_at TEXT;
+ALTER TABLE task ADD COLUMN finished_at TEXT;
+ALTER TABLE task ADD COLUMN host TEXT;
+ALTER TABLE task ADD COLUMN pid INTEGER;
+UPDATE task SET state = CASE
+  WHEN processed = 0 THEN 'pending'
+  WHEN error IS NULL THEN 'succeeded'
+  WHEN error = 'cancelled' THEN 'cancelled'
+  ELSE 'failed'
+END;
+CREATE INDEX idx_task_state ON task(state);
+`},
+	{6, "record the time and resources each task used", `
+ALTER TABLE task ADD COLUMN wall_ms INTEGER;
+ALTER TABLE task ADD COLUMN exit_code INTEGER;
+ALTER TABLE task ADD COLUMN user_cpu_ms INTEGER;
+ALTER TABLE task ADD COLUMN sys_cpu_ms INTEGER;
+ALTER TABLE task ADD COLUMN max_rss_kb INTEGER;
+ALTER TABLE task ADD COLUMN bytes_in INTEGER;
+ALTER TABLE task ADD COLUMN bytes_out INTEGER;
+`},
+	{7, "record each run and the tasks it executed", `
+CREATE TABLE run (
+  id             INTEGER PRIMARY KEY AUTOINCREMENT,
+  started_at     TEXT NOT NULL,
+  finished_at    TEXT,
+  manifest_hash  TEXT NOT NULL,
+  manifest       TEXT NOT NULL,
+  args           TEXT NOT NULL,
+  host           TEXT NOT NULL,
+  pid            INTEGER NOT NULL,
+  outcome        TEXT NOT NULL DEFAULT 'running',
+  error          TEXT,
+  tasks_executed INTEGER NOT NULL DEFAULT 0,
+  tasks_failed   INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX idx_run_started_at ON run(started_at);
+ALTER TABLE task ADD COLUMN run_id INTEGER REFERENCES run(id);
+CREATE INDEX idx_task_run ON task(run_id);
+CREATE TABLE run_task (
+  run_id  INTEGER NOT NULL REFERENCES run(id),
+  task_id INTEGER NOT NULL REFERENCES task(id),
+  outcome TEXT NOT NULL,
+
+  PRIMARY KEY(run_id, task_id)
+);
+CREATE INDEX idx_run_task_task ON run_task(task_id);
+`},
+	{8, "version steps by how their scripts are run", `
+ALTER TABLE step ADD COLUMN runner TEXT NOT NULL DEFAULT '';
+`},
+}
+
+const schemaVersionTable = `
+CREATE TABLE IF NOT EXISTS schema_version (
+  version     INTEGER PRIMARY KEY,
+  description TEXT NOT NULL,
+  applied_at  TEXT DEFAULT (CURRENT_TIMESTAMP)
+);
+`
+
+// LatestSchemaVersion is the schema version this build of grit writes
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func schemaVersion(q querier) (int, error) {
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_version')").Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = q.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	return int(version.Int64), err
+}
+
+func checkSchemaVersion(version int) error {
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than this grit supports (%d), upgrade grit to open it", version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+func pendingMigrations(version int) []Migration {
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// SchemaVersion returns the schema version recorded in the database (0 for unversioned databases)
+func (d Database) SchemaVersion() (int, error) {
+	return schemaVersion(d.db)
+}
+
+// PendingMigrations lists the migrations Migrate would apply, oldest first
+func (d Database) PendingMigrations() ([]Migration, error) {
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchemaVersion(version); err != nil {
+		return nil, err
+	}
+	return pendingMigrations(version), nil
+}
+
+// Migrate applies all pending migrations in a single transaction, so a failure
+// leaves the database at its original version. Returns the applied migrations.
+func (d Database) Migrate() ([]Migration, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(schemaVersionTable); err != nil {
+		return nil, err
+	}
+
+	// Re-read the version inside the transaction in case another process migrated first
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchemaVersion(version); err != nil {
+		return nil, err
+	}
+
+	pending := pendingMigrations(version)
+	for _, m := range pending {
+		dbLogger.Info("Applying migration", "version", m.Version, "description", m.Description)
+		if _, err := tx.Exec(m.SQL); err != nil {
+			return nil, fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_version (version, description) VALUES (?, ?)", m.Version, m.Description); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
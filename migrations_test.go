@@ -0,0 +1,124 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d (%s) has version %d, want %d", i, m.Description, m.Version, i+1)
+		}
+	}
+
+	tests := []struct {
+		name string
+		open func(t *testing.T) string // returns the repository
+	}{
+		{"new repository", func(t *testing.T) string { return filepath.Join(t.TempDir(), "db") }},
+		{"unversioned repository", func(t *testing.T) string {
+			repo, _ := newLegacyRepository(t, "legacy")
+			return repo
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, err := NewDatabase(tt.open(t), DatabaseOptions{ObjectStore: "dir"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer database.Close()
+
+			if version, err := database.SchemaVersion(); err != nil || version != LatestSchemaVersion() {
+				t.Fatalf("schema version %d, %v, want %d", version, err, LatestSchemaVersion())
+			}
+			if pending, err := database.PendingMigrations(); err != nil || len(pending) != 0 {
+				t.Errorf("pending migrations after opening: %v, %v", pending, err)
+			}
+			for _, table := range []string{"task_output", "task_log", "run", "run_task", "raw_object", "setting"} {
+				if exists, err := database.tableExists(table); err != nil || !exists {
+					t.Errorf("table %s missing: %v", table, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateRecordsLegacyObjectsAsRaw(t *testing.T) {
+	repo, hash := newLegacyRepository(t, "legacy")
+	database, err := NewDatabase(repo, DatabaseOptions{ObjectStore: "dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if !database.rawObjects[hash] {
+		t.Errorf("object of the unversioned repository is not recorded as raw")
+	}
+
+	// Objects stored from now on have a codec header
+	hash = sha256Hex([]byte("new"))
+	if err := database.StoreObject(hash, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.CreateResource("new", hash, 3); err != nil {
+		t.Fatal(err)
+	}
+	if raw, err := database.loadRawObjects(); err != nil || raw[hash] {
+		t.Errorf("new object recorded as raw: %v", err)
+	}
+}
+
+func TestMigrateRefusesNewerDatabases(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "db")
+	database, err := NewDatabase(repo, DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.db.Exec("INSERT INTO schema_version (version, description) VALUES (?, 'from the future')", LatestSchemaVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+
+	if database, err := NewDatabase(repo, DatabaseOptions{}); err == nil {
+		database.Close()
+		t.Fatal("opening a database from a newer grit succeeded")
+	} else if !strings.Contains(err.Error(), "newer") {
+		t.Errorf("got %v, want it to say the database is newer", err)
+	}
+}
+
+func TestFailedMigrationLeavesTheDatabaseAlone(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "db")
+	database, err := NewDatabase(repo, DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+
+	latest := LatestSchemaVersion()
+	defer func(original []Migration) { migrations = original }(migrations)
+	migrations = append(migrations[:len(migrations):len(migrations)],
+		Migration{latest + 1, "add a table", "CREATE TABLE added (id INTEGER);"},
+		Migration{latest + 2, "broken", "ALTER TABLE missing ADD COLUMN x INTEGER;"},
+	)
+
+	database, err = NewDatabase(repo, DatabaseOptions{SkipMigrations: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if pending, err := database.PendingMigrations(); err != nil || len(pending) != 2 {
+		t.Fatalf("pending migrations: %v, %v, want the two new ones", pending, err)
+	}
+	if _, err := database.Migrate(); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("Migrate: got %v, want the broken migration to fail", err)
+	}
+	if version, err := database.SchemaVersion(); err != nil || version != latest {
+		t.Errorf("schema version %d, %v after a failed migration, want %d", version, err, latest)
+	}
+	if exists, _ := database.tableExists("added"); exists {
+		t.Error("the migration before the broken one was kept")
+	}
+}
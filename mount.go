@@ -0,0 +1,383 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+)
+
+var mountLogger = NewLogger("MOUNT")
+
+func mountCommand(args []string) {
+	fs := flag.NewFlagSet("mount", flag.ExitOnError)
+	addLogFlags(fs)
+	dbFlags := addDatabaseFlags(fs)
+	commandUsage(fs, "mount [-db PATH] DIR")
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	mountPath := positional[0]
+
+	database := dbFlags.open(DatabaseOptions{ReadOnly: true})
+	defer database.Close()
+
+	server, err := MountResourceFS(mountPath, database)
+	if err != nil {
+		fatal("Failed to mount", "path", mountPath, "error", err)
+	}
+
+	// Unmount on Ctrl-C; Serve returns once the filesystem is unmounted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		mountLogger.Info("Unmounting", "path", mountPath)
+		if err := server.Unmount(); err != nil {
+			mountLogger.Error("Failed to unmount", "path", mountPath, "error", err)
+		}
+	}()
+
+	mountLogger.Info("Resources mounted read-only (Ctrl-C to unmount)", "path", mountPath)
+	server.Serve()
+}
+
+// MountResourceFS mounts a read-only view of the resource store at mountPath:
+//
+//	/by-name/<name>/<hash>
+//	/by-step/<step>/v<version>/<task-id>/<output>
+//	/by-hash/<hash>
+//
+// Object content is only fetched when a file is opened or its size is needed.
+// The caller must call Serve on the returned server.
+func MountResourceFS(mountPath string, db Database) (*fuse.Server, error) {
+	if err := os.MkdirAll(mountPath, 0755); err != nil {
+		return nil, err
+	}
+
+	fs := pathfs.NewPathNodeFs(&resourceFS{
+		FileSystem: pathfs.NewReadonlyFileSystem(pathfs.NewDefaultFileSystem()),
+		db:         db,
+		sizes:      make(map[string]uint64),
+	}, nil)
+	server, _, err := nodefs.MountRoot(mountPath, fs.Root(), &nodefs.Options{
+		AttrTimeout:  time.Second,
+		EntryTimeout: time.Second,
+	})
+	return server, err
+}
+
+// resourceFS implements the read-only browsing filesystem
+type resourceFS struct {
+	pathfs.FileSystem
+	db Database
+
+	mu    sync.Mutex
+	sizes map[string]uint64 // object sizes already fetched, by hash
+}
+
+var (
+	mountDirAttr  = &fuse.Attr{Mode: fuse.S_IFDIR | 0555}
+	mountRootDirs = []string{"by-name", "by-step", "by-hash"}
+)
+
+// resolve maps a path to either a directory (hash == "") or a file backed by an object hash
+func (fs *resourceFS) resolve(name string) (isDir bool, hash string, status fuse.Status) {
+	if name == "" {
+		return true, "", fuse.OK
+	}
+
+	parts := strings.Split(name, "/")
+	switch parts[0] {
+	case "by-name":
+		switch len(parts) {
+		case 1:
+			return true, "", fuse.OK
+		case 2:
+			names, err := fs.db.ListResourceNames()
+			if err != nil {
+				return false, "", fs.dbError(name, err)
+			}
+			for _, n := range names {
+				if n == parts[1] {
+					return true, "", fuse.OK
+				}
+			}
+		case 3:
+			r, err := fs.db.GetResourceByNameAndHash(parts[1], parts[2])
+			if err != nil {
+				return false, "", fs.dbError(name, err)
+			}
+			if r != nil {
+				return false, r.ObjectHash, fuse.OK
+			}
+		}
+
+	case "by-hash":
+		switch len(parts) {
+		case 1:
+			return true, "", fuse.OK
+		case 2:
+			exists, err := fs.db.ResourceHashExists(parts[1])
+			if err != nil {
+				return false, "", fs.dbError(name, err)
+			}
+			if exists {
+				return false, parts[1], fuse.OK
+			}
+		}
+
+	case "by-step":
+		if len(parts) == 1 {
+			return true, "", fuse.OK
+		}
+		if len(parts) == 2 {
+			step, err := fs.db.GetStepByName(parts[1])
+			if err != nil {
+				return false, "", fs.dbError(name, err)
+			}
+			return step != nil, "", statusIf(step != nil)
+		}
+
+		step, status := fs.stepVersion(parts[1], parts[2])
+		if status != fuse.OK {
+			return false, "", status
+		}
+		if len(parts) == 3 {
+			return true, "", fuse.OK
+		}
+
+		task, status := fs.stepTask(step, parts[3])
+		if status != fuse.OK {
+			return false, "", status
+		}
+		if len(parts) == 4 {
+			return true, "", fuse.OK
+		}
+
+		if len(parts) == 5 {
+			outputs, err := fs.db.GetTaskOutputs(task.ID)
+			if err != nil {
+				return false, "", fs.dbError(name, err)
+			}
+			for _, o := range outputs {
+				if o.Filename == parts[4] {
+					return false, o.Resource.ObjectHash, fuse.OK
+				}
+			}
+		}
+	}
+
+	return false, "", fuse.ENOENT
+}
+
+func (fs *resourceFS) stepVersion(stepName string, versionDir string) (*Step, fuse.Status) {
+	version, err := strconv.Atoi(strings.TrimPrefix(versionDir, "v"))
+	if err != nil || !strings.HasPrefix(versionDir, "v") {
+		return nil, fuse.ENOENT
+	}
+
+	step, err := fs.db.GetStepByNameAndVersion(stepName, version)
+	if err != nil {
+		return nil, fs.dbError(stepName, err)
+	}
+	if step == nil {
+		return nil, fuse.ENOENT
+	}
+	return step, fuse.OK
+}
+
+func (fs *resourceFS) stepTask(step *Step, taskDir string) (*Task, fuse.Status) {
+	taskID, err := strconv.ParseInt(taskDir, 10, 64)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+
+	task, err := fs.db.GetTask(taskID)
+	if err != nil {
+		return nil, fs.dbError(taskDir, err)
+	}
+	if task == nil || task.StepID != step.ID {
+		return nil, fuse.ENOENT
+	}
+	return task, fuse.OK
+}
+
+func (fs *resourceFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	isDir, hash, status := fs.resolve(name)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if isDir {
+		return mountDirAttr, fuse.OK
+	}
+
+	size, status := fs.objectSize(hash)
+	if status != fuse.OK {
+		return nil, status
+	}
+	return &fuse.Attr{Mode: fuse.S_IFREG | 0444, Size: size}, fuse.OK
+}
+
+func (fs *resourceFS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	isDir, _, status := fs.resolve(name)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if !isDir {
+		return nil, fuse.ENOTDIR
+	}
+
+	var dirs, files []string
+	parts := strings.Split(name, "/")
+
+	switch {
+	case name == "":
+		dirs = mountRootDirs
+
+	case name == "by-name":
+		names, err := fs.db.ListResourceNames()
+		if err != nil {
+			return nil, fs.dbError(name, err)
+		}
+		dirs = names
+
+	case parts[0] == "by-name":
+		for r := range fs.db.GetResourcesByName(parts[1]) {
+			files = append(files, r.ObjectHash)
+		}
+
+	case name == "by-hash":
+		hashes, err := fs.db.ListObjectHashes()
+		if err != nil {
+			return nil, fs.dbError(name, err)
+		}
+		files = hashes
+
+	case name == "by-step":
+		seen := make(map[string]bool)
+		for step := range fs.db.ListSteps() {
+			if !seen[step.Name] {
+				seen[step.Name] = true
+				dirs = append(dirs, step.Name)
+			}
+		}
+
+	case parts[0] == "by-step" && len(parts) == 2:
+		for step := range fs.db.ListSteps() {
+			if step.Name == parts[1] {
+				dirs = append(dirs, "v"+strconv.Itoa(step.Version))
+			}
+		}
+
+	case parts[0] == "by-step" && len(parts) == 3:
+		step, status := fs.stepVersion(parts[1], parts[2])
+		if status != fuse.OK {
+			return nil, status
+		}
+		for task := range fs.db.GetTasksForStep(step.ID) {
+			dirs = append(dirs, strconv.FormatInt(task.ID, 10))
+		}
+
+	case parts[0] == "by-step" && len(parts) == 4:
+		taskID, _ := strconv.ParseInt(parts[3], 10, 64)
+		outputs, err := fs.db.GetTaskOutputs(taskID)
+		if err != nil {
+			return nil, fs.dbError(name, err)
+		}
+		for _, o := range outputs {
+			files = append(files, o.Filename)
+		}
+	}
+
+	entries := make([]fuse.DirEntry, 0, len(dirs)+len(files))
+	for _, d := range dirs {
+		entries = append(entries, fuse.DirEntry{Name: d, Mode: fuse.S_IFDIR})
+	}
+	for _, f := range files {
+		entries = append(entries, fuse.DirEntry{Name: f, Mode: fuse.S_IFREG})
+	}
+	return entries, fuse.OK
+}
+
+func (fs *resourceFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&0x3 != 0 { // O_WRONLY or O_RDWR
+		return nil, fuse.EROFS
+	}
+
+	isDir, hash, status := fs.resolve(name)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if isDir {
+		return nil, fuse.EISDIR
+	}
+
+	data, err := fs.db.GetObject(hash)
+	if err != nil {
+		mountLogger.Error("Failed to read object", "path", name, "hash", hash, "error", err)
+		return nil, fuse.EIO
+	}
+
+	fs.mu.Lock()
+	fs.sizes[hash] = uint64(len(data))
+	fs.mu.Unlock()
+
+	mountLogger.Debug("open", "path", name, "hash", hash, "bytes", len(data))
+	return nodefs.NewReadOnlyFile(nodefs.NewDataFile(data)), fuse.OK
+}
+
+// objectSize returns the uncompressed size of an object as recorded in the
+// database, fetching the object once if it was stored before sizes were recorded
+func (fs *resourceFS) objectSize(hash string) (uint64, fuse.Status) {
+	fs.mu.Lock()
+	size, ok := fs.sizes[hash]
+	fs.mu.Unlock()
+	if ok {
+		return size, fuse.OK
+	}
+
+	recorded, ok, err := fs.db.ObjectSize(hash)
+	if err != nil {
+		return 0, fs.dbError(hash, err)
+	}
+	if ok {
+		fs.mu.Lock()
+		fs.sizes[hash] = uint64(recorded)
+		fs.mu.Unlock()
+		return uint64(recorded), fuse.OK
+	}
+
+	data, err := fs.db.GetObject(hash)
+	if err != nil {
+		mountLogger.Error("Failed to read object", "hash", hash, "error", err)
+		return 0, fuse.EIO
+	}
+
+	fs.mu.Lock()
+	fs.sizes[hash] = uint64(len(data))
+	fs.mu.Unlock()
+	return uint64(len(data)), fuse.OK
+}
+
+func (fs *resourceFS) dbError(name string, err error) fuse.Status {
+	mountLogger.Error("Database error", "path", name, "error", err)
+	return fuse.EIO
+}
+
+func statusIf(ok bool) fuse.Status {
+	if ok {
+		return fuse.OK
+	}
+	return fuse.ENOENT
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// ErrObjectNotFound is returned by ObjectStore.Get when no object has the requested hash
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectStore is a content-addressed blob store keyed by SHA-256 hex hashes.
+// Values are stored exactly as given; compression is handled by the Database.
+type ObjectStore interface {
+	Put(hash string, data []byte) error
+	PutBatch(objects map[string][]byte) error
+	Get(hash string) ([]byte, error)
+	GetBatch(hashes []string) (map[string][]byte, error)
+	Exists(hash string) bool
+	Close() error
+}
+
+// OpenObjectStore opens the object store described by spec:
+//
+//	badger           BadgerDB at <repo>/objects_db (default)
+//	dir              sharded directory at <repo>/objects
+//	dir:/some/path   sharded directory at the given path
+//	s3://bucket/pfx  S3-compatible bucket, see NewS3ObjectStore
+//
+// A read-only store never blocks on, or blocks, a process writing to the same store.
+func OpenObjectStore(spec string, repoPath string, readOnly bool) (ObjectStore, error) {
+	switch {
+	case spec == "" || spec == "badger":
+		return NewBadgerObjectStore(filepath.Join(repoPath, "objects_db"), readOnly)
+	case spec == "dir":
+		return NewDirObjectStore(filepath.Join(repoPath, "objects"))
+	case strings.HasPrefix(spec, "dir:"):
+		return NewDirObjectStore(strings.TrimPrefix(spec, "dir:"))
+	case strings.HasPrefix(spec, "s3://"):
+		return NewS3ObjectStore(spec)
+	}
+	return nil, fmt.Errorf("unknown object store %q (expected badger, dir, dir:PATH or s3://BUCKET/PREFIX)", spec)
+}
+
+// validObjectStoreSpec reports whether OpenObjectStore understands spec
+func validObjectStoreSpec(spec string) bool {
+	return spec == "" || spec == "badger" || spec == "dir" || strings.HasPrefix(spec, "dir:") || strings.HasPrefix(spec, "s3://")
+}
+
+// BadgerObjectStore keeps objects in an embedded BadgerDB
+type BadgerObjectStore struct {
+	db *badger.DB
+}
+
+func NewBadgerObjectStore(path string, readOnly bool) (*BadgerObjectStore, error) {
+	dbLogger.Debug("Opening BadgerDB", "path", path)
+	badgerOpts := badger.DefaultOptions(path)
+	badgerOpts.Logger = nil // Disable BadgerDB's default logging
+
+	if readOnly {
+		// Readers skip Badger's directory lock so they can run alongside the writing
+		// process; the run lock already guarantees there is at most one writer.
+		// Objects still in the writer's memtable may not be visible yet.
+		badgerOpts.ReadOnly = true
+		badgerOpts.BypassLockGuard = true
+	}
+
+	// Performance tuning for sequential batch operations
+	// Objects are written in batches during output processing, then read sequentially during task execution
+	badgerOpts.SyncWrites = false           // Don't fsync on every write
+	badgerOpts.NumVersionsToKeep = 1        // No version history for immutable data
+	badgerOpts.CompactL0OnClose = false     // Faster shutdown
+	badgerOpts.ValueLogFileSize = 512 << 20 // Larger value log (512MB) for batch writes
+	badgerOpts.MemTableSize = 128 << 20     // Large memtable (128MB) for batch buffering
+	badgerOpts.NumMemtables = 3             // More memtables for write-heavy batches
+	badgerOpts.NumLevelZeroTables = 5       // Allow more L0 tables before compaction
+	badgerOpts.NumLevelZeroTablesStall = 10 // Higher stall threshold
+	badgerOpts.ValueThreshold = 1024        // Store larger values in value log for sequential read
+	badgerOpts.NumCompactors = 2            // More compactors for background work
+
+	db, err := badger.Open(badgerOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open BadgerDB: %w", err)
+	}
+
+	return &BadgerObjectStore{db: db}, nil
+}
+
+func (s *BadgerObjectStore) Put(hash string, data []byte) error {
+	// Use WriteBatch for better performance even for single writes
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	if err := wb.Set([]byte(hash), data); err != nil {
+		return err
+	}
+
+	return wb.Flush()
+}
+
+// PutBatch stores multiple objects in a single batch (much faster)
+func (s *BadgerObjectStore) PutBatch(objects map[string][]byte) error {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for hash, data := range objects {
+		if err := wb.Set([]byte(hash), data); err != nil {
+			return err
+		}
+	}
+
+	return wb.Flush()
+}
+
+func (s *BadgerObjectStore) Get(hash string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(hash))
+		if err != nil {
+			return err
+		}
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrObjectNotFound
+	}
+	return data, err
+}
+
+// GetBatch retrieves multiple objects in a single transaction (faster for sequential reads)
+func (s *BadgerObjectStore) GetBatch(hashes []string) (map[string][]byte, error) {
+	results := make(map[string][]byte)
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		for _, hash := range hashes {
+			item, err := txn.Get([]byte(hash))
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return fmt.Errorf("%s: %w", hash, ErrObjectNotFound)
+			}
+			if err != nil {
+				return err
+			}
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			results[hash] = data
+		}
+		return nil
+	})
+
+	return results, err
+}
+
+func (s *BadgerObjectStore) Exists(hash string) bool {
+	err := s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(hash))
+		return err
+	})
+	return err == nil
+}
+
+// Size returns the size of the LSM tree and value log on disk, as last computed by Badger
+func (s *BadgerObjectStore) Size() (lsm, vlog int64) {
+	return s.db.Size()
+}
+
+func (s *BadgerObjectStore) Close() error {
+	return s.db.Close()
+}
+
+// unavailableObjectStore stands in for an object store that could not be opened
+// read-only, reporting why whenever object content is needed
+type unavailableObjectStore struct {
+	err error
+}
+
+func (s unavailableObjectStore) error() error {
+	return fmt.Errorf("object store is unavailable (it may be in use by a running pipeline): %w", s.err)
+}
+
+func (s unavailableObjectStore) Put(hash string, data []byte) error       { return s.error() }
+func (s unavailableObjectStore) PutBatch(objects map[string][]byte) error { return s.error() }
+func (s unavailableObjectStore) Get(hash string) ([]byte, error)          { return nil, s.error() }
+func (s unavailableObjectStore) GetBatch(hashes []string) (map[string][]byte, error) {
+	return nil, s.error()
+}
+func (s unavailableObjectStore) Exists(hash string) bool { return false }
+func (s unavailableObjectStore) Close() error            { return nil }
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3ObjectStore keeps objects in an S3-compatible bucket under an optional key prefix.
+// Requests are signed with AWS Signature Version 4 using the standard AWS_* environment
+// variables; without credentials requests are sent anonymously.
+type S3ObjectStore struct {
+	client    *http.Client
+	endpoint  *url.URL // scheme and host requests are sent to
+	pathStyle bool     // bucket in the path (custom endpoints) instead of the host name
+	bucket    string
+	prefix    string
+	region    string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// NewS3ObjectStore parses a spec of the form
+//
+//	s3://bucket/prefix?endpoint=http://localhost:9000&region=us-east-1
+//
+// The endpoint defaults to AWS (or $AWS_ENDPOINT_URL) and the region to $AWS_REGION or us-east-1.
+// Custom endpoints use path-style addressing, which is what local S3 stand-ins expect.
+func NewS3ObjectStore(spec string) (*S3ObjectStore, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 object store %q: %w", spec, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 object store %q: missing bucket", spec)
+	}
+
+	query := u.Query()
+	region := query.Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	s := &S3ObjectStore{
+		client:       &http.Client{Timeout: 5 * time.Minute},
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint != "" {
+		s.endpoint, err = url.Parse(endpoint)
+		if err != nil || s.endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid s3 endpoint %q", endpoint)
+		}
+		s.pathStyle = true
+	} else {
+		s.endpoint = &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", s.bucket, region)}
+	}
+
+	dbLogger.Debug("Using S3 object store", "bucket", s.bucket, "prefix", s.prefix, "endpoint", s.endpoint)
+	return s, nil
+}
+
+func (s *S3ObjectStore) objectURL(hash string) *url.URL {
+	key := hash
+	if s.prefix != "" {
+		key = s.prefix + "/" + hash
+	}
+	if s.pathStyle {
+		key = s.bucket + "/" + key
+	}
+
+	u := *s.endpoint
+	u.Path = "/" + key
+	u.RawPath = "/" + s3EscapePath(key)
+	return &u
+}
+
+func (s *S3ObjectStore) do(method string, hash string, body []byte) (*http.Response, error) {
+	u := s.objectURL(hash)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	req.ContentLength = int64(len(body))
+
+	s.sign(req, u, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to req
+func (s *S3ObjectStore) sign(req *http.Request, u *url.URL, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return
+	}
+
+	headers := map[string]string{
+		"host":                 u.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if s.sessionToken != "" {
+		headers["x-amz-security-token"] = s.sessionToken
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		u.EscapedPath(),
+		"", // no query string
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func (s *S3ObjectStore) Put(hash string, data []byte) error {
+	resp, err := s.do(http.MethodPut, hash, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return s3Error("PUT", hash, resp)
+	}
+	return nil
+}
+
+func (s *S3ObjectStore) PutBatch(objects map[string][]byte) error {
+	for hash, data := range objects {
+		if err := s.Put(hash, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3ObjectStore) Get(hash string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, hash, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrObjectNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, s3Error("GET", hash, resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3ObjectStore) GetBatch(hashes []string) (map[string][]byte, error) {
+	results := make(map[string][]byte, len(hashes))
+	for _, hash := range hashes {
+		data, err := s.Get(hash)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", hash, err)
+		}
+		results[hash] = data
+	}
+	return results, nil
+}
+
+func (s *S3ObjectStore) Exists(hash string) bool {
+	resp, err := s.do(http.MethodHead, hash, nil)
+	if err != nil {
+		dbLogger.Warn("Failed to check S3 object", "hash", hash, "error", err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode/100 == 2
+}
+
+func (s *S3ObjectStore) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+func s3Error(method string, hash string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s %s: %s: %s", method, hash, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// s3EscapePath URI-encodes each path segment the way SigV4 expects
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		var b strings.Builder
+		for _, c := range []byte(segment) {
+			if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+				c == '-' || c == '_' || c == '.' || c == '~' {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		segments[i] = b.String()
+	}
+	return strings.Join(segments, "/")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
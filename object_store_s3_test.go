@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a local stand-in for an S3-compatible server: it keeps objects in
+// memory by path and records the requests it gets
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	requests []*http.Request
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Path] = data
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3ObjectStore(t *testing.T) {
+	fake, server := newFakeS3(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+
+	store, err := NewS3ObjectStore("s3://bucket/some/prefix?endpoint=" + server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	hash := sha256Hex([]byte("hello"))
+	if store.Exists(hash) {
+		t.Fatal("object exists before it was stored")
+	}
+	if _, err := store.Get(hash); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("Get of a missing object: got %v, want ErrObjectNotFound", err)
+	}
+	if err := store.Put(hash, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Exists(hash) {
+		t.Fatal("object does not exist after it was stored")
+	}
+	data, err := store.Get(hash)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Get: got %q, %v", data, err)
+	}
+
+	// Custom endpoints use path-style addressing with the prefix before the hash
+	if _, ok := fake.objects["/bucket/some/prefix/"+hash]; !ok {
+		t.Errorf("object stored at unexpected keys: %v", fake.objects)
+	}
+	for _, r := range fake.requests {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=test-key/") || !strings.Contains(auth, "Signature=") {
+			t.Errorf("%s request not signed: %q", r.Method, auth)
+		}
+	}
+}
+
+func TestDatabaseRemembersObjectStore(t *testing.T) {
+	_, server := newFakeS3(t)
+	repo := t.TempDir()
+	spec := "s3://bucket/objects?endpoint=" + server.URL
+
+	database, err := NewDatabase(repo, DatabaseOptions{ObjectStore: spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256Hex([]byte("content"))
+	if err := database.StoreObject(hash, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without -object-store, the recorded store is used
+	database, err = NewDatabase(repo, DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := database.GetObject(hash)
+	if err != nil || string(data) != "content" {
+		t.Fatalf("GetObject after reopening: got %q, %v", data, err)
+	}
+	database.Close()
+
+	// Another store is refused rather than silently splitting the objects
+	if database, err := NewDatabase(repo, DatabaseOptions{ObjectStore: "badger"}); err == nil {
+		database.Close()
+		t.Fatal("opening with a different object store succeeded")
+	}
+}
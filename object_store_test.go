@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestObjectStores(t *testing.T) {
+	for _, spec := range []string{"badger", "dir", "dir:" + filepath.Join(t.TempDir(), "shared")} {
+		t.Run(spec, func(t *testing.T) {
+			store, err := OpenObjectStore(spec, t.TempDir(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			a, b := sha256Hex([]byte("a")), sha256Hex([]byte("b"))
+			if store.Exists(a) {
+				t.Fatal("object exists before it was stored")
+			}
+			if _, err := store.Get(a); !errors.Is(err, ErrObjectNotFound) {
+				t.Fatalf("Get of a missing object: got %v, want ErrObjectNotFound", err)
+			}
+			if err := store.Put(a, []byte("a")); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.PutBatch(map[string][]byte{b: []byte("b")}); err != nil {
+				t.Fatal(err)
+			}
+			if !store.Exists(a) || !store.Exists(b) {
+				t.Fatal("stored objects do not exist")
+			}
+			objects, err := store.GetBatch([]string{a, b})
+			if err != nil || string(objects[a]) != "a" || string(objects[b]) != "b" {
+				t.Fatalf("GetBatch: got %q, %v", objects, err)
+			}
+			if _, err := store.GetBatch([]string{a, sha256Hex([]byte("c"))}); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("GetBatch with a missing object: got %v, want ErrObjectNotFound", err)
+			}
+		})
+	}
+}
+
+func TestOpenObjectStoreRefusesUnknownSpecs(t *testing.T) {
+	for _, spec := range []string{"badgerdb", "s3:bucket", "directory"} {
+		if store, err := OpenObjectStore(spec, t.TempDir(), false); err == nil {
+			store.Close()
+			t.Errorf("OpenObjectStore(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestMoveObjects(t *testing.T) {
+	repo := t.TempDir()
+	database, err := NewDatabase(repo, DatabaseOptions{ObjectStore: "dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("moved between stores")
+	hash := sha256Hex(data)
+	if err := database.StoreObject(hash, data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.CreateResource("moved", hash, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	target := "dir:" + filepath.Join(t.TempDir(), "objects")
+	if moved, err := database.MoveObjects(target); err != nil || moved != 1 {
+		t.Fatalf("MoveObjects: moved %d, %v, want 1", moved, err)
+	}
+	database.Close()
+
+	// The repository now opens with the new store, where the object reads back
+	database, err = NewDatabase(repo, DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if spec, err := database.RecordedObjectStore(); err != nil || spec != target {
+		t.Errorf("recorded store %q, %v, want %q", spec, err, target)
+	}
+	if got, err := database.GetObject(hash); err != nil || string(got) != string(data) {
+		t.Errorf("GetObject after moving: got %q, %v", got, err)
+	}
+}
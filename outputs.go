@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// OutputRules are the outputs a step declares in the manifest. A step without
+// declared outputs may write any name.
+type OutputRules struct {
+	Declared       []string // resource names the step may write
+	Required       []string // names every successful task must write
+	WarnUndeclared bool     // keep undeclared files with a warning instead of refusing them
+	Suffix         string   // added to the resource names of a step expanded from a matrix, see matrixSuffix
+}
+
+// ParseOutputRules reads the outputs, required_outputs and undeclared_outputs of
+// a manifest step
+func ParseOutputRules(step ManifestStep) (OutputRules, error) {
+	rules := OutputRules{Declared: step.Outputs, Required: step.RequiredOutputs, Suffix: matrixSuffix(step.Params)}
+	switch step.UndeclaredOutputs {
+	case "", "reject":
+	case "warn":
+		rules.WarnUndeclared = true
+	default:
+		return rules, fmt.Errorf("unknown undeclared_outputs %q (expected reject or warn)", step.UndeclaredOutputs)
+	}
+	for _, name := range slices.Concat(step.Outputs, step.RequiredOutputs) {
+		if err := checkResourceName(name); err != nil {
+			return rules, fmt.Errorf("invalid output name %q (%w)", name, err)
+		}
+	}
+	if len(rules.Declared) > 0 {
+		for _, name := range rules.Required {
+			if !slices.Contains(rules.Declared, name) {
+				return rules, fmt.Errorf("required output %q is not in outputs", name)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// checkResourceName rejects names that cannot be resources: ones that would not
+// survive being split at the first underscore or used as a path element
+func checkResourceName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/_\x00") {
+		return fmt.Errorf("resource names cannot be empty, . or .., or contain / or _")
+	}
+	return nil
+}
+
+// resourceName is the resource a file in an output directory becomes: its name
+// up to the first underscore, so raw_1 and raw_2 are both "raw"
+func resourceName(file string) string {
+	name, _, _ := strings.Cut(file, "_")
+	return name
+}
+
+// storedName is the name file is stored under: with the suffix after its
+// resource name, so raw_1 of eval[seed=1] becomes raw[seed=1]_1
+func (r OutputRules) storedName(file string) string {
+	if r.Suffix == "" {
+		return file
+	}
+	name, rest, found := strings.Cut(file, "_")
+	if !found {
+		return name + r.Suffix
+	}
+	return name + r.Suffix + "_" + rest
+}
+
+// allows reports whether a step may write file
+func (r OutputRules) allows(file string) bool {
+	return len(r.Declared) == 0 || slices.Contains(r.Declared, resourceName(file))
+}
+
+// check returns why a task that wrote the files written, and had the files
+// refused refused, fails its step's rules, or nil if it does not
+func (r OutputRules) check(written, refused []string) error {
+	if len(refused) > 0 {
+		return fmt.Errorf("wrote undeclared outputs: %s", strings.Join(refused, ", "))
+	}
+	var missing []string
+	for _, name := range r.Required {
+		if !slices.ContainsFunc(written, func(file string) bool { return resourceName(file) == name }) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("did not write required outputs: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
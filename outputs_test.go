@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseOutputRules(t *testing.T) {
+	tests := []struct {
+		name string
+		step ManifestStep
+		err  string // start of the error, or "" for none
+	}{
+		{"no outputs", ManifestStep{}, ""},
+		{"declared and required", ManifestStep{Outputs: []string{"model", "stats"}, RequiredOutputs: []string{"model"}}, ""},
+		{"required without declared", ManifestStep{RequiredOutputs: []string{"model"}}, ""},
+		{"warn", ManifestStep{Outputs: []string{"model"}, UndeclaredOutputs: "warn"}, ""},
+		{"unknown mode", ManifestStep{UndeclaredOutputs: "ignore"}, "unknown undeclared_outputs"},
+		{"required not declared", ManifestStep{Outputs: []string{"stats"}, RequiredOutputs: []string{"model"}}, `required output "model" is not in outputs`},
+		{"underscore", ManifestStep{Outputs: []string{"model_1"}}, `invalid output name "model_1"`},
+		{"path", ManifestStep{RequiredOutputs: []string{"../model"}}, `invalid output name "../model"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseOutputRules(tt.step)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestOutputRules(t *testing.T) {
+	declared := OutputRules{Declared: []string{"model", "stats"}, Required: []string{"model"}}
+	tests := []struct {
+		name    string
+		rules   OutputRules
+		file    string
+		allowed bool
+	}{
+		{"anything without declared outputs", OutputRules{}, "whatever_3", true},
+		{"declared", declared, "stats", true},
+		{"numbered declared", declared, "model_2", true},
+		{"undeclared", declared, "debug", false},
+		{"declared name as a prefix", declared, "models", false},
+	}
+	for _, tt := range tests {
+		if got := tt.rules.allows(tt.file); got != tt.allowed {
+			t.Errorf("%s: allows(%q) = %v, want %v", tt.name, tt.file, got, tt.allowed)
+		}
+	}
+
+	checks := []struct {
+		name             string
+		written, refused []string
+		err              string
+	}{
+		{"required written", []string{"model", "stats"}, nil, ""},
+		{"required written numbered", []string{"model_1", "model_2"}, nil, ""},
+		{"required missing", []string{"stats"}, nil, "did not write required outputs: model"},
+		{"refused", []string{"model"}, []string{"debug", "trace_1"}, "wrote undeclared outputs: debug, trace_1"},
+	}
+	for _, tt := range checks {
+		err := declared.check(tt.written, tt.refused)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestStoredName(t *testing.T) {
+	tests := []struct {
+		suffix, file, want string
+	}{
+		{"", "raw_1", "raw_1"},
+		{"[seed=1]", "raw", "raw[seed=1]"},
+		{"[seed=1]", "raw_1", "raw[seed=1]_1"},
+		{"[seed=1]", "raw_1_b", "raw[seed=1]_1_b"},
+	}
+	for _, tt := range tests {
+		if got := (OutputRules{Suffix: tt.suffix}).storedName(tt.file); got != tt.want {
+			t.Errorf("storedName(%q) with suffix %q = %q, want %q", tt.file, tt.suffix, got, tt.want)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"os"
 	"runtime"
+	"sync"
 	"sync/atomic"
 
 	"github.com/danhab99/idk/workers"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var pipelineLogger = NewLogger("PIPELINE")
@@ -14,8 +18,21 @@ type Pipeline struct {
 	db          *Database
 	fuseWatcher *FuseWatcher
 	outputChan  chan FileData
+
+	// ProcessGroups runs each script in its own process group so cancelling a task
+	// kills everything it started. Scripts then no longer receive the terminal's
+	// Ctrl-C, so only long-running servers that cancel tasks themselves enable it.
+	ProcessGroups bool
+
+	mu        sync.Mutex
+	running   map[int64]context.CancelFunc // Tasks currently executing
+	cancelled map[int64]bool               // Tasks cancelled before they started
+	stopping  bool                         // Set by Shutdown, no new tasks start
 }
 
+// ErrTaskCancelled is recorded as the error of a task cancelled with CancelTask
+const ErrTaskCancelled = "cancelled"
+
 func NewPipeline(db *Database) (*Pipeline, error) {
 	outDir, err := os.MkdirTemp("/tmp", "output-*")
 	if err != nil {
@@ -33,21 +50,29 @@ func NewPipeline(db *Database) (*Pipeline, error) {
 		db:          db,
 		fuseWatcher: fuseWatcher,
 		outputChan:  outputChan,
+		running:     make(map[int64]context.CancelFunc),
+		cancelled:   make(map[int64]bool),
 	}, nil
 }
 
-func (p *Pipeline) ExecuteStep(step Step, maxParallel int) int64 {
+func (p *Pipeline) ExecuteStep(ctx context.Context, step Step, maxParallel int) int64 {
 	db := p.db
 
+	ctx, span := tracer.Start(ctx, "step "+step.Name, trace.WithAttributes(
+		attribute.String("grit.step.name", step.Name),
+		attribute.Int("grit.step.version", step.Version),
+	))
+	defer span.End()
+
 	// Schedule new tasks for this step
 	tasksCreated, err := db.ScheduleTasksForStep(step.ID)
 	if err != nil {
-		pipelineLogger.Printf("Error scheduling tasks for step %s: %v\n", step.Name, err)
+		pipelineLogger.Error("Failed to schedule tasks", "step", step.Name, "error", err)
 		return 0
 	}
 
 	if tasksCreated > 0 {
-		pipelineLogger.Printf("Step %s: scheduled %d new tasks\n", step.Name, tasksCreated)
+		pipelineLogger.Info("Scheduled new tasks", "step", step.Name, "count", tasksCreated)
 	}
 
 	err = db.ForceSaveWAL()
@@ -66,28 +91,122 @@ func (p *Pipeline) ExecuteStep(step Step, maxParallel int) int64 {
 		pr = &x
 	}
 	workers.Parallel0(taskChan, *pr, func(task Task) {
-		pipelineLogger.Verbosef("Executing task %d for step %s\n", task.ID, step.Name)
+		ctx, ok := p.startTask(ctx, task.ID)
+		if !ok {
+			pipelineLogger.Debug("Not starting task, cancelled or shutting down", "task_id", task.ID, "step", step.Name)
+			return
+		}
+		defer p.finishTask(task.ID)
+
+		pipelineLogger.Debug("Executing task", "task_id", task.ID, "step", step.Name)
 
-		execErr := executor.Execute(task, step, p.outputChan)
+		execErr := executor.Execute(ctx, task, step, p.outputChan)
 
 		var errorMsg *string
-		if execErr != nil {
+		if ctx.Err() != nil {
+			msg := ErrTaskCancelled
+			errorMsg = &msg
+			pipelineLogger.Warn("Task cancelled", "task_id", task.ID, "step", step.Name)
+		} else if execErr != nil {
 			msg := execErr.Error()
 			errorMsg = &msg
-			pipelineLogger.Printf("Task %d failed: %v\n", task.ID, execErr)
+			pipelineLogger.Error("Task failed", "task_id", task.ID, "step", step.Name, "error", execErr)
 		}
 
 		err = db.UpdateTaskStatus(task.ID, true, errorMsg)
 		if err != nil {
-			pipelineLogger.Printf("Error updating task %d: %v\n", task.ID, err)
+			pipelineLogger.Error("Failed to update task", "task_id", task.ID, "step", step.Name, "error", err)
+		} else if errorMsg != nil {
+			taskFailed(ctx, *db, task.ID, step, *errorMsg)
 		}
 
 		executionCount.Add(1)
 	})
 
+	span.SetAttributes(attribute.Int64("grit.tasks_executed", executionCount.Load()))
 	return executionCount.Load()
 }
 
+// startTask registers a task as running, returning false if it was cancelled
+// while queued or the pipeline is shutting down. The task's context is derived
+// from parent so its span nests under the step's.
+func (p *Pipeline) startTask(parent context.Context, taskID int64) (context.Context, bool) {
+	p.mu.Lock()
+	if p.stopping {
+		p.mu.Unlock()
+		return nil, false
+	}
+	if p.cancelled[taskID] {
+		delete(p.cancelled, taskID)
+		p.mu.Unlock()
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	p.running[taskID] = cancel
+	p.mu.Unlock()
+
+	// Recorded so the task can be recovered if this process dies while running it
+	host, _ := os.Hostname()
+	if err := p.db.StartTask(taskID, runIDFromContext(ctx), host, os.Getpid()); err != nil {
+		pipelineLogger.Error("Failed to record start of task", "task_id", taskID, "error", err)
+	}
+	return ctx, true
+}
+
+func (p *Pipeline) finishTask(taskID int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if cancel, ok := p.running[taskID]; ok {
+		cancel()
+		delete(p.running, taskID)
+	}
+}
+
+// CancelTask kills a running task, or marks a pending one as cancelled so it is
+// never started. Either way the task is recorded as failed with ErrTaskCancelled.
+// Returns false if the task has already finished.
+func (p *Pipeline) CancelTask(taskID int64) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if cancel, ok := p.running[taskID]; ok {
+		cancel()
+		return true, nil
+	}
+
+	task, err := p.db.GetTask(taskID)
+	if err != nil || task == nil || task.Processed {
+		return false, err
+	}
+
+	msg := ErrTaskCancelled
+	if err := p.db.UpdateTaskStatus(taskID, true, &msg); err != nil {
+		return false, err
+	}
+	p.cancelled[taskID] = true
+	return true, nil
+}
+
+// Shutdown kills every running task and stops new ones from starting. Tasks
+// that never started stay pending for the next run.
+func (p *Pipeline) Shutdown() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopping = true
+	for _, cancel := range p.running {
+		cancel()
+	}
+}
+
+// WaitForOutputs blocks until every file written so far has been stored and
+// recorded as a resource. Tasks must not be running while it is called.
+func (p *Pipeline) WaitForOutputs() {
+	p.fuseWatcher.WaitForWrites()
+	p.fuseWatcher.pending.Wait()
+}
+
 func (p *Pipeline) GetFusePath() string {
 	return p.fuseWatcher.mountPath
 }
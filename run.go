@@ -1,35 +1,170 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"slices"
+	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var runLogger = NewLogger("RUN")
 
-func run(manifest Manifest, database Database, parallel int, startStepName string, enabledSteps []string) {
+func run(manifestPath string, vars map[string]string, manifest Manifest, database Database, parallel int, startStepName string, enabledSteps []string) {
 	startTime := time.Now()
 
-	// Register all steps from manifest
+	runID, err := beginRun(database, manifestPath, vars)
+	if err != nil {
+		panic(err)
+	}
+	ctx, span := tracer.Start(withRun(traceRoot(), runID, manifest.Hooks), "run", trace.WithAttributes(attribute.Int64("grit.run.id", runID)))
+	defer span.End()
+
+	// A run that cannot get going is recorded as failed rather than left running
+	abort := func(err error) {
+		if finishErr := finishRun(database, runID, manifest.Hooks, err); finishErr != nil {
+			runLogger.Error("Failed to record end of run", "run_id", runID, "error", finishErr)
+		}
+		waitForHooks()
+		panic(err)
+	}
+
+	steps, byName, err := registerSteps(manifest, database, enabledSteps)
+	if err != nil {
+		abort(err)
+	}
+
+	runLogger.Info("Registered steps", "count", len(manifest.Steps))
+
+	// Create pipeline with single FUSE server
+	pipeline, err := NewPipeline(&database)
+	if err != nil {
+		abort(err)
+	}
+	defer pipeline.fuseWatcher.Stop()
+
+	runLogger.Info("FUSE server started", "path", pipeline.GetFusePath())
+
+	if err := seedPipeline(ctx, database, pipeline, steps, byName); err != nil {
+		abort(err)
+	}
+
+	totalExecutions, err := runPasses(ctx, pipeline, steps, parallel)
+	if err != nil {
+		abort(err)
+	}
+
+	if err := finishRun(database, runID, manifest.Hooks, nil); err != nil {
+		panic(err)
+	}
+	waitForHooks()
+
+	duration := time.Since(startTime)
+	runLogger.Info("Pipeline complete", "run_id", runID, "tasks", totalExecutions, "duration", duration.Round(time.Millisecond))
+}
+
+// runInfo is what the tasks of a run need to know about it, carried in their context
+type runInfo struct {
+	id    int64
+	hooks Hooks
+}
+
+type runInfoKey struct{}
+
+// withRun returns a context for the tasks of a run, so they are linked to the
+// run and their failures fire its hooks
+func withRun(ctx context.Context, runID int64, hooks Hooks) context.Context {
+	return context.WithValue(ctx, runInfoKey{}, runInfo{runID, hooks})
+}
+
+// runIDFromContext returns the ID of the run ctx belongs to, or nil
+func runIDFromContext(ctx context.Context) *int64 {
+	if info, ok := ctx.Value(runInfoKey{}).(runInfo); ok {
+		return &info.id
+	}
+	return nil
+}
+
+// taskFailed records that a task of the run in ctx failed, firing its on_task_failure hook
+func taskFailed(ctx context.Context, database Database, taskID int64, step Step, errorMsg string) {
+	if info, ok := ctx.Value(runInfoKey{}).(runInfo); ok {
+		info.hooks.taskFailed(database, &info.id, taskID, step, errorMsg)
+	}
+}
+
+// finishRun records the end of a run and fires its on_success or on_failure hook
+func finishRun(database Database, runID int64, hooks Hooks, runErr error) error {
+	if err := database.FinishRun(runID, runErr); err != nil {
+		return err
+	}
+	hooks.runFinished(database, runID)
+	return nil
+}
+
+// beginRun records the start of a run of the manifest at manifestPath (and the
+// files it includes), with the command line of this process
+func beginRun(database Database, manifestPath string, vars map[string]string) (int64, error) {
+	manifest, err := readManifestSource(manifestPath, vars)
+	if err != nil {
+		return 0, err
+	}
+	host, _ := os.Hostname()
+	return database.StartRun(manifest, os.Args[1:], host, os.Getpid())
+}
+
+// registerSteps records the manifest's steps in the database (creating new versions
+// for changed steps) and returns the enabled ones, upstream first, and every step
+// by name, with the settings only the manifest has (compression, outputs and runner)
+func registerSteps(manifest Manifest, database Database, enabledSteps []string) ([]Step, map[string]Step, error) {
 	var steps []Step
+	byName := make(map[string]Step)
 	for _, manifestStep := range manifest.Steps {
+		compress, err := ParseCompression(manifestStep.Compress)
+		if err != nil {
+			return nil, nil, fmt.Errorf("step %s: %w", manifestStep.Name, err)
+		}
+		outputs, err := ParseOutputRules(manifestStep)
+		if err != nil {
+			return nil, nil, fmt.Errorf("step %s: %w", manifestStep.Name, err)
+		}
+		runner, err := ParseScriptRunner(manifestStep)
+		if err != nil {
+			return nil, nil, fmt.Errorf("step %s: %w", manifestStep.Name, err)
+		}
+
 		step := Step{
 			Name:     manifestStep.Name,
 			Script:   manifestStep.Script,
 			IsStart:  manifestStep.Start,
 			Parallel: manifestStep.Parallel,
 			Inputs:   manifestStep.Inputs,
+			Compress: compress,
+			Outputs:  outputs,
+			Params:   manifestStep.Params,
+			Runner:   runner,
+
+			scriptTemplate: manifestStep.ScriptTemplate,
 		}
 
 		id, err := database.CreateStep(step)
 		if err != nil {
-			panic(err)
+			return nil, nil, fmt.Errorf("step %s: %w", manifestStep.Name, err)
 		}
 		step.ID = id
+		stored, err := database.GetStep(id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("step %s: %w", manifestStep.Name, err)
+		}
+		step.Version = stored.Version
+		byName[step.Name] = step
 
-		// Filter to enabled steps if specified
+		// Filter to enabled steps if specified; naming a step with a matrix enables all its combinations
 		if len(enabledSteps) > 0 {
-			if slices.Contains(enabledSteps, step.Name) {
+			if slices.Contains(enabledSteps, step.Name) || manifestStep.MatrixStep != "" && slices.Contains(enabledSteps, manifestStep.MatrixStep) {
 				steps = append(steps, step)
 			}
 		} else {
@@ -37,87 +172,205 @@ func run(manifest Manifest, database Database, parallel int, startStepName strin
 		}
 	}
 
-	runLogger.Printf("Registered %d steps\n", len(manifest.Steps))
+	return orderSteps(manifest, steps), byName, nil
+}
 
-	// Create pipeline with single FUSE server
-	pipeline, err := NewPipeline(&database)
-	if err != nil {
-		panic(err)
+// orderSteps sorts steps so that each one comes after the steps writing its
+// inputs, as far as their declared or script outputs show, and otherwise keeps
+// manifest order. Steps in a cycle keep manifest order after the others.
+func orderSteps(manifest Manifest, steps []Step) []Step {
+	graph := buildStepGraph(manifest)
+	writers := make(map[string][]string) // resource name -> steps writing it
+	for _, edge := range graph.Edges {
+		if edge.Kind == "writes" {
+			writers[edge.To] = append(writers[edge.To], edge.From)
+		}
+	}
+	enabled := make(map[string]bool, len(steps))
+	for _, step := range steps {
+		enabled[step.Name] = true
+	}
+	upstream := make(map[string][]string)
+	for _, step := range graph.Steps {
+		for _, input := range step.Inputs {
+			for _, writer := range writers[input] {
+				if writer != step.Name && enabled[writer] {
+					upstream[step.Name] = append(upstream[step.Name], writer)
+				}
+			}
+		}
 	}
-	defer pipeline.fuseWatcher.Stop()
 
-	runLogger.Printf("FUSE server started at: %s\n", pipeline.GetFusePath())
+	ordered := make([]Step, 0, len(steps))
+	placed := make(map[string]bool, len(steps))
+	for len(ordered) < len(steps) {
+		progress := false
+		for _, step := range steps {
+			if placed[step.Name] || slices.ContainsFunc(upstream[step.Name], func(name string) bool { return !placed[name] }) {
+				continue
+			}
+			ordered = append(ordered, step)
+			placed[step.Name] = true
+			progress = true
+		}
+		if !progress {
+			for _, step := range steps {
+				if !placed[step.Name] {
+					ordered = append(ordered, step)
+				}
+			}
+			break
+		}
+	}
+	return ordered
+}
 
-	// Check if we need to seed
+// seedPipeline runs the start step once if the database has no resources yet
+func seedPipeline(ctx context.Context, database Database, pipeline *Pipeline, steps []Step, byName map[string]Step) error {
 	resourceCount, err := database.CountResources()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if resourceCount > 0 {
+		return nil
 	}
 
-	if resourceCount == 0 {
-		runLogger.Printf("No resources found, running seed step\n")
-		startStep, err := database.GetStartingStep()
-		if err != nil {
-			panic(err)
-		}
-		if startStep == nil {
-			panic("no start step found in manifest")
-		}
+	runLogger.Info("No resources found, running seed step")
+	startStep, err := database.GetStartingStep()
+	if err != nil {
+		return err
+	}
+	if startStep == nil {
+		return fmt.Errorf("no start step found in manifest")
+	}
+	startStep.Script = byName[startStep.Name].Script
+	startStep.Compress = byName[startStep.Name].Compress
+	startStep.Outputs = byName[startStep.Name].Outputs
+	startStep.Runner = byName[startStep.Name].Runner
 
-		// Create and execute seed task
-		seedTask := Task{
-			StepID:          startStep.ID,
-			InputResourceID: nil,
-			Processed:       false,
-		}
-		seedTaskID, err := database.CreateTask(seedTask)
-		if err != nil {
-			panic(err)
-		}
-		seedTask.ID = seedTaskID
+	// Create and execute seed task
+	seedTask := Task{
+		StepID:          startStep.ID,
+		InputResourceID: nil,
+		Processed:       false,
+	}
+	seedTaskID, err := database.CreateTask(seedTask)
+	if err != nil {
+		return err
+	}
+	seedTask.ID = seedTaskID
 
-		outputChan := database.MakeResourceConsumer()
+	ctx, ok := pipeline.startTask(ctx, seedTask.ID)
+	if !ok {
+		return nil
+	}
+	defer pipeline.finishTask(seedTask.ID)
 
-		executor := NewScriptExecutor(&database, pipeline)
-		execErr := executor.Execute(seedTask, *startStep, outputChan)
+	executor := NewScriptExecutor(&database, pipeline)
+	execErr := executor.Execute(ctx, seedTask, *startStep, pipeline.outputChan)
+	pipeline.WaitForOutputs()
 
-		close(outputChan)
+	var errorMsg *string
+	if ctx.Err() != nil {
+		msg := ErrTaskCancelled
+		errorMsg = &msg
+		runLogger.Warn("Seed task cancelled", "task_id", seedTask.ID, "step", startStep.Name)
+	} else if execErr != nil {
+		msg := execErr.Error()
+		errorMsg = &msg
+		runLogger.Error("Seed task failed", "task_id", seedTask.ID, "step", startStep.Name, "error", execErr)
+	}
 
-		var errorMsg *string
-		if execErr != nil {
-			msg := execErr.Error()
-			errorMsg = &msg
-			runLogger.Printf("Seed task failed: %v\n", execErr)
-		}
+	if err := database.UpdateTaskStatus(seedTask.ID, true, errorMsg); err != nil {
+		return err
+	}
+	if errorMsg != nil {
+		taskFailed(ctx, database, seedTask.ID, *startStep, *errorMsg)
+	}
 
-		err = database.UpdateTaskStatus(seedTask.ID, true, errorMsg)
-		if err != nil {
-			panic(err)
-		}
+	if execErr == nil {
+		runLogger.Debug("Seed task completed", "task_id", seedTask.ID, "step", startStep.Name)
+	}
 
-		if execErr == nil {
-			runLogger.Verbosef("Seed task completed\n")
+	if len(steps) > 1 {
+		database.ScheduleTasksForStep(steps[1].ID)
+	}
+	return nil
+}
+
+// executeSteps runs one pass over steps in order and waits for the outputs of
+// that pass to be committed, so the next pass can schedule tasks for them.
+// Before each step it waits for the outputs of the steps before it, so with
+// steps upstream first one pass runs everything their outputs lead to.
+func executeSteps(ctx context.Context, pipeline *Pipeline, steps []Step, parallel int) int64 {
+	var executions int64
+	for _, step := range steps {
+		if executions > 0 {
+			pipeline.WaitForOutputs()
 		}
+		n := pipeline.ExecuteStep(ctx, step, parallel)
+		executions += n
 
-		if len(steps) >= 1 {
-			database.ScheduleTasksForStep(steps[1].ID)
+		if n > 0 {
+			runLogger.Info("Executed tasks", "step", step.Name, "count", n)
 		}
 	}
 
-	// Execute all steps
-	var totalExecutions int64
-	for range 2 {
-		for _, step := range steps {
-			executions := pipeline.ExecuteStep(step, parallel)
-			totalExecutions += executions
+	pipeline.WaitForOutputs()
+	return executions
+}
 
-			if executions > 0 {
-				runLogger.Printf("Step %s: executed %d tasks\n", step.Name, executions)
-			}
+// maxPasses bounds the passes of a run: steps whose outputs lead back to their
+// own inputs can make new work for every pass
+const maxPasses = 100
+
+// runPasses runs passes over steps until one executes nothing. Steps are in
+// DAG order, so a pass takes new resources all the way down and passes only
+// repeat for the edges only the scripts know, or for cycles. A run still
+// finding work after maxPasses stops with an error naming the steps left with
+// pending tasks, which the next run picks up.
+func runPasses(ctx context.Context, pipeline *Pipeline, steps []Step, parallel int) (int64, error) {
+	return repeatPasses(maxPasses, func() int64 {
+		return executeSteps(ctx, pipeline, steps, parallel)
+	}, func() ([]string, error) {
+		return pendingSteps(*pipeline.db, steps)
+	})
+}
+
+// repeatPasses calls pass until it executes nothing, at most limit times, and
+// then reports the steps pending lists
+func repeatPasses(limit int, pass func() int64, pending func() ([]string, error)) (int64, error) {
+	var executions int64
+	for range limit {
+		n := pass()
+		executions += n
+		if n == 0 {
+			return executions, nil
 		}
 	}
 
+	steps, err := pending()
+	if err != nil {
+		return executions, err
+	}
+	return executions, fmt.Errorf("steps still had work after %d passes, their outputs may lead back to their inputs (pending tasks: %s)", limit, strings.Join(steps, ", "))
+}
 
-	duration := time.Since(startTime)
-	runLogger.Printf("Pipeline complete: %d tasks executed in %s\n", totalExecutions, duration.Round(time.Millisecond))
+// pendingSteps schedules the tasks steps have left and lists the steps with
+// unprocessed tasks, with their counts
+func pendingSteps(database Database, steps []Step) ([]string, error) {
+	var pending []string
+	for _, step := range steps {
+		if _, err := database.ScheduleTasksForStep(step.ID); err != nil {
+			return nil, err
+		}
+		n, err := database.CountUnprocessedTasksForStep(step.ID)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			pending = append(pending, fmt.Sprintf("%s (%d)", step.Name, n))
+		}
+	}
+	return pending, nil
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOrderSteps(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []ManifestStep
+		want  string // step names in order
+	}{
+		{
+			name: "listed downstream first",
+			steps: []ManifestStep{
+				{Name: "report", Inputs: []string{"clean"}, Script: "cat $INPUT_FILE > $OUTPUT_DIR/report"},
+				{Name: "clean", Inputs: []string{"raw"}, Script: "sort $INPUT_FILE > $OUTPUT_DIR/clean"},
+				{Name: "fetch", Start: true, Script: "date > $OUTPUT_DIR/raw"},
+			},
+			want: "fetch clean report",
+		},
+		{
+			name: "independent steps keep manifest order",
+			steps: []ManifestStep{
+				{Name: "b", Inputs: []string{"x"}, Script: "true"},
+				{Name: "a", Inputs: []string{"y"}, Script: "true"},
+			},
+			want: "b a",
+		},
+		{
+			name: "step reading its own output",
+			steps: []ManifestStep{
+				{Name: "refine", Inputs: []string{"raw", "refined"}, Script: "cp $INPUT_FILE $OUTPUT_DIR/refined"},
+				{Name: "fetch", Start: true, Script: "date > $OUTPUT_DIR/raw"},
+			},
+			want: "fetch refine",
+		},
+		{
+			name: "cycle",
+			steps: []ManifestStep{
+				{Name: "ping", Inputs: []string{"pong"}, Script: "cp $INPUT_FILE $OUTPUT_DIR/ping"},
+				{Name: "pong", Inputs: []string{"ping"}, Script: "cp $INPUT_FILE $OUTPUT_DIR/pong"},
+				{Name: "report", Inputs: []string{"ping"}, Script: "true"},
+				{Name: "fetch", Start: true, Script: "date > $OUTPUT_DIR/pong"},
+			},
+			want: "fetch ping pong report",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var steps []Step
+			for _, s := range tt.steps {
+				steps = append(steps, Step{Name: s.Name})
+			}
+			var got []string
+			for _, step := range orderSteps(Manifest{Steps: tt.steps}, steps) {
+				got = append(got, step.Name)
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepeatPasses(t *testing.T) {
+	tests := []struct {
+		name       string
+		work       []int64 // executions of each pass; passes after these find work again
+		executions int64
+		passes     int
+		err        bool
+	}{
+		{"nothing to do", []int64{0}, 0, 1, false},
+		{"settles", []int64{3, 1, 0}, 4, 3, false},
+		{"cycle", nil, 5, 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			passes := 0
+			pass := func() int64 {
+				passes++
+				if passes <= len(tt.work) {
+					return tt.work[passes-1]
+				}
+				return 1
+			}
+			pending := func() ([]string, error) { return []string{"ping (1)"}, nil }
+			executions, err := repeatPasses(5, pass, pending)
+			if executions != tt.executions || passes != tt.passes || (err != nil) != tt.err {
+				t.Fatalf("got %d executions in %d passes, %v", executions, passes, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "after 5 passes") || err != nil && !strings.Contains(err.Error(), "ping (1)") {
+				t.Errorf("got %v, want the pass limit and the pending steps", err)
+			}
+		})
+	}
+}
+
+func TestPendingStepsOfACycle(t *testing.T) {
+	database, err := NewDatabase(filepath.Join(t.TempDir(), "db"), DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	var steps []Step
+	for _, s := range []Step{
+		{Name: "ping", Script: "cp $INPUT_FILE $OUTPUT_DIR/ping", Inputs: []string{"pong"}},
+		{Name: "pong", Script: "cp $INPUT_FILE $OUTPUT_DIR/pong", Inputs: []string{"ping"}},
+		{Name: "idle", Script: "true", Inputs: []string{"nothing"}},
+	} {
+		if s.ID, err = database.CreateStep(s); err != nil {
+			t.Fatal(err)
+		}
+		steps = append(steps, s)
+	}
+	if _, err := database.CreateResource("pong", strings.Repeat("0", 64), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := pendingSteps(database, steps)
+	if err != nil || strings.Join(pending, ", ") != "ping (1)" {
+		t.Errorf("got %v, %v, want ping with one task", pending, err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ScriptRunner is how a step's script is run: by which shell or interpreter, in
+// which directory and with which environment. It is part of the step's version.
+type ScriptRunner struct {
+	Shell       []string          `json:"shell,omitempty"`       // runs SHELL... -c SCRIPT (default sh)
+	Interpreter []string          `json:"interpreter,omitempty"` // or INTERPRETER... FILE, with the script in FILE
+	Env         map[string]string `json:"env,omitempty"`         // added to grit's environment
+	ClearEnv    bool              `json:"clear_env,omitempty"`   // start from an empty environment instead
+	Workdir     string            `json:"workdir,omitempty"`     // as written in the manifest; grit's working directory if empty
+	WorkdirBase string            `json:"-"`                     // what a relative Workdir is relative to, on this machine
+
+	// env with {{env.NAME}} left as written: the version holds it rather than
+	// Env, so values from the environment never reach the database
+	envTemplate map[string]string
+}
+
+// reservedEnv are the variables grit sets for every script, which env cannot change
+var reservedEnv = []string{"INPUT_FILE", "OUTPUT_DIR"}
+
+// ParseScriptRunner reads the shell, interpreter, env, clear_env and workdir of
+// a manifest step. A shell or interpreter is a command line split on spaces, or
+// a list of arguments.
+func ParseScriptRunner(step ManifestStep) (ScriptRunner, error) {
+	runner := ScriptRunner{Env: step.Env, ClearEnv: step.ClearEnv, Workdir: step.Workdir, WorkdirBase: step.WorkdirBase, envTemplate: step.EnvTemplate}
+	if runner.envTemplate == nil {
+		runner.envTemplate = step.Env
+	}
+	var err error
+	if runner.Shell, err = parseArgv("shell", step.Shell); err != nil {
+		return runner, err
+	}
+	if runner.Interpreter, err = parseArgv("interpreter", step.Interpreter); err != nil {
+		return runner, err
+	}
+	if runner.Shell != nil && runner.Interpreter != nil {
+		return runner, fmt.Errorf("set shell or interpreter, not both")
+	}
+	for name := range step.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return runner, fmt.Errorf("invalid environment variable name %q", name)
+		}
+		if slices.Contains(reservedEnv, name) || strings.HasPrefix(name, "MATRIX_") {
+			return runner, fmt.Errorf("env cannot set %s, grit sets it", name)
+		}
+	}
+	return runner, nil
+}
+
+func parseArgv(key string, value any) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if argv := strings.Fields(value); len(argv) > 0 {
+			return argv, nil
+		}
+	case []any:
+		argv := make([]string, len(value))
+		for i, arg := range value {
+			s, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a string or a list of strings", key)
+			}
+			argv[i] = s
+		}
+		if len(argv) > 0 && argv[0] != "" {
+			return argv, nil
+		}
+	default:
+		return nil, fmt.Errorf("%s must be a string or a list of strings", key)
+	}
+	return nil, fmt.Errorf("%s is empty", key)
+}
+
+// version is what the runner adds to a step's version: "" for the default, so
+// steps recorded before runners existed keep their versions
+func (r ScriptRunner) version() string {
+	if r.Shell == nil && r.Interpreter == nil && len(r.Env) == 0 && !r.ClearEnv && r.Workdir == "" {
+		return ""
+	}
+	// Maps are encoded with sorted keys, so equal runners give equal strings.
+	// The env template keeps {{env.NAME}} and the workdir is as written, so
+	// neither secrets nor where the manifest is checked out change the version.
+	data, _ := json.Marshal(struct {
+		Shell       []string          `json:"shell,omitempty"`
+		Interpreter []string          `json:"interpreter,omitempty"`
+		Env         map[string]string `json:"env,omitempty"`
+		ClearEnv    bool              `json:"clear_env,omitempty"`
+		Workdir     string            `json:"workdir,omitempty"`
+	}{r.Shell, r.Interpreter, r.envTemplate, r.ClearEnv, r.Workdir})
+	return string(data)
+}
+
+// dir is the directory the script runs in, "" for grit's own
+func (r ScriptRunner) dir() string {
+	if r.Workdir == "" || filepath.IsAbs(r.Workdir) {
+		return r.Workdir
+	}
+	return filepath.Join(r.WorkdirBase, r.Workdir)
+}
+
+// relativeTo returns the runner for another machine with a checkout of dir:
+// a relative workdir is made relative to dir rather than the file the step is
+// in, for the other machine to resolve against its own checkout
+func (r ScriptRunner) relativeTo(dir string) ScriptRunner {
+	if r.Workdir != "" && !filepath.IsAbs(r.Workdir) {
+		if rel, err := filepath.Rel(dir, r.dir()); err == nil {
+			r.Workdir = rel
+		}
+	}
+	r.WorkdirBase = ""
+	return r
+}
+
+// command returns the command running script. An interpreter gets the script in
+// a temporary file, which cleanup removes.
+func (r ScriptRunner) command(ctx context.Context, script string) (cmd *exec.Cmd, cleanup func(), err error) {
+	if r.Interpreter == nil {
+		shell := r.Shell
+		if shell == nil {
+			shell = []string{"sh"}
+		}
+		args := append(slices.Clone(shell[1:]), "-c", script)
+		return exec.CommandContext(ctx, shell[0], args...), func() {}, nil
+	}
+
+	file, err := os.CreateTemp("", "script-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create script file: %w", err)
+	}
+	_, err = file.WriteString(script)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, nil, fmt.Errorf("failed to write script file: %w", err)
+	}
+	args := append(slices.Clone(r.Interpreter[1:]), file.Name())
+	return exec.CommandContext(ctx, r.Interpreter[0], args...), func() { os.Remove(file.Name()) }, nil
+}
+
+// environ is the environment of a script before grit adds its own variables
+func (r ScriptRunner) environ() []string {
+	var env []string
+	if !r.ClearEnv {
+		env = os.Environ()
+	}
+	names := make([]string, 0, len(r.Env))
+	for name := range r.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+r.Env[name])
+	}
+	return env
+}
+
+// resolveWorkdirs records the directory of the file each step is in, which a
+// relative workdir is relative to, and warns about workdirs that do not exist
+func (c *manifestChecker) resolveWorkdirs() {
+	for i := range c.manifest.Steps {
+		step := &c.manifest.Steps[i]
+		if step.Workdir == "" {
+			continue
+		}
+		step.WorkdirBase = absPath(filepath.Dir(c.steps[i].file))
+		dir := ScriptRunner{Workdir: step.Workdir, WorkdirBase: step.WorkdirBase}.dir()
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			c.warnf(c.steps[i], "workdir", "step %q: workdir %s is not a directory here", step.Name, dir)
+		}
+	}
+}
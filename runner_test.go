@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseScriptRunner(t *testing.T) {
+	tests := []struct {
+		name        string
+		step        ManifestStep
+		shell       []string
+		interpreter []string
+		err         string
+	}{
+		{"default", ManifestStep{}, nil, nil, ""},
+		{"shell line", ManifestStep{Shell: "bash -eu"}, []string{"bash", "-eu"}, nil, ""},
+		{"shell list", ManifestStep{Shell: []any{"bash", "-o", "pipefail"}}, []string{"bash", "-o", "pipefail"}, nil, ""},
+		{"interpreter", ManifestStep{Interpreter: "python3 -u"}, nil, []string{"python3", "-u"}, ""},
+		{"both", ManifestStep{Shell: "bash", Interpreter: "python3"}, nil, nil, "set shell or interpreter, not both"},
+		{"empty shell", ManifestStep{Shell: " "}, nil, nil, "shell is empty"},
+		{"empty interpreter list", ManifestStep{Interpreter: []any{""}}, nil, nil, "interpreter is empty"},
+		{"not strings", ManifestStep{Shell: []any{"bash", int64(1)}}, nil, nil, "shell must be a string or a list of strings"},
+		{"reserved env", ManifestStep{Env: map[string]string{"OUTPUT_DIR": "/tmp"}}, nil, nil, "env cannot set OUTPUT_DIR, grit sets it"},
+		{"matrix env", ManifestStep{Env: map[string]string{"MATRIX_SEED": "1"}}, nil, nil, "env cannot set MATRIX_SEED, grit sets it"},
+		{"invalid env name", ManifestStep{Env: map[string]string{"A=B": "1"}}, nil, nil, `invalid environment variable name "A=B"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, err := ParseScriptRunner(tt.step)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("got %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || !slices.Equal(runner.Shell, tt.shell) || !slices.Equal(runner.Interpreter, tt.interpreter) {
+				t.Errorf("got %+v, %v", runner, err)
+			}
+		})
+	}
+}
+
+func TestScriptRunnerVersion(t *testing.T) {
+	runner := func(step ManifestStep) ScriptRunner {
+		r, err := ParseScriptRunner(step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	secret := func(value string) ManifestStep {
+		return ManifestStep{
+			Env:         map[string]string{"TOKEN": value, "MODEL": "small"},
+			EnvTemplate: map[string]string{"TOKEN": "{{env.TOKEN}}", "MODEL": "small"},
+		}
+	}
+
+	tests := []struct {
+		name string
+		a, b ManifestStep
+		same bool
+	}{
+		{"secret from the environment", secret("hunter2"), secret("swordfish"), true},
+		{"env value", ManifestStep{Env: map[string]string{"MODEL": "small"}}, ManifestStep{Env: map[string]string{"MODEL": "large"}}, false},
+		{"shell spelling", ManifestStep{Shell: "bash -eu"}, ManifestStep{Shell: []any{"bash", "-eu"}}, true},
+		{"shell", ManifestStep{Shell: "bash"}, ManifestStep{Shell: "zsh"}, false},
+		{"clear env", ManifestStep{}, ManifestStep{ClearEnv: true}, false},
+		{"checkout location", ManifestStep{Workdir: "scripts", WorkdirBase: "/home/a/repo"}, ManifestStep{Workdir: "scripts", WorkdirBase: "/srv/repo"}, true},
+		{"workdir", ManifestStep{Workdir: "scripts"}, ManifestStep{Workdir: "tools"}, false},
+	}
+	for _, tt := range tests {
+		a, b := runner(tt.a).version(), runner(tt.b).version()
+		if (a == b) != tt.same {
+			t.Errorf("%s: got versions %s and %s, want equal %v", tt.name, a, b, tt.same)
+		}
+		for _, s := range []string{"hunter2", "swordfish", "/home/a", "/srv"} {
+			if strings.Contains(a+b, s) {
+				t.Errorf("%s: version holds %q: %s %s", tt.name, s, a, b)
+			}
+		}
+	}
+	if v := runner(ManifestStep{}).version(); v != "" {
+		t.Errorf("default runner: got version %q, want none", v)
+	}
+}
+
+func TestRelativeTo(t *testing.T) {
+	tests := []struct {
+		name    string
+		runner  ScriptRunner
+		dir     string
+		workdir string
+	}{
+		{"main manifest", ScriptRunner{Workdir: "scripts", WorkdirBase: "/repo"}, "/repo", "scripts"},
+		{"included file", ScriptRunner{Workdir: "scripts", WorkdirBase: "/repo/lib"}, "/repo", "lib/scripts"},
+		{"up from an included file", ScriptRunner{Workdir: "../data", WorkdirBase: "/repo/lib"}, "/repo", "data"},
+		{"absolute", ScriptRunner{Workdir: "/data", WorkdirBase: "/repo/lib"}, "/repo", "/data"},
+		{"none", ScriptRunner{WorkdirBase: "/repo/lib"}, "/repo", ""},
+	}
+	for _, tt := range tests {
+		got := tt.runner.relativeTo(tt.dir)
+		if got.Workdir != tt.workdir || got.WorkdirBase != "" {
+			t.Errorf("%s: got %+v, want workdir %q", tt.name, got, tt.workdir)
+		}
+		// The other machine resolves it against its own checkout
+		got.WorkdirBase = "/checkout"
+		if want := filepath.Join("/checkout", tt.workdir); tt.workdir != "" && !filepath.IsAbs(tt.workdir) && got.dir() != want {
+			t.Errorf("%s: resolved to %s, want %s", tt.name, got.dir(), want)
+		}
+	}
+}
+
+func TestScriptRunnerCommand(t *testing.T) {
+	t.Setenv("GRIT_TEST_INHERITED", "yes")
+	dir := t.TempDir()
+	tests := []struct {
+		name   string
+		runner ScriptRunner
+		script string
+		want   string
+	}{
+		{"default shell", ScriptRunner{}, "echo $((1 + 2))", "3"},
+		{"shell", ScriptRunner{Shell: []string{"sh", "-e"}}, "echo $-", "e"},
+		{"interpreter", ScriptRunner{Interpreter: []string{"sh"}}, `echo "$0"`, "script-"},
+		{"env", ScriptRunner{Env: map[string]string{"MODEL": "small"}}, "echo $MODEL $GRIT_TEST_INHERITED", "small yes"},
+		{"clear env", ScriptRunner{ClearEnv: true, Env: map[string]string{"MODEL": "small"}}, "echo $MODEL ${GRIT_TEST_INHERITED:-unset}", "small unset"},
+		{"workdir", ScriptRunner{Workdir: filepath.Base(dir), WorkdirBase: filepath.Dir(dir)}, "pwd", dir},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, cleanup, err := tt.runner.command(context.Background(), tt.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanup()
+			cmd.Dir = tt.runner.dir()
+			cmd.Env = tt.runner.environ()
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(out)); !strings.Contains(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The interpreter's script file is removed afterwards
+	cmd, cleanup, err := ScriptRunner{Interpreter: []string{"cat"}}.command(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := cmd.Args[len(cmd.Args)-1]
+	cleanup()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("script file %s left behind: %v", file, err)
+	}
+}
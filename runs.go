@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runsCommand lists past runs, newest first, or with `show ID` prints one run in
+// full: its command line, the manifest it used and the tasks it executed.
+func runsCommand(args []string) {
+	fs := flag.NewFlagSet("runs", flag.ExitOnError)
+	addLogFlags(fs)
+	dbFlags := addDatabaseFlags(fs)
+	limit := fs.Int("limit", 20, "number of runs to list (0 for all)")
+	since := fs.String("since", "", "only list runs started at or after this UTC time (2006-01-02 or 2006-01-02 15:04:05)")
+	commandUsage(fs, "runs [-db PATH] [--limit N] [--since TIME]\n       grit runs show [-db PATH] ID")
+	positional := parseArgs(fs, args)
+
+	var showID int64
+	switch {
+	case len(positional) == 0:
+	case len(positional) == 2 && positional[0] == "show":
+		id, err := strconv.ParseInt(positional[1], 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid run id %q\n", positional[1])
+			os.Exit(2)
+		}
+		showID = id
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	database := dbFlags.open(DatabaseOptions{ReadOnly: true})
+	defer database.Close()
+
+	if showID != 0 {
+		showRun(database, showID)
+		return
+	}
+
+	runs, err := database.ListRuns(*limit, *since)
+	if err != nil {
+		fatal("Failed to list runs", "error", err)
+	}
+	if len(runs) == 0 {
+		fmt.Println("No runs recorded")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tSTARTED (UTC)\tDURATION\tOUTCOME\tTASKS\tFAILED\tHOST\tCOMMAND")
+	for _, r := range runs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			r.ID, formatRunTime(r.StartedAt), runDuration(r), r.Outcome, r.TasksExecuted, r.TasksFailed, r.Host, strings.Join(r.Args, " "))
+	}
+	w.Flush()
+}
+
+func showRun(database Database, id int64) {
+	run, err := database.GetRun(id)
+	if err != nil {
+		fatal("Failed to get run", "run_id", id, "error", err)
+	}
+	if run == nil {
+		fatal("Run not found", "run_id", id)
+	}
+	steps, err := database.ListRunSteps(id)
+	if err != nil {
+		fatal("Failed to count tasks of run", "run_id", id, "error", err)
+	}
+
+	finished := ""
+	if run.FinishedAt != nil {
+		finished = formatRunTime(*run.FinishedAt)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Run:\t%d\n", run.ID)
+	fmt.Fprintf(w, "Outcome:\t%s\n", run.Outcome)
+	if run.Error != nil {
+		fmt.Fprintf(w, "Error:\t%s\n", *run.Error)
+	}
+	fmt.Fprintf(w, "Started (UTC):\t%s\n", formatRunTime(run.StartedAt))
+	fmt.Fprintf(w, "Finished (UTC):\t%s\n", finished)
+	fmt.Fprintf(w, "Duration:\t%s\n", runDuration(*run))
+	fmt.Fprintf(w, "Host:\t%s (pid %d)\n", run.Host, run.PID)
+	fmt.Fprintf(w, "Command:\tgrit %s\n", strings.Join(run.Args, " "))
+	fmt.Fprintf(w, "Tasks:\t%d executed, %d failed\n", run.TasksExecuted, run.TasksFailed)
+	fmt.Fprintf(w, "Manifest:\tsha256:%s\n", run.ManifestHash)
+	w.Flush()
+
+	if len(steps) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "STEP\tVERSION\tTASKS\tFAILED\tCANCELLED")
+		for _, st := range steps {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", st.StepName, st.StepVersion, st.Tasks, st.Failed, st.Cancelled)
+		}
+		w.Flush()
+	}
+
+	failed, err := database.FindTasks(TaskFilter{Run: id, State: TaskFailed})
+	if err != nil {
+		fatal("Failed to list failed tasks of run", "run_id", id, "error", err)
+	}
+	if len(failed) > 0 {
+		slices.Reverse(failed)
+		fmt.Printf("\nFailed tasks: ")
+		for i, t := range failed {
+			if i > 0 {
+				fmt.Print(", ")
+			}
+			fmt.Print(t.ID)
+		}
+		fmt.Println(" (see grit dashboard or /api/tasks/ID/log for their output)")
+	}
+
+	fmt.Printf("\n--- manifest ---\n%s", run.Manifest)
+	if !strings.HasSuffix(run.Manifest, "\n") {
+		fmt.Println()
+	}
+}
+
+// formatRunTime drops the milliseconds of a stored timestamp
+func formatRunTime(timestamp string) string {
+	if len(timestamp) > len(time.DateTime) {
+		return timestamp[:len(time.DateTime)]
+	}
+	return timestamp
+}
+
+// runDuration is how long a finished run took, or how long it has been running
+func runDuration(r Run) string {
+	if r.Outcome == RunInterrupted {
+		return ""
+	}
+	start := parseResourceTime(r.StartedAt)
+	end := time.Now()
+	if r.FinishedAt != nil {
+		end = parseResourceTime(*r.FinishedAt)
+	}
+	return formatMillis(end.Sub(start).Milliseconds())
+}
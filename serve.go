@@ -0,0 +1,1108 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var serveLogger = NewLogger("SERVE")
+
+// serveCommand keeps the database and FUSE server resident and exposes them over
+// an HTTP/JSON API, so other programs can drive grit without shelling out.
+func serveCommand(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addLogFlags(fs)
+	dbFlags := addDatabaseFlags(fs)
+	manifestPath := fs.String("manifest", "", "manifest path, re-read at the start of every run (required)")
+	listen := fs.String("listen", "127.0.0.1:8420", "address to listen on: HOST:PORT or unix:PATH")
+	parallel := fs.Int("parallel", runtime.NumCPU(), "number of processes to run in parallel")
+	var enabledSteps stringSlice
+	fs.Var(&enabledSteps, "step", "steps to run (can be used multiple times)")
+	vars := addVarFlag(fs)
+	remoteWorkers := fs.Bool("remote-workers", false, "hand tasks to grit worker processes instead of running them here")
+	leaseTTL := fs.Duration("lease-ttl", 30*time.Second, "how long a remote worker's task lease lasts without a heartbeat")
+	token := addTokenFlag(fs)
+	traceSpec := fs.String("trace", "", "export trace spans of runs, steps and tasks: otlp, http://HOST:PORT (OTLP collector) or file:PATH (JSON)")
+	metricsAddr := fs.String("metrics-addr", "", "serve Prometheus metrics at /metrics on this address: HOST:PORT or unix:PATH")
+	commandUsage(fs, "serve -manifest PATH [-db PATH] [--listen 127.0.0.1:8420|unix:PATH] [--token TOKEN] [--remote-workers]")
+	fs.Parse(args)
+
+	if *manifestPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	*token = apiToken(*token, *listen)
+
+	manifest, err := LoadManifest(*manifestPath, vars)
+	if err != nil {
+		fatal("Failed to load manifest", "path", *manifestPath, "error", err)
+	}
+
+	storeSpec := *dbFlags.objectStore
+	if storeSpec == "" {
+		storeSpec = manifest.ObjectStore
+	}
+	database := dbFlags.open(DatabaseOptions{ObjectStore: storeSpec})
+	defer database.Close()
+
+	if _, _, err := registerSteps(manifest, database, enabledSteps); err != nil {
+		fatal("Failed to register steps", "error", err)
+	}
+	if *metricsAddr != "" {
+		if err := serveMetrics(*metricsAddr, &database); err != nil {
+			fatal("Failed to serve metrics", "address", *metricsAddr, "error", err)
+		}
+	}
+	if *traceSpec != "" {
+		shutdown, err := setupTracing(*traceSpec)
+		if err != nil {
+			fatal("Failed to set up tracing", "error", err)
+		}
+		defer shutdown()
+	}
+
+	api := &apiServer{
+		database:     database,
+		manifestPath: *manifestPath,
+		vars:         vars,
+		parallel:     *parallel,
+		enabledSteps: enabledSteps,
+		token:        *token,
+		listen:       *listen,
+	}
+	if *remoteWorkers {
+		// Workers upload their outputs, so the coordinator needs no FUSE mount
+		api.coordinator = NewCoordinator(&database, *leaseTTL)
+	} else {
+		pipeline, err := NewPipeline(&database)
+		if err != nil {
+			fatal("Failed to start FUSE server", "error", err)
+		}
+		defer pipeline.fuseWatcher.Stop()
+		pipeline.ProcessGroups = true
+		api.pipeline = pipeline
+	}
+
+	listener, err := listenAPI(*listen)
+	if err != nil {
+		fatal("Failed to listen", "address", *listen, "error", err)
+	}
+	server := &http.Server{Handler: api.routes()}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		serveLogger.Info("Shutting down")
+		if api.coordinator != nil {
+			// Ends waiting lease requests, which would otherwise hold up the shutdown
+			api.coordinator.Shutdown()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	serveLogger.Info("API and dashboard listening", "url", dashboardURL(*listen))
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		serveLogger.Error("Server error", "error", err)
+	}
+
+	// Stop a run in progress before the FUSE server and database go away
+	if api.pipeline != nil {
+		api.pipeline.Shutdown()
+	} else {
+		api.coordinator.Shutdown()
+	}
+	api.runs.Wait()
+	waitForHooks()
+}
+
+// listenAPI listens on a TCP address or, for unix:PATH, a socket only the current user can use
+func listenAPI(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		// Remove a stale socket from a previous server, but nothing else that
+		// happens to be at path
+		if info, err := os.Lstat(path); err == nil {
+			if info.Mode().Type() != os.ModeSocket {
+				return nil, fmt.Errorf("%s exists and is not a socket", path)
+			}
+			os.Remove(path)
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		return listener, os.Chmod(path, 0600)
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, err
+	}
+	return net.Listen("tcp", address)
+}
+
+func addTokenFlag(fs *flag.FlagSet) *string {
+	return fs.String("token", "", "token every request must present (defaults to $GRIT_TOKEN), required on a non-loopback address")
+}
+
+// apiToken returns the --token flag, or $GRIT_TOKEN without it. Exits if there
+// is none and the API would be served on a non-loopback address.
+func apiToken(token, listen string) string {
+	if token == "" {
+		token = os.Getenv("GRIT_TOKEN")
+	}
+	if token == "" && !isLoopbackAddress(listen) {
+		fatal("Serving on a non-loopback address needs a token (--token or $GRIT_TOKEN)", "address", listen)
+	}
+	return token
+}
+
+// isLoopbackAddress reports whether only this machine can connect to address
+func isLoopbackAddress(address string) bool {
+	if strings.HasPrefix(address, "unix:") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+type apiServer struct {
+	database     Database
+	pipeline     *Pipeline    // runs tasks locally
+	coordinator  *Coordinator // hands tasks to remote workers instead
+	manifestPath string
+	vars         map[string]string // -var overrides, applied every time the manifest is re-read
+	parallel     int
+	enabledSteps []string
+	token        string // token every route requires, if set, see checkToken
+	listen       string // --listen address, see checkHost
+
+	mu         sync.Mutex
+	currentRun int64 // ID of the run started through the API that is in progress, or 0
+	runs       sync.WaitGroup
+}
+
+// routes registers the API and the dashboard. Without a pipeline or coordinator
+// the server is read-only and the routes that change state are left out.
+func (s *apiServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", s.handleStatus)
+	mux.HandleFunc("GET /api/steps", s.handleSteps)
+	mux.HandleFunc("GET /api/graph", s.handleGraph)
+	mux.HandleFunc("GET /api/tasks", s.handleTasks)
+	mux.HandleFunc("GET /api/tasks/{id}", s.handleTask)
+	mux.HandleFunc("GET /api/tasks/{id}/log", s.handleTaskLog)
+	mux.HandleFunc("GET /api/resources", s.handleResources)
+	mux.HandleFunc("GET /api/resource-names", s.handleResourceNames)
+	mux.HandleFunc("GET /api/objects/{hash}", s.handleObject)
+	mux.HandleFunc("GET /api/runs", s.handleRuns)
+	mux.HandleFunc("GET /api/runs/latest", s.handleLatestRun)
+	mux.HandleFunc("GET /api/runs/{id}", s.handleRun)
+	if !s.readOnly() {
+		mux.HandleFunc("POST /api/tasks/{id}/cancel", s.handleCancelTask)
+		mux.HandleFunc("POST /api/resources", s.handleCreateResource)
+		mux.HandleFunc("POST /api/runs", s.handleStartRun)
+	}
+	if s.coordinator != nil {
+		mux.HandleFunc("GET /api/leases", s.handleLeases)
+		mux.HandleFunc("POST /api/leases", s.handleLease)
+		mux.HandleFunc("POST /api/leases/{id}/heartbeat", s.handleHeartbeat)
+		mux.HandleFunc("POST /api/leases/{id}/complete", s.handleCompleteLease)
+		mux.HandleFunc("DELETE /api/leases/{id}", s.handleReleaseLease)
+	}
+	mux.Handle("GET /", dashboardHandler())
+	return s.checkHost(s.checkToken(checkMutations(mux)))
+}
+
+// checkHost refuses requests for a host name that is not the server's, so a
+// web page that rebinds its own name to this machine cannot use the API through
+// a browser: loopback names are allowed, and the --listen host. A server
+// listening on every address takes any name, as it needs a token anyway; a
+// Unix socket cannot be reached by a browser.
+func (s *apiServer) checkHost(next http.Handler) http.Handler {
+	if strings.HasPrefix(s.listen, "unix:") {
+		return next
+	}
+	listenHost, _, _ := net.SplitHostPort(s.listen)
+	if s.listen != "" && (listenHost == "" || net.ParseIP(listenHost).IsUnspecified()) {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		ip := net.ParseIP(host)
+		if !strings.EqualFold(host, "localhost") && !(ip != nil && ip.IsLoopback()) && !(listenHost != "" && strings.EqualFold(host, listenHost)) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("requests for host %s are not allowed", r.Host))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkToken refuses requests without the server's token, when one is set.
+// Workers and scripts send it as a bearer token; a browser asks for it as
+// the password of the dashboard, with any user name.
+func (s *apiServer) checkToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !bearer {
+				_, token, _ = r.BasicAuth()
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="grit"`)
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or wrong token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiClientHeader marks a request that changes state as coming from a grit
+// client rather than a page in a browser, which cannot set it cross-origin
+// without a preflight the API never grants
+const apiClientHeader = "X-Grit-Client"
+
+// checkMutations refuses requests that change state unless they come from the
+// dashboard's own origin (or no browser at all) and are JSON or carry
+// apiClientHeader, so that other web pages cannot start runs, cancel tasks or
+// store resources through a browser on the same machine
+func checkMutations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Host != r.Host {
+				writeError(w, http.StatusForbidden, fmt.Errorf("requests from origin %s are not allowed", origin))
+				return
+			}
+		}
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" && r.Header.Get(apiClientHeader) == "" {
+			writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("%s requests need Content-Type: application/json or an %s header", r.Method, apiClientHeader))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type apiRun struct {
+	ID            int64        `json:"id"`
+	StartedAt     string       `json:"started_at"`
+	FinishedAt    *string      `json:"finished_at,omitempty"`
+	Outcome       string       `json:"outcome"` // running, succeeded, failed or interrupted
+	Error         *string      `json:"error,omitempty"`
+	TasksExecuted int64        `json:"tasks_executed"`
+	TasksFailed   int64        `json:"tasks_failed"`
+	Host          string       `json:"host"`
+	PID           int          `json:"pid"`
+	Args          []string     `json:"args"`
+	ManifestHash  string       `json:"manifest_hash"`
+	Manifest      string       `json:"manifest,omitempty"` // run details only
+	Steps         []apiRunStep `json:"steps,omitempty"`    // run details only
+}
+
+type apiRunStep struct {
+	Step      string `json:"step"`
+	Version   int    `json:"version"`
+	Tasks     int64  `json:"tasks"`
+	Failed    int64  `json:"failed"`
+	Cancelled int64  `json:"cancelled"`
+}
+
+type apiStep struct {
+	ID      int64    `json:"id"`
+	Name    string   `json:"name"`
+	Version int      `json:"version"`
+	IsStart bool     `json:"is_start"`
+	Inputs  []string `json:"inputs"`
+	Script  string   `json:"script,omitempty"`
+	Tasks   int64    `json:"tasks"`
+	Done    int64    `json:"done"`
+	Failed  int64    `json:"failed"`
+	Pending int64    `json:"pending"`
+}
+
+type apiTask struct {
+	ID          int64         `json:"id"`
+	Step        string        `json:"step"`
+	StepVersion int           `json:"step_version"`
+	State       string        `json:"state"`            // pending, running, succeeded, failed or cancelled
+	Worker      string        `json:"worker,omitempty"` // remote worker running the task
+	Error       *string       `json:"error,omitempty"`
+	StartedAt   *string       `json:"started_at,omitempty"`
+	FinishedAt  *string       `json:"finished_at,omitempty"`
+	Host        string        `json:"host,omitempty"` // where the task last ran
+	PID         int           `json:"pid,omitempty"`
+	Usage       *TaskUsage    `json:"usage,omitempty"`  // time and resources of the last run
+	RunID       *int64        `json:"run_id,omitempty"` // the run that last started the task
+	InputID     *int64        `json:"input_resource_id,omitempty"`
+	Input       *apiResource  `json:"input,omitempty"`   // task details only
+	Outputs     []apiResource `json:"outputs,omitempty"` // task details only
+}
+
+type apiResource struct {
+	ID         int64          `json:"id"`
+	Name       string         `json:"name"`
+	Hash       string         `json:"hash"`
+	CreatedAt  string         `json:"created_at"`
+	Source     string         `json:"source,omitempty"`
+	Filename   string         `json:"filename,omitempty"`    // for task outputs
+	ProducedBy []exportOrigin `json:"produced_by,omitempty"` // for resource listings
+}
+
+func (s *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	resources, err := s.database.CountResources()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	complete, total, processed, err := s.database.GetPipelineStatus()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.mu.Lock()
+	running := s.currentRun != 0
+	s.mu.Unlock()
+
+	// The last run of any process using the database, not only of this server
+	var run *apiRun
+	runs, err := s.database.ListRuns(1, "")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(runs) > 0 {
+		r := describeRun(runs[0])
+		run = &r
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"running":   running,
+		"complete":  complete,
+		"tasks":     total,
+		"processed": processed,
+		"resources": resources,
+		"last_run":  run,
+		"read_only": s.readOnly(),
+	})
+}
+
+func (s *apiServer) handleSteps(w http.ResponseWriter, r *http.Request) {
+	steps := []apiStep{}
+	for step := range s.database.ListSteps() {
+		steps = append(steps, apiStep{
+			ID:      step.ID,
+			Name:    step.Name,
+			Version: step.Version,
+			IsStart: step.IsStart,
+			Inputs:  step.Inputs,
+			Script:  step.Script,
+		})
+	}
+
+	for i := range steps {
+		if err := s.countTasks(&steps[i]); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, steps)
+}
+
+type apiGraph struct {
+	Steps []apiStep `json:"steps"` // latest version of each step
+	Edges []apiEdge `json:"edges"`
+}
+
+// apiEdge connects a step that has produced a resource name to a step that takes it as input
+type apiEdge struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Resource string `json:"resource"`
+}
+
+func (s *apiServer) handleGraph(w http.ResponseWriter, r *http.Request) {
+	graph := apiGraph{Steps: []apiStep{}, Edges: []apiEdge{}}
+	latest := make(map[string]int)
+	for step := range s.database.ListSteps() {
+		node := apiStep{
+			ID:      step.ID,
+			Name:    step.Name,
+			Version: step.Version,
+			IsStart: step.IsStart,
+			Inputs:  step.Inputs,
+		}
+		if i, ok := latest[step.Name]; !ok {
+			latest[step.Name] = len(graph.Steps)
+			graph.Steps = append(graph.Steps, node)
+		} else if step.Version > graph.Steps[i].Version {
+			graph.Steps[i] = node
+		}
+	}
+
+	for i := range graph.Steps {
+		if err := s.countTasks(&graph.Steps[i]); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// Steps declare their inputs but not their outputs, so edges come from what
+	// each step has actually produced so far
+	outputs, err := s.database.ListStepOutputNames()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, consumer := range graph.Steps {
+		for _, input := range consumer.Inputs {
+			for _, producer := range graph.Steps {
+				if slices.Contains(outputs[producer.Name], input) {
+					graph.Edges = append(graph.Edges, apiEdge{From: producer.Name, To: consumer.Name, Resource: input})
+				}
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, graph)
+}
+
+// countTasks fills in the task counts of a step version
+func (s *apiServer) countTasks(step *apiStep) error {
+	total, processed, err := s.database.GetTaskCountsForStep(step.ID)
+	if err != nil {
+		return err
+	}
+	failed, err := s.database.CountFailedTasksForStep(step.ID)
+	if err != nil {
+		return err
+	}
+	step.Tasks, step.Done, step.Failed, step.Pending = total, processed-failed, failed, total-processed
+	return nil
+}
+
+func (s *apiServer) handleTasks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), 100)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	run, err := queryInt(query.Get("run"), 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tasks, err := s.database.FindTasks(TaskFilter{Step: query.Get("step"), State: query.Get("state"), Run: int64(run), Limit: limit})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	steps := s.stepsByID()
+	result := make([]apiTask, 0, len(tasks))
+	for _, task := range tasks {
+		result = append(result, s.describeTask(task, steps))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *apiServer) handleTask(w http.ResponseWriter, r *http.Request) {
+	task, ok := s.lookupTask(w, r)
+	if !ok {
+		return
+	}
+
+	result := s.describeTask(*task, s.stepsByID())
+	if task.InputResourceID != nil {
+		input, err := s.database.GetResource(*task.InputResourceID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if input != nil {
+			result.Input = &apiResource{ID: input.ID, Name: input.Name, Hash: input.ObjectHash, CreatedAt: input.CreatedAt}
+		}
+	}
+
+	outputs, err := s.database.GetTaskOutputs(task.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, o := range outputs {
+		result.Outputs = append(result.Outputs, apiResource{
+			ID:        o.Resource.ID,
+			Name:      o.Resource.Name,
+			Hash:      o.Resource.ObjectHash,
+			CreatedAt: o.Resource.CreatedAt,
+			Filename:  o.Filename,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleTaskLog returns the captured stdout and stderr of a task's script as text
+func (s *apiServer) handleTaskLog(w http.ResponseWriter, r *http.Request) {
+	task, ok := s.lookupTask(w, r)
+	if !ok {
+		return
+	}
+
+	output, err := s.database.GetTaskLog(task.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, output)
+}
+
+func (s *apiServer) handleCancelTask(w http.ResponseWriter, r *http.Request) {
+	task, ok := s.lookupTask(w, r)
+	if !ok {
+		return
+	}
+
+	var cancelled bool
+	var err error
+	if s.coordinator != nil {
+		cancelled, err = s.coordinator.CancelTask(task.ID)
+	} else {
+		cancelled, err = s.pipeline.CancelTask(task.ID)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !cancelled {
+		writeError(w, http.StatusConflict, fmt.Errorf("task %d has already finished", task.ID))
+		return
+	}
+
+	serveLogger.Info("Cancelled task", "task_id", task.ID)
+	writeJSON(w, http.StatusAccepted, map[string]any{"id": task.ID, "cancelled": true})
+}
+
+func (s *apiServer) handleResources(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), 100)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	filter := ResourceFilter{Step: query.Get("step"), LatestVersion: query.Get("latest_version") == "true"}
+	if name := query.Get("name"); name != "" {
+		filter.Names = []string{name}
+	}
+	found, err := s.database.FindResources(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// FindResources returns one row per producing task; merge them per resource
+	resources := []apiResource{}
+	byID := make(map[int64]int)
+	for _, l := range found {
+		i, ok := byID[l.Resource.ID]
+		if !ok {
+			if limit > 0 && len(resources) == limit {
+				continue
+			}
+			i = len(resources)
+			byID[l.Resource.ID] = i
+			resources = append(resources, apiResource{
+				ID:        l.Resource.ID,
+				Name:      l.Resource.Name,
+				Hash:      l.Resource.ObjectHash,
+				CreatedAt: l.Resource.CreatedAt,
+				Source:    l.Resource.Source,
+			})
+		}
+		if l.Origin != nil {
+			resources[i].ProducedBy = append(resources[i].ProducedBy, exportOrigin{
+				Step:        l.Origin.StepName,
+				StepVersion: l.Origin.StepVersion,
+				TaskID:      l.Origin.TaskID,
+				Filename:    l.Origin.Filename,
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resources)
+}
+
+func (s *apiServer) handleResourceNames(w http.ResponseWriter, r *http.Request) {
+	names, err := s.database.ListResourceNames()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	writeJSON(w, http.StatusOK, names)
+}
+
+// handleCreateResource stores the request body as a resource, like grit import
+func (s *apiServer) handleCreateResource(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("name is required"))
+		return
+	}
+	if err := checkResourceName(name); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid resource name %q: %w", name, err))
+		return
+	}
+	mode, err := ParseCompression(query.Get("compress"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id, hash, err := s.database.ImportResource(name, r.Body, query.Get("source"), mode)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	serveLogger.Debug("Created resource", "resource", name, "hash", hash)
+	writeJSON(w, http.StatusCreated, apiResource{ID: id, Name: name, Hash: hash, Source: query.Get("source")})
+}
+
+func (s *apiServer) handleObject(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	data, err := s.database.GetObject(hash)
+	if errors.Is(err, ErrObjectNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("object %s not found", hash))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("ETag", `"`+hash+`"`)
+	if name := r.URL.Query().Get("download"); name != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+	}
+	w.Write(data)
+}
+
+func (s *apiServer) handleStartRun(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	if s.currentRun != 0 {
+		runID := s.currentRun
+		s.mu.Unlock()
+		s.writeRun(w, http.StatusConflict, runID)
+		return
+	}
+
+	runID, err := beginRun(s.database, s.manifestPath, s.vars)
+	if err != nil {
+		s.mu.Unlock()
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.currentRun = runID
+	s.runs.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.runs.Done()
+		start := time.Now()
+		executed, hooks, err := s.execute(runID)
+		if finishErr := finishRun(s.database, runID, hooks, err); finishErr != nil {
+			serveLogger.Error("Failed to record end of run", "run_id", runID, "error", finishErr)
+		}
+
+		s.mu.Lock()
+		s.currentRun = 0
+		s.mu.Unlock()
+		if err != nil {
+			serveLogger.Error("Run failed", "run_id", runID, "error", err)
+		} else {
+			serveLogger.Info("Run complete", "run_id", runID, "tasks", executed, "duration", time.Since(start).Round(time.Millisecond))
+		}
+	}()
+
+	s.writeRun(w, http.StatusAccepted, runID)
+}
+
+func (s *apiServer) handleRuns(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), 100)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	runs, err := s.database.ListRuns(limit, query.Get("since"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	result := make([]apiRun, 0, len(runs))
+	for _, run := range runs {
+		result = append(result, describeRun(run))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *apiServer) handleLatestRun(w http.ResponseWriter, r *http.Request) {
+	runs, err := s.database.ListRuns(1, "")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(runs) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no run has been started"))
+		return
+	}
+	writeJSON(w, http.StatusOK, describeRun(runs[0]))
+}
+
+func (s *apiServer) handleRun(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid run id %q", r.PathValue("id")))
+		return
+	}
+	s.writeRun(w, http.StatusOK, id)
+}
+
+// writeRun responds with the details of a run, including its manifest and the
+// tasks it executed by step
+func (s *apiServer) writeRun(w http.ResponseWriter, status int, id int64) {
+	run, err := s.database.GetRun(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if run == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("run %d not found", id))
+		return
+	}
+	steps, err := s.database.ListRunSteps(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	result := describeRun(*run)
+	result.Manifest = run.Manifest
+	for _, st := range steps {
+		result.Steps = append(result.Steps, apiRunStep{Step: st.StepName, Version: st.StepVersion, Tasks: st.Tasks, Failed: st.Failed, Cancelled: st.Cancelled})
+	}
+	writeJSON(w, status, result)
+}
+
+func describeRun(run Run) apiRun {
+	return apiRun{
+		ID:            run.ID,
+		StartedAt:     run.StartedAt,
+		FinishedAt:    run.FinishedAt,
+		Outcome:       run.Outcome,
+		Error:         run.Error,
+		TasksExecuted: run.TasksExecuted,
+		TasksFailed:   run.TasksFailed,
+		Host:          run.Host,
+		PID:           run.PID,
+		Args:          run.Args,
+		ManifestHash:  run.ManifestHash,
+	}
+}
+
+// apiLease is a task leased to a remote worker, with everything needed to run it
+type apiLease struct {
+	ID          string            `json:"lease_id"`
+	TaskID      int64             `json:"task_id"`
+	Step        string            `json:"step"`
+	StepVersion int               `json:"step_version"`
+	Script      string            `json:"script,omitempty"`
+	Params      []MatrixParam     `json:"params,omitempty"` // matrix parameters, set as MATRIX_NAME
+	Runner      ScriptRunner      `json:"runner"`           // shell or interpreter, environment and working directory relative to the manifest
+	Input       *apiResource      `json:"input,omitempty"`
+	Worker      string            `json:"worker"`
+	StartedAt   time.Time         `json:"started_at"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+	TTLSeconds  float64           `json:"ttl_seconds"`
+	Trace       map[string]string `json:"trace,omitempty"` // W3C trace context of the task's span, for TRACEPARENT
+}
+
+// apiTaskResult is the first part of a worker's completion upload
+type apiTaskResult struct {
+	Error *string    `json:"error"`
+	Log   string     `json:"log"`
+	Usage *TaskUsage `json:"usage,omitempty"` // nil if the script did not run
+}
+
+func (s *apiServer) describeLease(lease Lease) apiLease {
+	l := apiLease{
+		ID:          lease.ID,
+		TaskID:      lease.Task.ID,
+		Step:        lease.Step.Name,
+		StepVersion: lease.Step.Version,
+		Script:      lease.Step.Script,
+		Params:      lease.Step.Params,
+		Runner:      lease.Step.Runner.relativeTo(absPath(filepath.Dir(s.manifestPath))),
+		Worker:      lease.Worker,
+		StartedAt:   lease.Started,
+		ExpiresAt:   lease.Expires,
+		TTLSeconds:  s.coordinator.ttl.Seconds(),
+		Trace:       lease.Trace,
+	}
+	if lease.Input != nil {
+		l.Input = &apiResource{ID: lease.Input.ID, Name: lease.Input.Name, Hash: lease.Input.ObjectHash, CreatedAt: lease.Input.CreatedAt}
+	}
+	return l
+}
+
+func (s *apiServer) handleLeases(w http.ResponseWriter, r *http.Request) {
+	leases := []apiLease{}
+	for _, lease := range s.coordinator.Leases() {
+		l := s.describeLease(lease)
+		l.Script = ""
+		l.Runner = ScriptRunner{} // its env may hold secrets
+		leases = append(leases, l)
+	}
+	writeJSON(w, http.StatusOK, leases)
+}
+
+// handleLease hands a task to a worker, waiting a while for one to become available.
+// Responds 204 if there is none.
+func (s *apiServer) handleLease(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Worker string `json:"worker"`
+		Host   string `json:"host"`
+		PID    int    `json:"pid"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Worker == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("expected a JSON body with a worker name"))
+		return
+	}
+
+	lease, err := s.coordinator.Lease(request.Worker, request.Host, request.PID, r.Context().Done())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if lease == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.describeLease(*lease))
+}
+
+func (s *apiServer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if !s.coordinator.Heartbeat(r.PathValue("id")) {
+		writeError(w, http.StatusGone, ErrLeaseNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiServer) handleReleaseLease(w http.ResponseWriter, r *http.Request) {
+	if !s.coordinator.Release(r.PathValue("id")) {
+		writeError(w, http.StatusGone, ErrLeaseNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCompleteLease records a worker's result: a multipart body with a "result"
+// part (apiTaskResult) followed by an "output" file part per output
+func (s *apiServer) handleCompleteLease(w http.ResponseWriter, r *http.Request) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	part, err := reader.NextPart()
+	if err != nil || part.FormName() != "result" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("expected a result part first"))
+		return
+	}
+	var result apiTaskResult
+	if err := json.NewDecoder(part).Decode(&result); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid result: %w", err))
+		return
+	}
+
+	err = s.coordinator.Complete(r.PathValue("id"), result.Error, result.Log, result.Usage, func() (*LeaseOutput, error) {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		name := part.FileName()
+		if part.FormName() != "output" || name == "" || name == "." || name == "/" {
+			return nil, fmt.Errorf("unexpected part %q", part.FormName())
+		}
+		return &LeaseOutput{Name: name, Reader: part}, nil
+	})
+	if errors.Is(err, ErrLeaseNotFound) {
+		writeError(w, http.StatusGone, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// execute runs the pipeline until no step has work left, re-reading the manifest
+// first so edited steps get new versions. It returns the manifest's hooks for
+// the end of the run.
+func (s *apiServer) execute(runID int64) (executed int64, hooks Hooks, err error) {
+	manifest, err := LoadManifest(s.manifestPath, s.vars)
+	if err != nil {
+		return 0, hooks, err
+	}
+	hooks = manifest.Hooks
+
+	ctx, span := tracer.Start(withRun(traceRoot(), runID, hooks), "run", trace.WithAttributes(attribute.Int64("grit.run.id", runID)))
+	defer func() {
+		span.SetAttributes(attribute.Int64("grit.tasks_executed", executed))
+		endSpan(span, err)
+	}()
+
+	steps, byName, err := registerSteps(manifest, s.database, s.enabledSteps)
+	if err != nil {
+		return 0, hooks, err
+	}
+	if s.coordinator != nil {
+		executed, err = s.coordinator.Run(ctx, steps)
+		return executed, hooks, err
+	}
+	if err := seedPipeline(ctx, s.database, s.pipeline, steps, byName); err != nil {
+		return 0, hooks, err
+	}
+
+	executed, err = runPasses(ctx, s.pipeline, steps, s.parallel)
+	return executed, hooks, err
+}
+
+func (s *apiServer) lookupTask(w http.ResponseWriter, r *http.Request) (*Task, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid task id %q", r.PathValue("id")))
+		return nil, false
+	}
+	task, err := s.database.GetTask(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if task == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("task %d not found", id))
+		return nil, false
+	}
+	return task, true
+}
+
+func (s *apiServer) stepsByID() map[int64]Step {
+	steps := make(map[int64]Step)
+	for step := range s.database.ListSteps() {
+		steps[step.ID] = step
+	}
+	return steps
+}
+
+func (s *apiServer) describeTask(task Task, steps map[int64]Step) apiTask {
+	step := steps[task.StepID]
+	t := apiTask{
+		ID:          task.ID,
+		Step:        step.Name,
+		StepVersion: step.Version,
+		State:       task.State,
+		Error:       task.Error,
+		InputID:     task.InputResourceID,
+		StartedAt:   task.StartedAt,
+		FinishedAt:  task.FinishedAt,
+		Host:        task.Host,
+		PID:         task.PID,
+		Usage:       task.Usage,
+		RunID:       task.RunID,
+	}
+	if s.coordinator != nil {
+		if lease := s.coordinator.LeaseOf(task.ID); lease != nil {
+			t.Worker = lease.Worker
+		}
+	}
+	return t
+}
+
+func (s *apiServer) readOnly() bool {
+	return s.pipeline == nil && s.coordinator == nil
+}
+
+func queryInt(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number %q", value)
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		serveLogger.Debug("Failed to write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAPIRefusesForeignRequests(t *testing.T) {
+	database, err := NewDatabase(filepath.Join(t.TempDir(), "db"), DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	tests := []struct {
+		name    string
+		listen  string
+		method  string
+		host    string
+		headers map[string]string
+		want    int
+	}{
+		{"loopback host", "127.0.0.1:8420", "GET", "127.0.0.1:8420", nil, http.StatusOK},
+		{"localhost", "127.0.0.1:8420", "GET", "localhost:8420", nil, http.StatusOK},
+		{"ipv6 loopback", "127.0.0.1:8420", "GET", "[::1]:8420", nil, http.StatusOK},
+		{"rebound name", "127.0.0.1:8420", "GET", "attacker.example:8420", nil, http.StatusForbidden},
+		{"rebound name posting", "127.0.0.1:8420", "POST", "attacker.example:8420", map[string]string{"Origin": "http://attacker.example:8420", "Content-Type": "application/json"}, http.StatusForbidden},
+		{"listen host", "grit.internal:8420", "GET", "grit.internal:8420", nil, http.StatusOK},
+		{"other name of a named listener", "grit.internal:8420", "GET", "attacker.example", nil, http.StatusForbidden},
+		{"every address", "0.0.0.0:8420", "GET", "coordinator-host:8420", nil, http.StatusOK},
+		{"foreign origin", "127.0.0.1:8420", "POST", "127.0.0.1:8420", map[string]string{"Origin": "http://attacker.example", "Content-Type": "application/json"}, http.StatusForbidden},
+		{"form post", "127.0.0.1:8420", "POST", "127.0.0.1:8420", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, http.StatusUnsupportedMediaType},
+		{"own origin", "127.0.0.1:8420", "POST", "127.0.0.1:8420", map[string]string{"Origin": "http://127.0.0.1:8420", "Content-Type": "application/json"}, http.StatusMethodNotAllowed},
+		{"client header", "127.0.0.1:8420", "POST", "127.0.0.1:8420", map[string]string{apiClientHeader: "test"}, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without a pipeline the server is read-only, so POSTs that get past the checks find no route
+			api := &apiServer{database: database, listen: tt.listen}
+			req := httptest.NewRequest(tt.method, "/api/status", strings.NewReader("{}"))
+			req.Host = tt.host
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			api.routes().ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// statsCommand prints per-step percentiles of the time and resources tasks used,
+// and the slowest tasks. Each step version gets its own row so a script edit that
+// makes a step slower shows up next to the version before it.
+func statsCommand(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	addLogFlags(fs)
+	dbFlags := addDatabaseFlags(fs)
+	stepName := fs.String("step", "", "only show this step")
+	slowest := fs.Int("slowest", 10, "number of slowest tasks to list (0 for none)")
+	commandUsage(fs, "stats [-db PATH] [--step NAME] [--slowest N]")
+	if len(parseArgs(fs, args)) != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	database := dbFlags.open(DatabaseOptions{ReadOnly: true})
+	defer database.Close()
+
+	tasks, err := database.ListTaskStats(*stepName)
+	if err != nil {
+		fatal("Failed to list tasks", "error", err)
+	}
+	if len(tasks) == 0 {
+		fmt.Println("No finished tasks with recorded usage")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tVERSION\tTASKS\tFAILED\tWALL P50\tP90\tP99\tMAX\tCPU P50\tP90\tMAX\tRSS P50\tMAX\tIN\tOUT")
+	// Tasks are ordered by step and version, so each group is a contiguous run
+	for start := 0; start < len(tasks); {
+		end := start
+		for end < len(tasks) && tasks[end].StepName == tasks[start].StepName && tasks[end].StepVersion == tasks[start].StepVersion {
+			end++
+		}
+		group := tasks[start:end]
+
+		var failed int
+		var wall, cpu, rss []int64
+		var bytesIn, bytesOut int64
+		for _, t := range group {
+			if t.Error != nil {
+				failed++
+			}
+			wall = append(wall, t.Usage.WallMS)
+			cpu = append(cpu, t.Usage.UserCPUMS+t.Usage.SysCPUMS)
+			rss = append(rss, t.Usage.MaxRSSKB)
+			bytesIn += t.Usage.BytesIn
+			bytesOut += t.Usage.BytesOut
+		}
+		slices.Sort(wall)
+		slices.Sort(cpu)
+		slices.Sort(rss)
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			group[0].StepName, group[0].StepVersion, len(group), failed,
+			formatMillis(percentile(wall, 50)), formatMillis(percentile(wall, 90)), formatMillis(percentile(wall, 99)), formatMillis(wall[len(wall)-1]),
+			formatMillis(percentile(cpu, 50)), formatMillis(percentile(cpu, 90)), formatMillis(cpu[len(cpu)-1]),
+			formatBytes(percentile(rss, 50)*1024), formatBytes(rss[len(rss)-1]*1024),
+			formatBytes(bytesIn), formatBytes(bytesOut))
+		start = end
+	}
+	w.Flush()
+
+	if *slowest <= 0 {
+		return
+	}
+	slices.SortStableFunc(tasks, func(a, b TaskStats) int {
+		return int(b.Usage.WallMS - a.Usage.WallMS)
+	})
+	tasks = tasks[:min(*slowest, len(tasks))]
+
+	fmt.Printf("\nSlowest %d task(s):\n", len(tasks))
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tSTEP\tVERSION\tSTATE\tWALL\tCPU\tMAX RSS\tEXIT\tHOST")
+	for _, t := range tasks {
+		exit := ""
+		if t.Usage.ExitCode != nil {
+			exit = fmt.Sprint(*t.Usage.ExitCode)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			t.ID, t.StepName, t.StepVersion, t.State,
+			formatMillis(t.Usage.WallMS), formatMillis(t.Usage.UserCPUMS+t.Usage.SysCPUMS), formatBytes(t.Usage.MaxRSSKB*1024),
+			exit, t.Host)
+	}
+	w.Flush()
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted, which must not be empty
+func percentile(sorted []int64, p float64) int64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
+
+func formatMillis(ms int64) string {
+	d := time.Duration(ms) * time.Millisecond
+	if d >= time.Minute {
+		return d.Round(time.Second).String()
+	}
+	return d.String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
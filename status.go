@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// statusCommand prints per-step task counts. It opens the database read-only,
+// so it can be used to watch a pipeline that is currently running.
+func statusCommand(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	addLogFlags(fs)
+	dbFlags := addDatabaseFlags(fs)
+	commandUsage(fs, "status [-db PATH]")
+	fs.Parse(args)
+
+	database := dbFlags.open(DatabaseOptions{ReadOnly: true})
+	defer database.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tVERSION\tTASKS\tDONE\tFAILED\tPENDING")
+
+	for step := range database.ListSteps() {
+		total, processed, err := database.GetTaskCountsForStep(step.ID)
+		if err != nil {
+			fatal("Failed to count tasks", "step", step.Name, "error", err)
+		}
+		failed, err := database.CountFailedTasksForStep(step.ID)
+		if err != nil {
+			fatal("Failed to count failed tasks", "step", step.Name, "error", err)
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\n", step.Name, step.Version, total, processed-failed, failed, total-processed)
+	}
+	w.Flush()
+
+	resources, err := database.CountResources()
+	if err != nil {
+		fatal("Failed to count resources", "error", err)
+	}
+	fmt.Printf("\n%d resource(s)\n", resources)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracingLogger = NewLogger("TRACE")
+
+// tracer records spans for runs, steps and tasks. Until setupTracing installs an
+// exporter it is a no-op, and so is everything that uses it.
+var tracer = otel.Tracer("grit")
+
+// tracePropagator reads and writes W3C trace context (TRACEPARENT and TRACESTATE)
+var tracePropagator = propagation.TraceContext{}
+
+// setupTracing exports spans as described by spec:
+//
+//	otlp               OTLP over HTTP, configured by the OTEL_EXPORTER_OTLP_* variables
+//	http://HOST:PORT   OTLP over HTTP to this collector (https:// too)
+//	file:PATH          one JSON span per line, appended to PATH
+//
+// The returned function flushes buffered spans and must be called before exiting.
+func setupTracing(spec string) (func(), error) {
+	ctx := context.Background()
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	var file *os.File
+	switch {
+	case spec == "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(strings.TrimSuffix(spec, "/")+"/v1/traces"))
+	case strings.HasPrefix(spec, "file:"):
+		file, err = os.OpenFile(strings.TrimPrefix(spec, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q (expected otlp, http://HOST:PORT or file:PATH)", spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("grit")))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	tracingLogger.Debug("Exporting traces", "exporter", spec)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			tracingLogger.Error("Failed to flush traces", "error", err)
+		}
+		if file != nil {
+			file.Close()
+		}
+	}, nil
+}
+
+// traceRoot returns a context for a run's root span. If grit itself was started
+// with TRACEPARENT set, runs nest under the caller's span.
+func traceRoot() context.Context {
+	carrier := propagation.MapCarrier{}
+	for _, key := range tracePropagator.Fields() {
+		if value := os.Getenv(strings.ToUpper(key)); value != "" {
+			carrier[key] = value
+		}
+	}
+	return tracePropagator.Extract(context.Background(), carrier)
+}
+
+// traceHeaders returns the W3C trace context of the span in ctx, keyed by
+// lower-case header name, or nil if ctx has no recording span
+func traceHeaders(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	return carrier
+}
+
+// traceEnv turns trace headers into environment variables for a script
+// (TRACEPARENT and TRACESTATE)
+func traceEnv(headers map[string]string) []string {
+	var env []string
+	for key, value := range headers {
+		env = append(env, strings.ToUpper(key)+"="+value)
+	}
+	return env
+}
+
+// taskSpanAttributes identify a task on its span
+func taskSpanAttributes(taskID int64, step Step) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.Int64("grit.task.id", taskID),
+		attribute.String("grit.step.name", step.Name),
+		attribute.Int("grit.step.version", step.Version),
+	)
+}
+
+// endSpan records err (if any) on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
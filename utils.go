@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"syscall"
 )
@@ -21,7 +22,7 @@ func checkDiskSpace(dbPath string) {
 	percentUsed := (usedGB / totalGB) * 100
 
 	if percentUsed > 85 {
-		mainLogger.Printf("⚠️  Disk %s is %.1f%% full (%.1fGB free / %.1fGB total). This may cause database slowness.\n", dbPath, percentUsed, availableGB, totalGB)
+		mainLogger.Warn("Disk almost full, this may cause database slowness", "path", dbPath, "percent_used", math.Round(percentUsed*10)/10, "free_gb", math.Round(availableGB*10)/10, "total_gb", math.Round(totalGB*10)/10)
 	}
 }
 
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+var manifestLogger = NewLogger("MANIFEST")
+
+// validateCommand checks a manifest and prints every problem with its position.
+// It exits 1 if there are errors (or, with -strict, warnings).
+func validateCommand(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	addLogFlags(fs)
+	manifestPath := fs.String("manifest", "", "manifest path (or give it as an argument)")
+	strict := fs.Bool("strict", false, "fail on warnings too")
+	vars := addVarFlag(fs)
+	commandUsage(fs, "validate [--strict] [-var NAME=VALUE] MANIFEST")
+	positional := parseArgs(fs, args)
+	if len(positional) == 1 && *manifestPath == "" {
+		*manifestPath = positional[0]
+	} else if len(positional) != 0 || *manifestPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	manifest, problems, err := CheckManifest(*manifestPath, vars)
+	if err != nil {
+		fatal("Failed to read manifest", "path", *manifestPath, "error", err)
+	}
+
+	var errorCount, warningCount int
+	for _, p := range problems {
+		fmt.Println(p)
+		if p.Warning {
+			warningCount++
+		} else {
+			errorCount++
+		}
+	}
+	if errorCount == 0 && warningCount == 0 {
+		fmt.Printf("%s: OK (%d steps, %d included files)\n", *manifestPath, len(manifest.Steps), len(manifest.Included))
+		return
+	}
+	fmt.Printf("%s: %d errors, %d warnings\n", *manifestPath, errorCount, warningCount)
+	if errorCount > 0 || *strict {
+		os.Exit(1)
+	}
+}
+
+// ManifestProblem is something CheckManifest found wrong with a manifest or a
+// file it includes. Line and Col are 0 when the problem has no single position.
+type ManifestProblem struct {
+	File    string
+	Line    int
+	Col     int
+	Warning bool
+	Message string
+}
+
+func (p ManifestProblem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s: %s", p.File, level, p.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", p.File, p.Line, p.Col, level, p.Message)
+}
+
+// tomlErrorPosition matches the "(line, col): " go-toml puts before its errors
+var tomlErrorPosition = regexp.MustCompile(`^\((\d+), (\d+)\): (.*)$`)
+
+// CheckManifest reads the manifest at path, with the files it includes and vars
+// overriding its [vars], and reports every problem with them: TOML errors,
+// unknown keys, includes that match nothing, unknown variables, duplicate or
+// missing step names, start steps, invalid settings, inputs no step writes and
+// steps that never get tasks. The error is only for a manifest that cannot be read.
+func CheckManifest(path string, vars map[string]string) (Manifest, []ManifestProblem, error) {
+	c := manifestChecker{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Manifest{}, nil, err
+	}
+	manifest, root, ok := c.parse(path, data)
+	if !ok {
+		return manifest, c.problems, nil
+	}
+	c.manifest = manifest
+	c.root = root
+	c.files = []string{path}
+	c.steps = root.steps()
+	if manifest.Namespace != "" {
+		c.warnf(root, "namespace", "namespace is only used in included files")
+	}
+	c.include(root, manifest.Include, "", map[string]bool{absPath(path): true})
+	c.expandMatrix()
+	c.interpolateVars(vars)
+	c.resolveWorkdirs()
+
+	c.check()
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		a, b := c.problems[i], c.problems[j]
+		fa, fb := slices.Index(c.files, a.File), slices.Index(c.files, b.File)
+		return fa < fb || fa == fb && (a.Line < b.Line || a.Line == b.Line && a.Col < b.Col)
+	})
+	return c.manifest, c.problems, nil
+}
+
+// parse decodes one manifest file, recording a problem if it is not valid TOML
+// or does not fit the Manifest
+func (c *manifestChecker) parse(path string, data []byte) (Manifest, manifestTable, bool) {
+	var manifest Manifest
+	tree, err := toml.LoadBytes(data)
+	if err == nil {
+		err = tree.Unmarshal(&manifest)
+	}
+	if err != nil {
+		c.problems = append(c.problems, tomlProblem(path, err))
+		return manifest, manifestTable{}, false
+	}
+	return manifest, manifestTable{tree, path}, true
+}
+
+// include adds the steps of the files matching patterns to the manifest, with
+// their names prefixed by the namespace of their file. Patterns are globs
+// relative to the including file; included files may include others.
+func (c *manifestChecker) include(from manifestTable, patterns []string, namespace string, seen map[string]bool) {
+	for _, pattern := range patterns {
+		path := pattern
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(from.file), path)
+		}
+		files, err := filepath.Glob(path)
+		if err != nil {
+			c.errorf(from, "include", "invalid include pattern %q: %v", pattern, err)
+			continue
+		}
+		if len(files) == 0 {
+			c.errorf(from, "include", "include %q matches no files", pattern)
+			continue
+		}
+		for _, file := range files {
+			if seen[absPath(file)] {
+				c.errorf(from, "include", "%s is included more than once", file)
+				continue
+			}
+			seen[absPath(file)] = true
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				c.errorf(from, "include", "%v", err)
+				continue
+			}
+			included, table, ok := c.parse(file, data)
+			c.files = append(c.files, file)
+			c.manifest.Included = append(c.manifest.Included, file)
+			if !ok {
+				continue
+			}
+
+			if included.ObjectStore != "" {
+				c.errorf(table, "object_store", "object_store is only allowed in the main manifest")
+			}
+			if table.Has("hooks") {
+				c.errorf(table, "hooks", "hooks are only allowed in the main manifest")
+			}
+			if table.Has("vars") {
+				c.errorf(table, "vars", "vars are only allowed in the main manifest")
+			}
+			ns := included.Namespace
+			if ns == "" {
+				ns = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+			}
+			if namespace != "" {
+				ns = namespace + "." + ns
+			}
+			for _, step := range included.Steps {
+				if step.Name != "" {
+					step.Name = ns + "." + step.Name
+				}
+				c.manifest.Steps = append(c.manifest.Steps, step)
+			}
+			c.steps = append(c.steps, table.steps()...)
+			c.include(table, included.Include, ns, seen)
+		}
+	}
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func tomlProblem(path string, err error) ManifestProblem {
+	m := tomlErrorPosition.FindStringSubmatch(err.Error())
+	if m == nil {
+		return ManifestProblem{File: path, Message: err.Error()}
+	}
+	line, _ := strconv.Atoi(m[1])
+	col, _ := strconv.Atoi(m[2])
+	return ManifestProblem{File: path, Line: line, Col: col, Message: m[3]}
+}
+
+// manifestTable is a table of a manifest file, so problems can point into the right file
+type manifestTable struct {
+	*toml.Tree
+	file string
+}
+
+// steps returns the [[step]] tables of a manifest file
+func (t manifestTable) steps() []manifestTable {
+	trees, _ := t.Get("step").([]*toml.Tree)
+	tables := make([]manifestTable, len(trees))
+	for i, tree := range trees {
+		tables[i] = manifestTable{tree, t.file}
+	}
+	return tables
+}
+
+// position is where key is set in the table, or where the table starts if
+// key is empty or not set
+func (t manifestTable) position(key string) toml.Position {
+	if pos := t.GetPosition(key); key != "" && !pos.Invalid() {
+		return pos
+	}
+	return t.Position()
+}
+
+type manifestChecker struct {
+	manifest Manifest
+	root     manifestTable
+	files    []string        // the manifest and the files it includes, in order
+	steps    []manifestTable // the [[step]] tables, in the order of manifest.Steps
+	problems []ManifestProblem
+}
+
+func (c *manifestChecker) errorf(table manifestTable, key string, format string, args ...any) {
+	pos := table.position(key)
+	c.problems = append(c.problems, ManifestProblem{File: table.file, Line: pos.Line, Col: pos.Col, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *manifestChecker) warnf(table manifestTable, key string, format string, args ...any) {
+	pos := table.position(key)
+	c.problems = append(c.problems, ManifestProblem{File: table.file, Line: pos.Line, Col: pos.Col, Warning: true, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *manifestChecker) check() {
+	c.checkKeys(c.root, "", reflect.TypeOf(Manifest{}))
+	if hooks, ok := c.root.Get("hooks").(*toml.Tree); ok {
+		c.checkKeys(manifestTable{hooks, c.root.file}, "hooks.", reflect.TypeOf(Hooks{}))
+	}
+	for _, step := range c.steps {
+		c.checkKeys(step, "step.", reflect.TypeOf(ManifestStep{}))
+	}
+
+	if c.manifest.ObjectStore != "" && !validObjectStoreSpec(c.manifest.ObjectStore) {
+		c.errorf(c.root, "object_store", "unknown object store %q (expected badger, dir, dir:PATH or s3://BUCKET/PREFIX)", c.manifest.ObjectStore)
+	}
+	if len(c.manifest.Steps) == 0 {
+		c.errorf(c.root, "", "no steps: add a [[step]] table")
+		return
+	}
+	if len(c.steps) != len(c.manifest.Steps) {
+		// Unmarshal succeeded so this does not happen, but positions would be wrong
+		return
+	}
+
+	c.checkSteps()
+	c.checkInputs()
+}
+
+// checkKeys warns about keys of table that no field of t (a struct with toml
+// tags) takes. They would be silently ignored.
+func (c *manifestChecker) checkKeys(table manifestTable, prefix string, t reflect.Type) {
+	var known []string
+	for i := range t.NumField() {
+		if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("toml"), ","); tag != "" && tag != "-" {
+			known = append(known, tag)
+		}
+	}
+	for _, key := range table.Keys() {
+		if slices.Contains(known, key) {
+			continue
+		}
+		if suggestion := closest(key, known); suggestion != "" {
+			c.warnf(table, key, "unknown key %q is ignored (did you mean %q?)", prefix+key, suggestion)
+		} else {
+			c.warnf(table, key, "unknown key %q is ignored", prefix+key)
+		}
+	}
+}
+
+func (c *manifestChecker) checkSteps() {
+	firstByName := make(map[string]manifestTable)
+	var starts []string
+	for i, step := range c.manifest.Steps {
+		table := c.steps[i]
+		first, duplicate := firstByName[step.Name]
+		switch {
+		case step.Name == "":
+			c.errorf(table, "", "step has no name")
+		case duplicate:
+			c.errorf(table, "name", "duplicate step name %q (first defined at %s:%d)", step.Name, first.file, first.position("name").Line)
+		default:
+			firstByName[step.Name] = table
+		}
+		if strings.TrimSpace(step.Script) == "" {
+			c.errorf(table, "script", "step %q has no script", step.Name)
+		}
+		if step.Start {
+			starts = append(starts, step.Name)
+			if len(starts) > 1 {
+				c.errorf(table, "start", "step %q is a second start step (%q is already one); only one step can seed the pipeline", step.Name, starts[0])
+			}
+		} else if len(step.Inputs) == 0 {
+			c.warnf(table, "", "step %q has no inputs and is not the start step, so it never gets tasks", step.Name)
+		}
+		if step.Parallel != nil && *step.Parallel < 1 {
+			c.errorf(table, "parallel", "step %q: parallel must be at least 1", step.Name)
+		}
+		if _, err := ParseCompression(step.Compress); err != nil {
+			c.errorf(table, "compress", "step %q: %v", step.Name, err)
+		}
+		if _, err := ParseScriptRunner(step); err != nil {
+			c.errorf(table, "", "step %q: %v", step.Name, err)
+		}
+		if rules, err := ParseOutputRules(step); err != nil {
+			c.errorf(table, "outputs", "step %q: %v", step.Name, err)
+		} else if names, _ := scriptOutputs(step.Script); !rules.WarnUndeclared {
+			for _, name := range names {
+				if !rules.allows(name) {
+					c.warnf(table, "script", "step %q: script writes %q, which is not in outputs and will be refused", step.Name, name)
+				}
+			}
+		}
+	}
+	if len(starts) == 0 {
+		c.warnf(c.steps[0], "", "no start step: the pipeline only runs on imported resources")
+	}
+}
+
+// checkInputs reports inputs no step writes and steps that can never get tasks.
+// The resources a step writes are its declared outputs or are guessed from its
+// script; if any step's outputs cannot be known statically, only likely typos
+// are reported.
+func (c *manifestChecker) checkInputs() {
+	written := make(map[string][]int) // resource name -> steps writing it
+	allKnown := true
+	for i, step := range c.manifest.Steps {
+		names, known := stepOutputs(step)
+		allKnown = allKnown && known
+		for _, name := range names {
+			written[name] = append(written[name], i)
+		}
+	}
+	writtenNames := make([]string, 0, len(written))
+	for name := range written {
+		writtenNames = append(writtenNames, name)
+	}
+	sort.Strings(writtenNames)
+
+	unwritten := make(map[string]bool)
+	for i, step := range c.manifest.Steps {
+		for _, input := range step.Inputs {
+			if _, ok := written[input]; ok {
+				continue
+			}
+			unwritten[input] = true
+			if suggestion := closest(input, writtenNames); suggestion != "" {
+				// Imported resources can be named anything, so a near miss is only a warning
+				c.warnf(c.steps[i], "inputs", "step %q: input %q is not written by any step (did you mean %q? fine if it is imported)", step.Name, input, suggestion)
+			} else if allKnown {
+				c.warnf(c.steps[i], "inputs", "step %q: input %q is not written by any step (fine if it is imported)", step.Name, input)
+			}
+		}
+	}
+	if !allKnown {
+		return
+	}
+
+	// A step is reachable from the start step, or from resources only imports
+	// can provide, through the resources steps write
+	reached := make([]bool, len(c.manifest.Steps))
+	for changed := true; changed; {
+		changed = false
+		for i, step := range c.manifest.Steps {
+			if reached[i] {
+				continue
+			}
+			for _, input := range step.Inputs {
+				if unwritten[input] || slices.ContainsFunc(written[input], func(j int) bool { return reached[j] }) {
+					reached[i] = true
+				}
+			}
+			if step.Start {
+				reached[i] = true
+			}
+			changed = changed || reached[i]
+		}
+	}
+	for i, step := range c.manifest.Steps {
+		if !reached[i] && len(step.Inputs) > 0 {
+			c.warnf(c.steps[i], "", "step %q is unreachable: its inputs are only written by steps that never run", step.Name)
+		}
+	}
+}
+
+// stepOutputs returns the resource names a step writes: its declared outputs,
+// or else the names read from its script, with the suffix of its matrix parameters
+func stepOutputs(step ManifestStep) (names []string, known bool) {
+	if len(step.Outputs) > 0 {
+		names, known = slices.Clone(step.Outputs), true
+	} else {
+		names, known = scriptOutputs(step.Script)
+		for _, name := range step.RequiredOutputs {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	for i := range names {
+		names[i] += matrixSuffix(step.Params)
+	}
+	return names, known
+}
+
+// outputPath matches a file a script writes into $OUTPUT_DIR
+var outputPath = regexp.MustCompile(`\$(?:\{OUTPUT_DIR\}|OUTPUT_DIR\b)"?/([^\s"'<>|;&)]*)`)
+
+// scriptOutputs guesses the resource names a script writes from its
+// $OUTPUT_DIR/NAME paths. known is false if a name is computed at runtime or
+// the script uses OUTPUT_DIR some other way.
+func scriptOutputs(script string) (names []string, known bool) {
+	matches := outputPath.FindAllStringSubmatch(script, -1)
+	if strings.Count(script, "OUTPUT_DIR") != len(matches) {
+		return nil, false
+	}
+	for _, m := range matches {
+		name := resourceName(m[1])
+		if name == "" || strings.ContainsAny(name, "$`*?[{(\\") {
+			return nil, false
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, true
+}
+
+// closest returns the candidate within two edits of s, or "" if there is none
+func closest(s string, candidates []string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range candidates {
+		if d := editDistance(s, candidate); d < bestDistance && d > 0 {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// checkManifest writes manifest to a file and returns the problems
+// CheckManifest finds with it, without the file name
+func checkManifest(t *testing.T, manifest string) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "grit.toml")
+	if err := os.WriteFile(path, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, problems, err := CheckManifest(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range problems {
+		got = append(got, strings.TrimPrefix(p.String(), path+":"))
+	}
+	return got
+}
+
+func TestCheckManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     []string // problems, each "LINE:COL: LEVEL: " followed by the start of its message
+	}{
+		{"valid", `
+[[step]]
+name = "fetch"
+start = true
+script = "date > $OUTPUT_DIR/raw"
+
+[[step]]
+name = "clean"
+inputs = ["raw"]
+script = "sort $INPUT_FILE > $OUTPUT_DIR/clean"
+`, nil},
+		{"typo in inputs", `
+[[step]]
+name = "fetch"
+start = true
+script = "date > $OUTPUT_DIR/raw"
+
+[[step]]
+name = "clean"
+inputs = ["rwa"]
+script = "sort $INPUT_FILE > $OUTPUT_DIR/clean"
+`, []string{`9:1: warning: step "clean": input "rwa" is not written by any step (did you mean "raw"?`}},
+		{"unknown keys", `
+[[step]]
+name = "fetch"
+start = true
+scirpt = "true"
+script = "true"
+timeout = "1m"
+`, []string{
+			`5:1: warning: unknown key "step.scirpt" is ignored (did you mean "script"?)`,
+			`7:1: warning: unknown key "step.timeout" is ignored`,
+		}},
+		{"duplicate names and second start", `
+[[step]]
+name = "fetch"
+start = true
+script = "true"
+
+[[step]]
+name = "fetch"
+start = true
+script = "true"
+`, []string{
+			`8:1: error: duplicate step name "fetch" (first defined at `,
+			`9:1: error: step "fetch" is a second start step`,
+		}},
+		{"missing name and script", `
+[[step]]
+start = true
+script = " "
+`, []string{
+			`2:1: error: step has no name`,
+			`4:1: error: step "" has no script`,
+		}},
+		{"invalid settings", `
+[[step]]
+name = "fetch"
+start = true
+parallel = 0
+compress = "gzip"
+script = "true"
+`, []string{
+			`5:1: error: step "fetch": parallel must be at least 1`,
+			`6:1: error: step "fetch": `,
+		}},
+		{"unreachable step", `
+[[step]]
+name = "fetch"
+start = true
+script = "true"
+
+[[step]]
+name = "left"
+inputs = ["right"]
+script = "cp $INPUT_FILE $OUTPUT_DIR/left"
+
+[[step]]
+name = "right"
+inputs = ["left"]
+script = "cp $INPUT_FILE $OUTPUT_DIR/right"
+`, []string{
+			`7:1: warning: step "left" is unreachable`,
+			`12:1: warning: step "right" is unreachable`,
+		}},
+		{"no start step", `
+[[step]]
+name = "clean"
+inputs = ["raw"]
+script = "sort $INPUT_FILE > $OUTPUT_DIR/clean"
+`, []string{
+			`2:1: warning: no start step: the pipeline only runs on imported resources`,
+			`4:1: warning: step "clean": input "raw" is not written by any step (fine if it is imported)`,
+		}},
+		{"no steps", `object_store = "tape"`, []string{
+			`1:1: error: unknown object store "tape"`,
+			`1:1: error: no steps`,
+		}},
+		{"invalid TOML", "[[step]\nname = 1", []string{`1:`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkManifest(t, tt.manifest)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got problems:\n%s\nwant %d", strings.Join(got, "\n"), len(tt.want))
+			}
+			for i := range got {
+				if !strings.HasPrefix(got[i], tt.want[i]) {
+					t.Errorf("problem %d: got %s, want %s...", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestScriptOutputs(t *testing.T) {
+	tests := []struct {
+		script string
+		want   []string
+		known  bool
+	}{
+		{"date > $OUTPUT_DIR/raw", []string{"raw"}, true},
+		{`cp a "${OUTPUT_DIR}/model_1"; cp b $OUTPUT_DIR/model_2 && cp c $OUTPUT_DIR/log`, []string{"model", "log"}, true},
+		{"true", nil, true},
+		{"cp a $OUTPUT_DIR/$NAME", nil, false},
+		{"cp * $OUTPUT_DIR", nil, false},
+		{"cd $OUTPUT_DIR && touch out", nil, false},
+	}
+	for _, tt := range tests {
+		got, known := scriptOutputs(tt.script)
+		if !slices.Equal(got, tt.want) || known != tt.known {
+			t.Errorf("scriptOutputs(%q) = %v, %v, want %v, %v", tt.script, got, known, tt.want, tt.known)
+		}
+	}
+}
+
+func TestClosest(t *testing.T) {
+	candidates := []string{"raw", "clean", "model"}
+	tests := []struct {
+		s, want string
+	}{
+		{"rwa", "raw"},
+		{"claen", "clean"},
+		{"models", "model"},
+		{"raw", ""}, // an exact match is not a typo
+		{"features", ""},
+	}
+	for _, tt := range tests {
+		if got := closest(tt.s, candidates); got != tt.want {
+			t.Errorf("closest(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
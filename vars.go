@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// varPattern matches {{name}} and {{env.NAME}}, with optional spaces inside the
+// braces. Other uses of {{ (Go or Jinja templates in scripts) are left alone
+// unless they look exactly like a variable.
+var varPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_.-]*)\s*\}\}`)
+
+// varFlags are the -var NAME=VALUE overrides of a manifest's [vars]
+type varFlags map[string]string
+
+func (v varFlags) String() string {
+	return fmt.Sprintf("%v", map[string]string(v))
+}
+
+func (v varFlags) Set(value string) error {
+	name, val, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected NAME=VALUE, got %q", value)
+	}
+	v[name] = val
+	return nil
+}
+
+func addVarFlag(fs *flag.FlagSet) varFlags {
+	vars := varFlags{}
+	fs.Var(vars, "var", "set a manifest variable declared in [vars]: NAME=VALUE (can be used multiple times)")
+	return vars
+}
+
+// interpolate replaces {{name}} in s with vars[name] and {{env.NAME}} with the
+// environment variable NAME. vars may be nil to only allow environment variables.
+func interpolate(s string, vars map[string]string) (string, error) {
+	return substitute(s, vars, true)
+}
+
+// versionTemplate replaces {{name}} in s with vars[name] like interpolate, but
+// leaves {{env.NAME}} as written, so the result can be stored without the
+// values of environment variables
+func versionTemplate(s string, vars map[string]string) string {
+	result, _ := substitute(s, vars, false)
+	return result
+}
+
+func substitute(s string, vars map[string]string, resolveEnv bool) (string, error) {
+	var problems []string
+	result := varPattern.ReplaceAllStringFunc(s, func(match string) string {
+		name := varPattern.FindStringSubmatch(match)[1]
+		if env, ok := strings.CutPrefix(name, "env."); ok {
+			if !resolveEnv {
+				return match
+			}
+			value, set := os.LookupEnv(env)
+			if !set {
+				problems = append(problems, fmt.Sprintf("environment variable %s is not set", env))
+			}
+			return value
+		}
+		value, ok := vars[name]
+		if !ok {
+			if vars == nil {
+				problems = append(problems, fmt.Sprintf("{{%s}}: only {{env.NAME}} can be used here", name))
+			} else {
+				problems = append(problems, fmt.Sprintf("unknown variable %q (declare it in [vars])", name))
+			}
+		}
+		return value
+	})
+	if len(problems) > 0 {
+		return s, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return result, nil
+}
+
+// interpolateVars resolves the manifest's [vars] and the -var overrides, and
+// substitutes them into every setting of the manifest and its steps, so steps
+// are versioned by the values they run with. A step's script and env are
+// versioned with {{env.NAME}}, also in the value of a variable, left as
+// written, so secrets passed through the environment never reach the database.
+func (c *manifestChecker) interpolateVars(overrides map[string]string) {
+	vars := make(map[string]string)
+	templates := make(map[string]string) // vars with {{env.NAME}} left as written
+	varsTable := c.root
+	if tree, ok := c.root.Get("vars").(*toml.Tree); ok {
+		varsTable = manifestTable{tree, c.root.file}
+	}
+	for name, value := range c.manifest.Vars {
+		switch value.(type) {
+		case string, int64, float64, bool:
+		default:
+			c.errorf(varsTable, name, "variable %q must be a string, number or boolean", name)
+			continue
+		}
+		resolved, err := interpolate(fmt.Sprint(value), nil)
+		if err != nil {
+			c.errorf(varsTable, name, "variable %q: %v", name, err)
+		}
+		vars[name] = resolved
+		templates[name] = fmt.Sprint(value)
+	}
+
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := c.manifest.Vars[name]; !ok {
+			c.errorf(varsTable, "", "-var %s: no variable %q in [vars]", name, name)
+			continue
+		}
+		vars[name] = overrides[name]
+		templates[name] = overrides[name]
+	}
+
+	c.interpolateFields(c.root, reflect.ValueOf(&c.manifest).Elem(), vars)
+	for i, step := range c.manifest.Steps {
+		stepTemplates := matrixVars(templates, step.Params)
+		c.manifest.Steps[i].ScriptTemplate = versionTemplate(step.Script, stepTemplates)
+		if step.Env != nil {
+			env := make(map[string]string, len(step.Env))
+			for name, value := range step.Env {
+				env[name] = versionTemplate(value, stepTemplates)
+			}
+			c.manifest.Steps[i].EnvTemplate = env
+		}
+		c.interpolateFields(c.steps[i], reflect.ValueOf(&c.manifest.Steps[i]).Elem(), matrixVars(vars, step.Params))
+	}
+}
+
+// notInterpolated are the manifest keys interpolateFields leaves alone: steps
+// are interpolated one by one, and includes and matrices are resolved before
+// variables are known
+var notInterpolated = []string{"step", "vars", "include", "namespace", "matrix"}
+
+// interpolateFields substitutes vars into the string fields (and lists and
+// tables of strings) of v, a struct decoded from table
+func (c *manifestChecker) interpolateFields(table manifestTable, v reflect.Value, vars map[string]string) {
+	for i := range v.NumField() {
+		key, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("toml"), ",")
+		if key == "" || key == "-" || slices.Contains(notInterpolated, key) {
+			continue
+		}
+		replace := func(s string) string {
+			result, err := interpolate(s, vars)
+			if err != nil {
+				c.errorf(table, key, "%s: %v", key, err)
+			}
+			return result
+		}
+
+		// Lists and tables are copied: the steps expanded from a matrix share them
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.String:
+			field.SetString(replace(field.String()))
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String && !field.IsNil():
+			list := reflect.MakeSlice(field.Type(), field.Len(), field.Len())
+			for j := range field.Len() {
+				list.Index(j).SetString(replace(field.Index(j).String()))
+			}
+			field.Set(list)
+		case field.Kind() == reflect.Map && field.Type().Elem().Kind() == reflect.String && !field.IsNil():
+			table := reflect.MakeMapWithSize(field.Type(), field.Len())
+			for _, k := range field.MapKeys() {
+				table.SetMapIndex(k, reflect.ValueOf(replace(field.MapIndex(k).String())))
+			}
+			field.Set(table)
+		case field.Kind() == reflect.Struct:
+			sub := table
+			if tree, ok := table.Get(key).(*toml.Tree); ok {
+				sub = manifestTable{tree, table.file}
+			}
+			c.interpolateFields(sub, field, vars)
+		}
+	}
+}
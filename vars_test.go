@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("GRIT_TEST_HOME", "/home/grit")
+	os.Unsetenv("GRIT_TEST_UNSET")
+	vars := map[string]string{"model": "small", "lr": "0.1", "a.b": "dotted"}
+
+	tests := []struct {
+		s    string
+		vars map[string]string
+		want string
+		err  string // start of the error, or "" for none
+	}{
+		{"train --model {{model}} --lr {{ lr }}", vars, "train --model small --lr 0.1", ""},
+		{"{{env.GRIT_TEST_HOME}}/data/{{model}}", vars, "/home/grit/data/small", ""},
+		{"{{a.b}}", vars, "dotted", ""},
+		{"{{ .Field }} and {{model | upper}} are left alone", vars, "{{ .Field }} and {{model | upper}} are left alone", ""},
+		{"{{env.GRIT_TEST_HOME}}", nil, "/home/grit", ""},
+		{"{{model}}", nil, "", "{{model}}: only {{env.NAME}} can be used here"},
+		{"{{modle}}", vars, "", `unknown variable "modle" (declare it in [vars])`},
+		{"{{env.GRIT_TEST_UNSET}}", vars, "", "environment variable GRIT_TEST_UNSET is not set"},
+		{"{{x}} {{y}}", vars, "", `unknown variable "x" (declare it in [vars]); unknown variable "y"`},
+	}
+	for _, tt := range tests {
+		got, err := interpolate(tt.s, tt.vars)
+		if tt.err == "" && (err != nil || got != tt.want) {
+			t.Errorf("interpolate(%q) = %q, %v, want %q", tt.s, got, err, tt.want)
+		}
+		if tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+			t.Errorf("interpolate(%q): got error %v, want %q", tt.s, err, tt.err)
+		}
+	}
+}
+
+func TestVersionTemplate(t *testing.T) {
+	t.Setenv("GRIT_TEST_SECRET", "hunter2")
+	vars := map[string]string{"model": "small", "token": "{{env.GRIT_TEST_SECRET}}"}
+	tests := []struct {
+		s, want string
+	}{
+		{"train {{model}}", "train small"},
+		{"curl -H {{env.GRIT_TEST_SECRET}}", "curl -H {{env.GRIT_TEST_SECRET}}"},
+		{"curl -H {{token}} {{model}}", "curl -H {{env.GRIT_TEST_SECRET}} small"},
+		{"{{unknown}}", "{{unknown}}"},
+	}
+	for _, tt := range tests {
+		if got := versionTemplate(tt.s, vars); got != tt.want {
+			t.Errorf("versionTemplate(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestVarFlags(t *testing.T) {
+	tests := []struct {
+		value, name, want string
+		ok                bool
+	}{
+		{"model=large", "model", "large", true},
+		{"query=a=b", "query", "a=b", true},
+		{"empty=", "empty", "", true},
+		{"model", "", "", false},
+		{"=large", "", "", false},
+	}
+	for _, tt := range tests {
+		vars := varFlags{}
+		err := vars.Set(tt.value)
+		if (err == nil) != tt.ok || tt.ok && vars[tt.name] != tt.want {
+			t.Errorf("Set(%q): got %v, %v", tt.value, vars, err)
+		}
+	}
+}
+
+const varsManifest = `
+[vars]
+model = "small"
+epochs = 3
+token = "{{env.GRIT_TEST_SECRET}}"
+
+[hooks]
+on_failure = "notify {{model}}"
+
+[[step]]
+name = "train"
+start = true
+script = "train --epochs {{epochs}} --token {{token}} > $OUTPUT_DIR/model"
+env = { MODEL = "{{model}}", SECRET = "{{env.GRIT_TEST_SECRET}}" }
+`
+
+func TestInterpolateVars(t *testing.T) {
+	t.Setenv("GRIT_TEST_SECRET", "hunter2")
+	path := filepath.Join(writeManifests(t, map[string]string{"grit.toml": varsManifest}), "grit.toml")
+
+	tests := []struct {
+		name      string
+		overrides map[string]string
+		script    string
+		env       string // MODEL
+		errors    []string
+	}{
+		{"defaults", nil, "train --epochs 3 --token hunter2 > $OUTPUT_DIR/model", "small", nil},
+		{"override", map[string]string{"model": "large", "epochs": "10"}, "train --epochs 10 --token hunter2 > $OUTPUT_DIR/model", "large", nil},
+		{"undeclared override", map[string]string{"modle": "large"}, "train --epochs 3 --token hunter2 > $OUTPUT_DIR/model", "small",
+			[]string{`-var modle: no variable "modle" in [vars]`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, problems, err := CheckManifest(path, tt.overrides)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var errors []string
+			for _, p := range problems {
+				if !p.Warning {
+					errors = append(errors, p.Message)
+				}
+			}
+			if strings.Join(errors, "\n") != strings.Join(tt.errors, "\n") {
+				t.Errorf("got errors %q, want %q", errors, tt.errors)
+			}
+			step := manifest.Steps[0]
+			if step.Script != tt.script || step.Env["MODEL"] != tt.env || step.Env["SECRET"] != "hunter2" {
+				t.Errorf("got script %q and env %v", step.Script, step.Env)
+			}
+			if strings.Contains(step.ScriptTemplate, "hunter2") || step.EnvTemplate["SECRET"] != "{{env.GRIT_TEST_SECRET}}" || step.EnvTemplate["MODEL"] != tt.env {
+				t.Errorf("got script template %q and env template %v, want the secret left as written", step.ScriptTemplate, step.EnvTemplate)
+			}
+			if manifest.Hooks.OnFailure != "notify "+tt.env {
+				t.Errorf("got hook %q", manifest.Hooks.OnFailure)
+			}
+		})
+	}
+}
+
+func TestVarsVersionSteps(t *testing.T) {
+	path := filepath.Join(writeManifests(t, map[string]string{"grit.toml": varsManifest}), "grit.toml")
+	database, err := NewDatabase(filepath.Join(t.TempDir(), "db"), DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	// Run one after the other against the same database
+	tests := []struct {
+		name      string
+		overrides map[string]string
+		secret    string
+		version   int
+	}{
+		{"first run", nil, "hunter2", 1},
+		{"changed secret", nil, "swordfish", 1},
+		{"changed var used in env", map[string]string{"model": "large"}, "hunter2", 2},
+		{"changed var used in script", map[string]string{"model": "large", "epochs": "10"}, "hunter2", 3},
+		{"back to the defaults", nil, "hunter2", 1},
+	}
+	for _, tt := range tests {
+		t.Setenv("GRIT_TEST_SECRET", tt.secret)
+		manifest, err := LoadManifest(path, tt.overrides)
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps, _, err := registerSteps(manifest, database, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if steps[0].Version != tt.version {
+			t.Errorf("%s: got version %d, want %d", tt.name, steps[0].Version, tt.version)
+		}
+	}
+
+	var leaked int
+	err = database.db.QueryRow("SELECT COUNT(*) FROM step WHERE script LIKE '%hunter2%' OR runner LIKE '%hunter2%' OR script LIKE '%swordfish%' OR runner LIKE '%swordfish%'").Scan(&leaked)
+	if err != nil || leaked != 0 {
+		t.Errorf("got %d steps storing the secret, %v", leaked, err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var watchLogger = NewLogger("WATCH")
+
+// watchCommand imports files from a drop folder as they appear and runs the
+// pipeline on them, keeping one FUSE server and the run lock for its lifetime.
+func watchCommand(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	addLogFlags(fs)
+	dbFlags := addDatabaseFlags(fs)
+	manifestPath := fs.String("manifest", "", "manifest path (required)")
+	dir := fs.String("dir", "", "directory to watch for new or changed files (required)")
+	name := fs.String("name", "", "resource name to import the files as (required)")
+	recordSource := fs.Bool("source", false, "record each file's absolute path as the resource source")
+	compress := fs.String("compress", "", "object compression for imported files: auto, zstd or none (defaults to auto)")
+	settle := fs.Duration("settle", 2*time.Second, "how long a file must be unchanged before it is imported")
+	parallel := fs.Int("parallel", runtime.NumCPU(), "number of processes to run in parallel")
+	var enabledSteps stringSlice
+	fs.Var(&enabledSteps, "step", "steps to run (can be used multiple times)")
+	vars := addVarFlag(fs)
+	traceSpec := fs.String("trace", "", "export trace spans of runs, steps and tasks: otlp, http://HOST:PORT (OTLP collector) or file:PATH (JSON)")
+	metricsAddr := fs.String("metrics-addr", "", "serve Prometheus metrics at /metrics on this address: HOST:PORT or unix:PATH")
+	commandUsage(fs, "watch -manifest PATH --dir DIR --name NAME [-db PATH] [--settle 2s]")
+	fs.Parse(args)
+
+	if *manifestPath == "" || *dir == "" || *name == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	mode, err := ParseCompression(*compress)
+	if err != nil {
+		fatal("Invalid compression", "error", err)
+	}
+
+	manifest, err := LoadManifest(*manifestPath, vars)
+	if err != nil {
+		fatal("Failed to load manifest", "path", *manifestPath, "error", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fatal("Failed to start file watcher", "error", err)
+	}
+	defer watcher.Close()
+
+	storeSpec := *dbFlags.objectStore
+	if storeSpec == "" {
+		storeSpec = manifest.ObjectStore
+	}
+	database := dbFlags.open(DatabaseOptions{ObjectStore: storeSpec})
+	defer database.Close()
+
+	steps, _, err := registerSteps(manifest, database, enabledSteps)
+	if err != nil {
+		fatal("Failed to register steps", "error", err)
+	}
+	watchLogger.Info("Registered steps", "count", len(steps))
+	if *metricsAddr != "" {
+		if err := serveMetrics(*metricsAddr, &database); err != nil {
+			fatal("Failed to serve metrics", "address", *metricsAddr, "error", err)
+		}
+	}
+	if *traceSpec != "" {
+		shutdown, err := setupTracing(*traceSpec)
+		if err != nil {
+			fatal("Failed to set up tracing", "error", err)
+		}
+		defer shutdown()
+	}
+
+	pipeline, err := NewPipeline(&database)
+	if err != nil {
+		fatal("Failed to start FUSE server", "error", err)
+	}
+	defer pipeline.fuseWatcher.Stop()
+
+	w := &dropFolder{
+		database: database,
+		watcher:  watcher,
+		name:     *name,
+		source:   *recordSource,
+		compress: mode,
+		changed:  make(map[string]time.Time),
+	}
+
+	// Watch before the initial scan so nothing written in between is missed
+	if err := w.addDir(*dir); err != nil {
+		fatal("Failed to watch directory", "path", *dir, "error", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer waitForHooks()
+
+	watchLogger.Info("Watching for new files (Ctrl-C to stop)", "path", *dir, "resource", *name)
+
+	tick := time.NewTicker(max(*settle/4, 50*time.Millisecond))
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-signals:
+			watchLogger.Info("Stopping")
+			return
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(event)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			watchLogger.Error("Watch error", "error", err)
+
+		case <-tick.C:
+			if w.importSettled(*settle) == 0 {
+				continue
+			}
+
+			start := time.Now()
+			runID, err := beginRun(database, *manifestPath, vars)
+			if err != nil {
+				watchLogger.Error("Failed to record run", "error", err)
+				continue
+			}
+			ctx, span := tracer.Start(withRun(traceRoot(), runID, manifest.Hooks), "run", trace.WithAttributes(attribute.Int64("grit.run.id", runID)))
+			executions, err := runPasses(ctx, pipeline, steps, *parallel)
+			endSpan(span, err)
+			if err != nil {
+				watchLogger.Error("Run stopped", "run_id", runID, "error", err)
+			}
+			if err := finishRun(database, runID, manifest.Hooks, err); err != nil {
+				watchLogger.Error("Failed to record end of run", "run_id", runID, "error", err)
+			}
+			watchLogger.Info("Batch complete", "run_id", runID, "tasks", executions, "duration", time.Since(start).Round(time.Millisecond))
+		}
+	}
+}
+
+// dropFolder tracks files in a watched directory until they stop changing
+type dropFolder struct {
+	database Database
+	watcher  *fsnotify.Watcher
+	name     string
+	source   bool
+	compress Compression
+
+	changed map[string]time.Time // paths waiting to settle, by last change
+}
+
+// addDir watches dir and everything below it, queueing the files already there
+func (w *dropFolder) addDir(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			watchLogger.Debug("Watching directory", "path", path)
+			return w.watcher.Add(path)
+		}
+		w.queue(path)
+		return nil
+	})
+}
+
+func (w *dropFolder) handle(event fsnotify.Event) {
+	watchLogger.Debug("File event", "path", event.Name, "op", event.Op.String())
+
+	switch {
+	case event.Has(fsnotify.Create):
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			if err := w.addDir(event.Name); err != nil {
+				watchLogger.Error("Failed to watch directory", "path", event.Name, "error", err)
+			}
+			return
+		}
+		w.queue(event.Name)
+	case event.Has(fsnotify.Write):
+		w.queue(event.Name)
+	case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+		delete(w.changed, event.Name)
+	}
+}
+
+// queue marks path as changed. Hidden files are skipped, since rsync and most
+// editors write to a hidden temporary file and rename it into place.
+func (w *dropFolder) queue(path string) {
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return
+	}
+	w.changed[path] = time.Now()
+}
+
+// importSettled imports files that have not changed for settle, returning how
+// many new resources were created
+func (w *dropFolder) importSettled(settle time.Duration) int64 {
+	var ready []string
+	for path, changed := range w.changed {
+		if time.Since(changed) >= settle {
+			ready = append(ready, path)
+			delete(w.changed, path)
+		}
+	}
+	if len(ready) == 0 {
+		return 0
+	}
+
+	before, err := w.database.CountResources()
+	if err != nil {
+		watchLogger.Error("Failed to count resources", "error", err)
+		return 0
+	}
+
+	for _, path := range ready {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue // removed again, or not a file
+		}
+		if err := importFile(w.database, w.name, path, w.source, w.compress); err != nil {
+			watchLogger.Error("Failed to import file", "resource", w.name, "path", path, "error", err)
+		}
+	}
+
+	after, err := w.database.CountResources()
+	if err != nil {
+		watchLogger.Error("Failed to count resources", "error", err)
+		return 0
+	}
+
+	added := after - before
+	watchLogger.Info("Imported files", "resource", w.name, "count", len(ready), "new", added)
+	return added
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func newDropFolder(t *testing.T) *dropFolder {
+	database, err := NewDatabase(filepath.Join(t.TempDir(), "db"), DatabaseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { watcher.Close() })
+	return &dropFolder{database: database, watcher: watcher, name: "raw", compress: CompressAuto, changed: map[string]time.Time{}}
+}
+
+func TestDropFolderEvents(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "batch"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "batch", "inside"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	tests := []struct {
+		name   string
+		events []fsnotify.Event
+		want   []string
+	}{
+		{"created file", []fsnotify.Event{{Name: path("a"), Op: fsnotify.Create}}, []string{"a"}},
+		{"written file", []fsnotify.Event{{Name: path("a"), Op: fsnotify.Write}}, []string{"a"}},
+		{"hidden temporary file", []fsnotify.Event{{Name: path(".a.tmp"), Op: fsnotify.Create}}, nil},
+		{"removed before settling", []fsnotify.Event{
+			{Name: path("a"), Op: fsnotify.Create},
+			{Name: path("a"), Op: fsnotify.Remove},
+		}, nil},
+		{"renamed into place", []fsnotify.Event{
+			{Name: path(".a.tmp"), Op: fsnotify.Create},
+			{Name: path(".a.tmp"), Op: fsnotify.Rename},
+			{Name: path("a"), Op: fsnotify.Create},
+		}, []string{"a"}},
+		{"created directory", []fsnotify.Event{{Name: path("batch"), Op: fsnotify.Create}}, []string{"batch/inside"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newDropFolder(t)
+			for _, event := range tt.events {
+				w.handle(event)
+			}
+			var got []string
+			for _, p := range slices.Sorted(maps.Keys(w.changed)) {
+				rel, _ := filepath.Rel(dir, p)
+				got = append(got, filepath.ToSlash(rel))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("queued %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropFolderImportsSettledFiles(t *testing.T) {
+	w := newDropFolder(t)
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	const settle = time.Hour
+	settled := time.Now().Add(-2 * settle)
+	w.changed[write("old", "old")] = settled
+	w.changed[write("copy", "old")] = settled
+	w.changed[filepath.Join(dir, "gone")] = settled
+	w.changed[write("fresh", "fresh")] = time.Now()
+
+	if added := w.importSettled(settle); added != 1 {
+		t.Errorf("first batch: got %d new resources, want 1", added)
+	}
+	if _, ok := w.changed[filepath.Join(dir, "fresh")]; !ok || len(w.changed) != 1 {
+		t.Errorf("still waiting for %v, want only the fresh file", slices.Collect(maps.Keys(w.changed)))
+	}
+
+	w.changed[filepath.Join(dir, "fresh")] = settled
+	if added := w.importSettled(settle); added != 1 {
+		t.Errorf("second batch: got %d new resources, want 1", added)
+	}
+	// Files whose content is already stored under the name start nothing
+	w.changed[write("fresh", "old")] = settled
+	if added := w.importSettled(settle); added != 0 {
+		t.Errorf("unchanged content: got %d new resources, want 0", added)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+var workerLogger = NewLogger("WORKER")
+
+// workerRetryDelay is how long a worker waits before retrying an unreachable coordinator
+const workerRetryDelay = 5 * time.Second
+
+// errLeaseLost is returned when the coordinator no longer knows a lease, because
+// it expired, the task was cancelled or the coordinator restarted
+var errLeaseLost = errors.New("lease lost")
+
+// workerCommand runs tasks leased from a coordinator (grit serve --remote-workers).
+// Inputs are fetched by hash and outputs uploaded when the script finishes, so
+// workers need no access to the database or object store.
+func workerCommand(args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	addLogFlags(fs)
+	coordinator := fs.String("coordinator", "", "coordinator address: HOST:PORT, http://HOST:PORT or unix:PATH (required)")
+	hostname, _ := os.Hostname()
+	name := fs.String("name", fmt.Sprintf("%s-%d", hostname, os.Getpid()), "worker name shown by the coordinator")
+	parallel := fs.Int("parallel", runtime.NumCPU(), "number of tasks to run in parallel")
+	token := fs.String("token", "", "the coordinator's token (defaults to $GRIT_TOKEN)")
+	checkout := fs.String("checkout", ".", "directory of the coordinator's manifest on this machine, which relative step workdirs are resolved against")
+	commandUsage(fs, "worker --coordinator ADDR [--name NAME] [-parallel N] [--token TOKEN] [--checkout DIR]")
+	if len(parseArgs(fs, args)) != 0 || *coordinator == "" || *parallel < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *token == "" {
+		*token = os.Getenv("GRIT_TOKEN")
+	}
+
+	client := newCoordinatorClient(*coordinator)
+	client.token = *token
+	w := &worker{
+		client:   client,
+		name:     *name,
+		checkout: absPath(*checkout),
+		executor: &ScriptExecutor{processGroups: true},
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	workerLogger.Info("Worker running", "worker", w.name, "parallel", *parallel, "coordinator", *coordinator)
+	var wg sync.WaitGroup
+	for range *parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(ctx)
+		}()
+	}
+	wg.Wait()
+	workerLogger.Info("Worker stopped", "worker", w.name)
+}
+
+type worker struct {
+	client   *coordinatorClient
+	name     string
+	checkout string // what leased workdirs are relative to
+	executor *ScriptExecutor
+}
+
+// loop leases and runs tasks one at a time until ctx is cancelled
+func (w *worker) loop(ctx context.Context) {
+	for ctx.Err() == nil {
+		lease, err := w.client.lease(ctx, w.name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			workerLogger.Warn("Failed to lease a task, retrying", "error", err, "retry_in", workerRetryDelay)
+			select {
+			case <-ctx.Done():
+			case <-time.After(workerRetryDelay):
+			}
+			continue
+		}
+		if lease != nil {
+			w.run(ctx, lease)
+		}
+	}
+}
+
+// run executes a leased task and reports its result. If ctx is cancelled the
+// script is killed and the lease released so another worker picks the task up.
+func (w *worker) run(ctx context.Context, lease *apiLease) {
+	workerLogger.Debug("Running task", "task_id", lease.TaskID, "step", lease.Step, "version", lease.StepVersion)
+
+	taskCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Renew the lease until the script finishes, stopping it if the lease is lost
+	var lost, interrupted bool
+	var mu sync.Mutex
+	heartbeatDone := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		ticker := time.NewTicker(max(time.Duration(lease.TTLSeconds*float64(time.Second))/3, 100*time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-ctx.Done():
+				mu.Lock()
+				interrupted = true
+				mu.Unlock()
+				cancel()
+				return
+			case <-ticker.C:
+				err := w.client.heartbeat(taskCtx, lease.ID)
+				if errors.Is(err, errLeaseLost) {
+					workerLogger.Warn("Lease lost (cancelled or expired), stopping task", "task_id", lease.TaskID, "step", lease.Step)
+					mu.Lock()
+					lost = true
+					mu.Unlock()
+					cancel()
+					return
+				}
+				if err != nil {
+					workerLogger.Debug("Heartbeat failed", "task_id", lease.TaskID, "error", err)
+				}
+			}
+		}
+	}()
+
+	outputDir, output, usage, runErr := w.execute(taskCtx, lease)
+	if outputDir != "" {
+		defer os.RemoveAll(outputDir)
+	}
+	close(finished)
+	<-heartbeatDone
+
+	mu.Lock()
+	defer mu.Unlock()
+	if lost {
+		return
+	}
+	if interrupted {
+		if err := w.client.release(lease.ID); err != nil {
+			workerLogger.Debug("Failed to release task", "task_id", lease.TaskID, "error", err)
+		}
+		return
+	}
+
+	var taskErr *string
+	if runErr != nil {
+		msg := runErr.Error()
+		taskErr = &msg
+	}
+	result := apiTaskResult{Error: taskErr, Log: output, Usage: usage}
+	if err := w.client.complete(lease.ID, result, outputDir); err != nil {
+		workerLogger.Error("Failed to report task result", "task_id", lease.TaskID, "step", lease.Step, "error", err)
+		return
+	}
+
+	if runErr != nil {
+		workerLogger.Error("Task failed", "task_id", lease.TaskID, "step", lease.Step, "error", runErr)
+	} else {
+		workerLogger.Info("Executed task", "task_id", lease.TaskID, "step", lease.Step, "duration", usage.Wall())
+	}
+}
+
+// execute fetches the task's input and runs its script, returning the output
+// directory, the tail of the script's output and what the script used (nil if it
+// did not run)
+func (w *worker) execute(ctx context.Context, lease *apiLease) (string, string, *TaskUsage, error) {
+	inputFile, err := os.CreateTemp("", "input-*")
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to create input file: %w", err)
+	}
+	defer os.Remove(inputFile.Name())
+
+	var bytesIn int64
+	if lease.Input != nil {
+		bytesIn, err = w.client.fetchObject(ctx, lease.Input.Hash, inputFile)
+	}
+	inputFile.Close()
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to get object: %w", err)
+	}
+
+	outputDir, err := os.MkdirTemp("", "output-*")
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// The script's TRACEPARENT points at the task span the coordinator started
+	ctx = tracePropagator.Extract(ctx, propagation.MapCarrier(lease.Trace))
+	step := Step{Name: lease.Step, Script: lease.Script, Params: lease.Params, Runner: lease.Runner}
+	step.Runner.WorkdirBase = w.checkout
+	cmd, cleanup, err := w.executor.buildCommand(ctx, step, inputFile.Name(), outputDir)
+	if err != nil {
+		return outputDir, "", nil, err
+	}
+	defer cleanup()
+	output := newLogTail(maxTaskLogSize)
+	start := time.Now()
+	err = w.executor.runScript(cmd, lease.TaskID, step, output)
+	usage := scriptUsage(cmd, time.Since(start))
+	usage.BytesIn = bytesIn
+	usage.BytesOut = outputSize(outputDir)
+	return outputDir, output.String(), &usage, err
+}
+
+// outputSize is the total size of the outputs that will be uploaded from dir
+func outputSize(dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, entry := range entries {
+		if info, err := os.Stat(filepath.Join(dir, entry.Name())); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// coordinatorClient speaks the lease API served by grit serve --remote-workers
+type coordinatorClient struct {
+	base  string
+	http  *http.Client
+	token string // the coordinator's token, sent as a bearer token
+}
+
+func newCoordinatorClient(address string) *coordinatorClient {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		return &coordinatorClient{base: "http://grit", http: &http.Client{Transport: transport}}
+	}
+
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return &coordinatorClient{base: strings.TrimSuffix(address, "/"), http: &http.Client{}}
+}
+
+// do sends a request and decodes a JSON response into v (if not nil). API errors
+// are returned as errors; 410 Gone as errLeaseLost.
+func (c *coordinatorClient) do(req *http.Request, v any) (int, error) {
+	req.Header.Set(apiClientHeader, "worker")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return resp.StatusCode, errLeaseLost
+	}
+	if resp.StatusCode >= 400 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return resp.StatusCode, fmt.Errorf("coordinator: %s", apiErr.Error)
+		}
+		return resp.StatusCode, fmt.Errorf("coordinator: %s", resp.Status)
+	}
+	if v != nil && resp.StatusCode != http.StatusNoContent {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode, nil
+}
+
+// lease asks for a task, returning nil if the coordinator has none to hand out
+func (c *coordinatorClient) lease(ctx context.Context, worker string) (*apiLease, error) {
+	host, _ := os.Hostname()
+	body, _ := json.Marshal(map[string]any{"worker": worker, "host": host, "pid": os.Getpid()})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+"/api/leases", strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var lease apiLease
+	status, err := c.do(req, &lease)
+	if err != nil || status == http.StatusNoContent {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+func (c *coordinatorClient) heartbeat(ctx context.Context, leaseID string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+"/api/leases/"+leaseID+"/heartbeat", nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req, nil)
+	return err
+}
+
+func (c *coordinatorClient) release(leaseID string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.base+"/api/leases/"+leaseID, nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req, nil)
+	return err
+}
+
+// fetchObject copies an object to dst and returns its size
+func (c *coordinatorClient) fetchObject(ctx context.Context, hash string, dst io.Writer) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+"/api/objects/"+hash, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("coordinator: %s", resp.Status)
+	}
+	return io.Copy(dst, resp.Body)
+}
+
+// complete uploads the result of a task: a "result" part with its error, log and
+// usage, then an "output" part for each file the script wrote
+func (c *coordinatorClient) complete(leaseID string, result apiTaskResult, outputDir string) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeTaskResult(mw, result, outputDir))
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, c.base+"/api/leases/"+leaseID+"/complete", pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	_, err = c.do(req, nil)
+	pr.Close()
+	return err
+}
+
+func writeTaskResult(mw *multipart.Writer, result apiTaskResult, outputDir string) error {
+	part, err := mw.CreateFormField("result")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(part).Encode(result); err != nil {
+		return err
+	}
+
+	if outputDir != "" {
+		entries, err := os.ReadDir(outputDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := writeTaskOutput(mw, filepath.Join(outputDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return mw.Close()
+}
+
+// writeTaskOutput adds one output file. Like the FUSE output directory, only
+// non-empty regular files become resources.
+func writeTaskOutput(mw *multipart.Writer, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		workerLogger.Debug("Skipping output, not a non-empty regular file", "path", path)
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	part, err := mw.CreateFormFile("output", filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}